@@ -0,0 +1,222 @@
+/*
+Copyright 2023 fpf.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EtcdBackupSpec defines the desired state of EtcdBackup
+type EtcdBackupSpec struct {
+	// ClusterName is the EtcdCluster in the same namespace to take the snapshot of.
+	ClusterName string `json:"clusterName"`
+
+	// Destination is where the snapshot is written to.
+	Destination BackupDestination `json:"destination"`
+
+	// DeletionPolicy decides what happens to the snapshot when the EtcdBackup is
+	// deleted. Defaults to Retain.
+	// +kubebuilder:default=Retain
+	// +optional
+	DeletionPolicy BackupDeletionPolicy `json:"deletionPolicy,omitempty"`
+}
+
+// BackupDeletionPolicy decides what happens to a snapshot when its EtcdBackup is deleted.
+// +kubebuilder:validation:Enum=Retain;Delete
+type BackupDeletionPolicy string
+
+const (
+	// BackupDeletionRetain keeps the snapshot.
+	BackupDeletionRetain BackupDeletionPolicy = "Retain"
+	// BackupDeletionDelete deletes the snapshot from its destination together with the EtcdBackup.
+	BackupDeletionDelete BackupDeletionPolicy = "Delete"
+)
+
+// BackupDestination is where a snapshot is kept. Exactly one of PVC, S3 and
+// VolumeSnapshot must be set.
+type BackupDestination struct {
+	// PVC writes the snapshot to a PersistentVolumeClaim.
+	// +optional
+	PVC *PVCDestination `json:"pvc,omitempty"`
+
+	// S3 uploads the snapshot to an S3 compatible bucket, for example AWS S3 or MinIO.
+	// +optional
+	S3 *S3Destination `json:"s3,omitempty"`
+
+	// VolumeSnapshot takes a CSI VolumeSnapshot of the data volume of a stopped
+	// follower instead of streaming a snapshot through the etcd API. It needs a CSI
+	// driver with snapshot support and at least three members, and cannot be encrypted.
+	// +optional
+	VolumeSnapshot *VolumeSnapshotDestination `json:"volumeSnapshot,omitempty"`
+
+	// Encryption encrypts snapshots before they leave the agent, and decrypts them when
+	// they are restored.
+	// +optional
+	Encryption *BackupEncryption `json:"encryption,omitempty"`
+}
+
+// BackupEncryption encrypts snapshots with AES-256-GCM. Every snapshot records the ID
+// of the key it was encrypted with, so a restore picks the right key by itself.
+type BackupEncryption struct {
+	// KeySecret is a Secret in the same namespace whose keys are key IDs and whose
+	// values are 32 byte keys, raw or base64 encoded. Keys of older snapshots have to
+	// stay in it until those snapshots are re-keyed or deleted.
+	KeySecret string `json:"keySecret"`
+
+	// KeyID is the key in KeySecret new snapshots are encrypted with. Required where
+	// snapshots are written. Changing it on a completed EtcdBackup re-encrypts its
+	// snapshot with the new key.
+	// +optional
+	KeyID string `json:"keyID,omitempty"`
+}
+
+// PVCDestination writes snapshots to a PersistentVolumeClaim.
+type PVCDestination struct {
+	// ClaimName is the PersistentVolumeClaim in the namespace of the backup.
+	ClaimName string `json:"claimName"`
+
+	// Path is the file the snapshot is written to, relative to the root of the
+	// volume. Defaults to <cluster>/<backup>.db.
+	// +optional
+	Path string `json:"path,omitempty"`
+}
+
+// VolumeSnapshotDestination keeps a snapshot as a snapshot.storage.k8s.io/v1
+// VolumeSnapshot of a member's data volume.
+type VolumeSnapshotDestination struct {
+	// ClassName is the VolumeSnapshotClass to use. Defaults to the default class of
+	// the CSI driver.
+	// +optional
+	ClassName string `json:"className,omitempty"`
+
+	// Name is the VolumeSnapshot in the namespace of the backup. Defaults to the
+	// name of the backup. A restore provisions the member volumes from it.
+	// +optional
+	Name string `json:"name,omitempty"`
+}
+
+// S3Destination uploads snapshots to an S3 compatible bucket.
+type S3Destination struct {
+	// Endpoint is the host and optional port of the service, for example s3.amazonaws.com or minio.minio:9000.
+	Endpoint string `json:"endpoint"`
+
+	Bucket string `json:"bucket"`
+
+	// Key is the object key of the snapshot. Defaults to <namespace>/<cluster>/<backup>.db.
+	// +optional
+	Key string `json:"key,omitempty"`
+
+	// +optional
+	Region string `json:"region,omitempty"`
+
+	// Insecure talks plain HTTP to the endpoint.
+	// +optional
+	Insecure bool `json:"insecure,omitempty"`
+
+	// CredentialsSecret is a Secret in the namespace of the backup with the keys
+	// accessKeyID and secretAccessKey.
+	CredentialsSecret string `json:"credentialsSecret"`
+}
+
+// BackupPhase is the lifecycle phase of an EtcdBackup.
+type BackupPhase string
+
+const (
+	BackupPhasePending   BackupPhase = "Pending"
+	BackupPhaseRunning   BackupPhase = "Running"
+	BackupPhaseCompleted BackupPhase = "Completed"
+	BackupPhaseFailed    BackupPhase = "Failed"
+)
+
+// EtcdBackupStatus defines the observed state of EtcdBackup
+type EtcdBackupStatus struct {
+	// Phase is Pending until the snapshot is started, then Running, and finally Completed or Failed.
+	// +optional
+	Phase BackupPhase `json:"phase,omitempty"`
+
+	// Member is the etcd member the snapshot was taken from.
+	// +optional
+	Member string `json:"member,omitempty"`
+
+	// Path is the file in the volume, the object key in the bucket or the VolumeSnapshot
+	// the snapshot was written to.
+	// +optional
+	Path string `json:"path,omitempty"`
+
+	// Size is the size of the snapshot in bytes. For a VolumeSnapshot it is the size
+	// of the volume it restores to.
+	// +optional
+	Size int64 `json:"size,omitempty"`
+
+	// Revision is the etcd revision the snapshot was taken at.
+	// +optional
+	Revision int64 `json:"revision,omitempty"`
+
+	// SHA256 is the hex encoded SHA-256 of the snapshot file, before it was encrypted.
+	// +optional
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Keys is the number of keys at Revision.
+	// +optional
+	Keys int64 `json:"keys,omitempty"`
+
+	// KeyID is the key the stored snapshot is encrypted with.
+	// +optional
+	KeyID string `json:"keyID,omitempty"`
+
+	// StartTime is when the snapshot was started.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the snapshot was stored or the backup failed.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Message explains why the backup is pending or failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.clusterName`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Revision",type=integer,JSONPath=`.status.revision`
+//+kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.status.size`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// EtcdBackup is the Schema for the etcdbackups API
+type EtcdBackup struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EtcdBackupSpec   `json:"spec,omitempty"`
+	Status EtcdBackupStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// EtcdBackupList contains a list of EtcdBackup
+type EtcdBackupList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []EtcdBackup `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&EtcdBackup{}, &EtcdBackupList{})
+}
@@ -0,0 +1,114 @@
+/*
+Copyright 2023 fpf.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EtcdBackupScheduleSpec defines the desired state of EtcdBackupSchedule
+type EtcdBackupScheduleSpec struct {
+	// ClusterName is the EtcdCluster in the same namespace to take snapshots of.
+	ClusterName string `json:"clusterName"`
+
+	// Schedule is a cron expression, for example "0 */6 * * *".
+	// +kubebuilder:validation:MinLength=1
+	Schedule string `json:"schedule"`
+
+	// Destination is where the snapshots are written to. PVC.Path and S3.Key are used
+	// as prefixes, every snapshot is stored as <prefix>/<backup>.db below them.
+	// VolumeSnapshot.Name is ignored, every VolumeSnapshot is named after its backup.
+	Destination BackupDestination `json:"destination"`
+
+	// Retention decides which snapshots are pruned. Snapshots are kept forever when unset.
+	// +optional
+	Retention *BackupRetention `json:"retention,omitempty"`
+
+	// Suspend stops new snapshots from being taken. Pruning carries on.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+}
+
+// BackupRetention decides how many snapshots of a schedule are kept. A snapshot is
+// pruned as soon as either limit is exceeded.
+type BackupRetention struct {
+	// MaxCount is how many completed snapshots are kept.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	MaxCount *int32 `json:"maxCount,omitempty"`
+
+	// MaxAge is how long completed snapshots are kept, for example 168h.
+	// +optional
+	MaxAge *metav1.Duration `json:"maxAge,omitempty"`
+}
+
+// EtcdBackupScheduleStatus defines the observed state of EtcdBackupSchedule
+type EtcdBackupScheduleStatus struct {
+	// LastScheduleTime is the scheduled time of the latest snapshot.
+	// +optional
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+
+	// LastBackup is the name of the latest EtcdBackup created by the schedule.
+	// +optional
+	LastBackup string `json:"lastBackup,omitempty"`
+
+	// LastSuccessfulTime is when the latest snapshot completed.
+	// +optional
+	LastSuccessfulTime *metav1.Time `json:"lastSuccessfulTime,omitempty"`
+
+	// LastFailureTime is when the latest snapshot failed.
+	// +optional
+	LastFailureTime *metav1.Time `json:"lastFailureTime,omitempty"`
+
+	// LastFailureMessage is why the latest failed snapshot failed.
+	// +optional
+	LastFailureMessage string `json:"lastFailureMessage,omitempty"`
+
+	// Message explains why no snapshots are taken, for example an invalid schedule.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.clusterName`
+//+kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=`.spec.schedule`
+//+kubebuilder:printcolumn:name="Suspend",type=boolean,JSONPath=`.spec.suspend`
+//+kubebuilder:printcolumn:name="Last Success",type=date,JSONPath=`.status.lastSuccessfulTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// EtcdBackupSchedule is the Schema for the etcdbackupschedules API
+type EtcdBackupSchedule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EtcdBackupScheduleSpec   `json:"spec,omitempty"`
+	Status EtcdBackupScheduleStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// EtcdBackupScheduleList contains a list of EtcdBackupSchedule
+type EtcdBackupScheduleList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []EtcdBackupSchedule `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&EtcdBackupSchedule{}, &EtcdBackupScheduleList{})
+}
@@ -28,19 +28,649 @@ type EtcdClusterSpec struct {
 	// INSERT ADDITIONAL SPEC FIELDS - desired state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
 
-	// Foo is an example field of EtcdCluster. Edit etcdcluster_types.go to remove/update
-	Size  *int32 `json:"size"`
-	Image string `json:"image"`
+	// Size is the number of members. It must be at least 1, and odd sizes are
+	// recommended: an even size tolerates no more failures than one member less.
+	Size *int32 `json:"size"`
+
+	// Image is the etcd image. With Version it is used as is while its tag names that
+	// version, for example v3.5.9 or 3.5.9-0, and otherwise gets the version in the
+	// format of its tag, or the tag v<Version>. It defaults to quay.io/coreos/etcd.
+	// +optional
+	Image string `json:"image,omitempty"`
+
+	// Version is the etcd version the members run, for example 3.5.1. Changing it
+	// upgrades the members one at a time, as configured by Upgrade.
+	// +kubebuilder:validation:Pattern=`^v?[0-9]+\.[0-9]+\.[0-9]+$`
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// Upgrade configures how changes of Version are rolled out.
+	// +optional
+	Upgrade *UpgradeSpec `json:"upgrade,omitempty"`
+
+	// Scaling configures how members are added to the cluster.
+	// +optional
+	Scaling *ScalingSpec `json:"scaling,omitempty"`
+
+	// MemberReplacement configures the automatic replacement of members that stay unhealthy.
+	// +optional
+	MemberReplacement *MemberReplacementSpec `json:"memberReplacement,omitempty"`
+
+	// QuorumRecovery configures the recovery of a cluster that lost quorum.
+	// +optional
+	QuorumRecovery *QuorumRecoverySpec `json:"quorumRecovery,omitempty"`
+
+	// TLS enables TLS for peer and client traffic. It cannot be turned on or off after the
+	// cluster is created, nor can its mode or, in Secrets mode, its Secrets change.
+	// +optional
+	TLS *TLSSpec `json:"tls,omitempty"`
+
+	// ChangeLog continuously writes every change of the cluster to segment files, which
+	// a restore can replay on top of a snapshot to reach a revision or a point in time.
+	// +optional
+	ChangeLog *ChangeLogSpec `json:"changeLog,omitempty"`
+
+	// Bootstrap decides where the data of a new cluster comes from. It is only read
+	// while the cluster is created, a cluster without it starts empty.
+	// +optional
+	Bootstrap *BootstrapSpec `json:"bootstrap,omitempty"`
+}
+
+// UpgradeMode decides which changes of Version are allowed.
+// +kubebuilder:validation:Enum=Upgrade;Downgrade
+type UpgradeMode string
+
+const (
+	// UpgradeModeUpgrade only allows newer versions.
+	UpgradeModeUpgrade UpgradeMode = "Upgrade"
+	// UpgradeModeDowngrade also allows older versions. Going back a minor version uses
+	// the downgrade API of etcd, which etcd 3.5 and later provide.
+	UpgradeModeDowngrade UpgradeMode = "Downgrade"
+)
+
+// UpgradeSpec configures how changes of Version are rolled out.
+//
+// A version change is checked first: it may not skip a minor version, it may only go
+// back in the Downgrade mode, and every member has to be healthy. Then a snapshot of
+// the cluster is taken, and the members are restarted on the new version one at a
+// time, followers first and the leader last, each once the others are healthy.
+//
+// A restarted member that is not healthy within MemberHealthTimeout stops the rollout,
+// and the upgraded members are put back on the previous image. That is only possible
+// while some member still runs the previous version, or for patch version changes,
+// because etcd raises the cluster version once every member runs the new one. A failed
+// version change is retried after the spec changed again.
+//
+// Going back a minor version is first validated and enabled with the downgrade API of
+// etcd, which lowers the cluster version, so that members on the older version can
+// join. A downgrade that fails is cancelled before the members are rolled back.
+type UpgradeSpec struct {
+	// Mode decides which version changes are allowed. Defaults to Upgrade.
+	// +optional
+	Mode UpgradeMode `json:"mode,omitempty"`
+
+	// BackupDestination is where the snapshot taken before every version change is
+	// written. Defaults to the destination of the latest completed EtcdBackup of the
+	// cluster. A version change waits until one of them is available.
+	// +optional
+	BackupDestination *BackupDestination `json:"backupDestination,omitempty"`
+
+	// MemberHealthTimeout is how long a restarted member may take to become healthy
+	// before the version change is rolled back. Defaults to 5m.
+	// +optional
+	MemberHealthTimeout *metav1.Duration `json:"memberHealthTimeout,omitempty"`
+}
+
+// ChangeLogSpec configures the change log writer of a cluster. The writer watches the
+// whole keyspace and stores the revisions it received as a new gzip compressed
+// segment every SegmentInterval. Leases are not recorded.
+type ChangeLogSpec struct {
+	// Destination is where the segments are written. pvc.path or s3.key is the
+	// directory they are written to, and defaults to <cluster>/changelog, or to
+	// <namespace>/<cluster>/changelog in a bucket, next to the snapshots of EtcdBackups.
+	Destination BackupDestination `json:"destination"`
+
+	// SegmentInterval is how often a segment is stored. It bounds how many seconds of
+	// writes a point in time restore can lose. Defaults to 10s.
+	// +optional
+	SegmentInterval *metav1.Duration `json:"segmentInterval,omitempty"`
+}
+
+// BootstrapSpec decides where the data of a new cluster comes from.
+type BootstrapSpec struct {
+	// RestoreFrom seeds every member with a snapshot before the members first start.
+	// The cluster gets a new cluster ID.
+	// +optional
+	RestoreFrom *RestoreSource `json:"restoreFrom,omitempty"`
+
+	// CloneFrom seeds the cluster with a snapshot streamed from another running
+	// EtcdCluster. Only the first member is seeded, the others join it one at a time
+	// like in a scale up. Cannot be combined with RestoreFrom.
+	// +optional
+	CloneFrom *CloneSource `json:"cloneFrom,omitempty"`
+}
+
+// CloneSource is a running EtcdCluster to copy the data of.
+type CloneSource struct {
+	// Name is the name of the source EtcdCluster.
+	Name string `json:"name"`
+
+	// Namespace is the namespace of the source EtcdCluster. Defaults to the namespace of the new cluster.
+	// A source in another namespace has to list the namespace of the new cluster in its
+	// etcd.gqq.com/clone-namespaces annotation, and use operator managed certificates if
+	// it uses TLS.
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// TLSMode selects where the certificates of a cluster come from.
+// +kubebuilder:validation:Enum=Operator;Secrets
+type TLSMode string
+
+const (
+	// TLSModeOperator makes the operator generate a CA and a peer and server certificate for every member.
+	TLSModeOperator TLSMode = "Operator"
+	// TLSModeSecrets uses certificates from user provided Secrets.
+	TLSModeSecrets TLSMode = "Secrets"
+)
+
+// TLSSpec configures TLS for peer and client traffic.
+type TLSSpec struct {
+	// Mode selects where the certificates come from.
+	Mode TLSMode `json:"mode"`
+
+	// PeerSecret is the name of the Secret holding the peer certificate in Secrets mode.
+	// Like the other Secrets it must contain tls.crt, tls.key and ca.crt, and the
+	// certificate must be valid for every member, for example through the SAN
+	// *.<cluster>.<namespace>.svc.cluster.local.
+	// +optional
+	PeerSecret string `json:"peerSecret,omitempty"`
+
+	// ServerSecret is the name of the Secret holding the certificate members present to clients in Secrets mode.
+	// +optional
+	ServerSecret string `json:"serverSecret,omitempty"`
+
+	// ClientSecret is the name of the Secret holding the client certificate the operator uses in Secrets mode.
+	// +optional
+	ClientSecret string `json:"clientSecret,omitempty"`
+
+	// RenewAtPercent is the percentage of their lifetime after which operator generated
+	// certificates, including the CA, are renewed. Defaults to 67.
+	// +kubebuilder:validation:Minimum=10
+	// +kubebuilder:validation:Maximum=95
+	// +optional
+	RenewAtPercent *int32 `json:"renewAtPercent,omitempty"`
+
+	// CertificateValidity is the lifetime of operator generated member and client certificates. Defaults to 1 year.
+	// +optional
+	CertificateValidity *metav1.Duration `json:"certificateValidity,omitempty"`
+
+	// CAValidity is the lifetime of the operator generated CA. Defaults to 10 years.
+	// +optional
+	CAValidity *metav1.Duration `json:"caValidity,omitempty"`
+}
+
+// CA rotation phases of operator generated certificates.
+const (
+	// CARotationTrustBoth means members trust the old and the new CA while certificates are still signed by the old one.
+	CARotationTrustBoth = "TrustBoth"
+	// CARotationReissue means certificates are signed by the new CA while both CAs are still trusted.
+	CARotationReissue = "Reissue"
+)
+
+// ScalingSpec configures how members are added to the cluster.
+type ScalingSpec struct {
+	// UseLearners adds new members as raft learners, which do not count towards
+	// quorum, and promotes them to voting members once they have caught up with
+	// the leader. Requires etcd 3.4 or newer.
+	// +optional
+	UseLearners bool `json:"useLearners,omitempty"`
+
+	// LearnerMaxLag is how many raft entries a learner may trail the leader by
+	// and still be promoted. Defaults to 1000.
+	// +kubebuilder:validation:Minimum=0
+	// +optional
+	LearnerMaxLag *int64 `json:"learnerMaxLag,omitempty"`
+
+	// SingleStep rejects changes of Size by more than one member, so that every
+	// membership change is asked for and checked on its own.
+	// +optional
+	SingleStep bool `json:"singleStep,omitempty"`
+}
+
+// MemberReplacementSpec configures the automatic replacement of failed members.
+type MemberReplacementSpec struct {
+	// Enabled turns on automatic replacement. A member is only replaced while the
+	// rest of the cluster keeps quorum.
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+
+	// UnhealthyThreshold is how long a member has to be unhealthy before it is
+	// removed, its volume deleted and a fresh member added in its place. Defaults to 5m.
+	// +optional
+	UnhealthyThreshold *metav1.Duration `json:"unhealthyThreshold,omitempty"`
+}
+
+// QuorumRecoverySource selects what a cluster that lost quorum is rebuilt from.
+// +kubebuilder:validation:Enum=Member;Backup
+type QuorumRecoverySource string
+
+const (
+	// QuorumRecoveryFromMember rebuilds the cluster from the surviving member with the
+	// highest raft index, and restores the latest backup when no member answers.
+	QuorumRecoveryFromMember QuorumRecoverySource = "Member"
+	// QuorumRecoveryFromBackup always restores the latest completed EtcdBackup of the cluster.
+	QuorumRecoveryFromBackup QuorumRecoverySource = "Backup"
+)
+
+// QuorumRecoverySpec configures the recovery of a cluster that lost quorum.
+//
+// Once quorum has been lost for longer than LossThreshold the operator plans a
+// recovery and records it in Status.QuorumRecovery. Recovery destroys the data of
+// every member but the one the cluster is rebuilt from, so it only starts after the
+// annotation etcd.gqq.com/approve-quorum-recovery is set to the ID of the plan.
+type QuorumRecoverySpec struct {
+	// Enabled turns on quorum recovery.
+	// +optional
+	Enabled bool `json:"enabled,omitempty"`
+
+	// LossThreshold is how long quorum has to be lost before a recovery is planned. Defaults to 5m.
+	// +optional
+	LossThreshold *metav1.Duration `json:"lossThreshold,omitempty"`
+
+	// Source selects what the cluster is rebuilt from. Defaults to Member.
+	// +optional
+	Source QuorumRecoverySource `json:"source,omitempty"`
 }
 
 // EtcdClusterStatus defines the observed state of EtcdCluster
 type EtcdClusterStatus struct {
 	// INSERT ADDITIONAL STATUS FIELD - define observed state of cluster
 	// Important: Run "make" to regenerate code after modifying this file
+
+	// ObservedGeneration is the most recent generation observed by the controller.
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// ReadyReplicas is the number of etcd members that answered a status request.
+	ReadyReplicas int32 `json:"readyReplicas"`
+
+	// Version is the etcd version of the pod template. It follows Spec.Version once a
+	// version change passed its checks and the snapshot before it was taken.
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// ClusterID is the etcd cluster ID in hex, as reported by the members.
+	ClusterID string `json:"clusterID,omitempty"`
+
+	// Leader is the name of the current raft leader.
+	Leader string `json:"leader,omitempty"`
+
+	// Members is the membership of the cluster as seen through the etcd API.
+	Members []MemberStatus `json:"members,omitempty"`
+
+	// Bootstrap reports how seeding the members of a new cluster went.
+	// +optional
+	Bootstrap *BootstrapStatus `json:"bootstrap,omitempty"`
+
+	// TLS reports the state of the operator generated certificates.
+	// +optional
+	TLS *TLSStatus `json:"tls,omitempty"`
+
+	// ChangeLog reports the change log writer.
+	// +optional
+	ChangeLog *ChangeLogStatus `json:"changeLog,omitempty"`
+
+	// QuorumRecovery reports the latest quorum loss and its recovery.
+	// +optional
+	QuorumRecovery *QuorumRecoveryStatus `json:"quorumRecovery,omitempty"`
+
+	// Upgrade reports the latest version change.
+	// +optional
+	Upgrade *UpgradeStatus `json:"upgrade,omitempty"`
+
+	// QuiescedMember is the member that is stopped while its data volume is snapshotted.
+	// +optional
+	QuiescedMember *QuiescedMemberStatus `json:"quiescedMember,omitempty"`
+
+	// ReplacementHistory records the steps of the latest automatic member replacements, newest last.
+	// +optional
+	ReplacementHistory []MemberReplacementRecord `json:"replacementHistory,omitempty"`
+
+	// Conditions describe the current state of the cluster.
+	// +listType=map
+	// +listMapKey=type
+	// +optional
+	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
 }
 
+// Condition types of an EtcdCluster.
+const (
+	// ConditionAvailable is true when the cluster has a leader and a healthy quorum.
+	ConditionAvailable = "Available"
+	// ConditionProgressing is true while the cluster is being created, scaled or rolled.
+	ConditionProgressing = "Progressing"
+	// ConditionDegraded is true when at least one member is unhealthy.
+	ConditionDegraded = "Degraded"
+	// ConditionQuorumAtRisk is true when losing one more member would lose quorum.
+	ConditionQuorumAtRisk = "QuorumAtRisk"
+	// ConditionUpgradeFailed is true when the latest version change failed.
+	ConditionUpgradeFailed = "UpgradeFailed"
+)
+
+// Condition reasons of an EtcdCluster.
+const (
+	ReasonQuorumHealthy    = "QuorumHealthy"
+	ReasonQuorumLost       = "QuorumLost"
+	ReasonNoLeader         = "NoLeader"
+	ReasonUnreachable      = "Unreachable"
+	ReasonScaling          = "Scaling"
+	ReasonRollingUpdate    = "RollingUpdate"
+	ReasonReconciled       = "Reconciled"
+	ReasonMembersUnhealthy = "MembersUnhealthy"
+	ReasonMembersHealthy   = "MembersHealthy"
+	ReasonNoFaultTolerance = "NoFaultTolerance"
+	ReasonFaultTolerant    = "FaultTolerant"
+
+	ReasonMemberReconcileFailed = "MemberReconcileFailed"
+	ReasonLearnerCatchingUp     = "LearnerCatchingUp"
+	ReasonBootstrapping         = "Bootstrapping"
+	ReasonBootstrapFailed       = "BootstrapFailed"
+
+	ReasonQuorumRecoveryPending = "QuorumRecoveryPending"
+	ReasonRecoveringQuorum      = "RecoveringQuorum"
+	ReasonQuorumRecoveryFailed  = "QuorumRecoveryFailed"
+
+	ReasonUpgradeBlocked      = "UpgradeBlocked"
+	ReasonUpgrading           = "Upgrading"
+	ReasonUpgradeSucceeded    = "UpgradeSucceeded"
+	ReasonRollingBack         = "RollingBack"
+	ReasonRolledBack          = "RolledBack"
+	ReasonRollbackNotPossible = "RollbackNotPossible"
+)
+
+// BootstrapPhase is the phase of seeding the members of a new cluster.
+type BootstrapPhase string
+
+const (
+	BootstrapPhasePending   BootstrapPhase = "Pending"
+	BootstrapPhaseSeeding   BootstrapPhase = "Seeding"
+	BootstrapPhaseCompleted BootstrapPhase = "Completed"
+	BootstrapPhaseFailed    BootstrapPhase = "Failed"
+)
+
+// BootstrapStatus reports how seeding the members of a new cluster went.
+type BootstrapStatus struct {
+	// Phase is Pending until the snapshot is available, Seeding while member volumes
+	// are restored, and Completed or Failed at the end.
+	Phase BootstrapPhase `json:"phase"`
+
+	// SeededMembers is how many member volumes were seeded so far.
+	// +optional
+	SeededMembers int32 `json:"seededMembers,omitempty"`
+
+	// Source is the snapshot or the cluster member the members were seeded from.
+	// +optional
+	Source string `json:"source,omitempty"`
+
+	// Revision is the etcd revision the cluster was seeded at. For a clone it is the
+	// revision of the source cluster when the snapshot was taken.
+	// +optional
+	Revision int64 `json:"revision,omitempty"`
+
+	// Message explains why bootstrapping is pending or failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// QuorumRecoveryPhase is the phase of a quorum recovery.
+type QuorumRecoveryPhase string
+
+const (
+	// QuorumRecoveryPhaseDetected means quorum is lost, but not yet for longer than the threshold.
+	QuorumRecoveryPhaseDetected QuorumRecoveryPhase = "Detected"
+	// QuorumRecoveryPhaseAwaitingApproval means a recovery is planned and waits for the approval annotation.
+	QuorumRecoveryPhaseAwaitingApproval QuorumRecoveryPhase = "AwaitingApproval"
+	QuorumRecoveryPhaseRecovering       QuorumRecoveryPhase = "Recovering"
+	QuorumRecoveryPhaseCompleted        QuorumRecoveryPhase = "Completed"
+	QuorumRecoveryPhaseFailed           QuorumRecoveryPhase = "Failed"
+)
+
+// Steps of a quorum recovery.
+const (
+	// QuorumRecoveryStepForceNewCluster restarts the surviving member with --force-new-cluster.
+	QuorumRecoveryStepForceNewCluster = "ForceNewCluster"
+	// QuorumRecoveryStepStopping stops every member and deletes their volumes before a backup is restored.
+	QuorumRecoveryStepStopping = "Stopping"
+	// QuorumRecoveryStepRestoring restores the backup into the volume of the first member.
+	QuorumRecoveryStepRestoring = "Restoring"
+	// QuorumRecoveryStepGrowing adds the other members back to the rebuilt single member cluster.
+	QuorumRecoveryStepGrowing = "Growing"
+)
+
+// QuorumRecoveryStatus reports the latest quorum loss and its recovery.
+type QuorumRecoveryStatus struct {
+	// Phase is Detected while quorum is lost, AwaitingApproval once a recovery is
+	// planned, Recovering after it was approved, and Completed or Failed at the end.
+	Phase QuorumRecoveryPhase `json:"phase"`
+
+	// LostSince is when the cluster was first seen without quorum.
+	// +optional
+	LostSince *metav1.Time `json:"lostSince,omitempty"`
+
+	// ID identifies the planned recovery. Setting the annotation
+	// etcd.gqq.com/approve-quorum-recovery to it approves the recovery. A new plan
+	// gets a new ID, so an approval never applies to a plan it was not given for.
+	// +optional
+	ID string `json:"id,omitempty"`
+
+	// Member is the surviving member the cluster is rebuilt from.
+	// +optional
+	Member string `json:"member,omitempty"`
+
+	// RaftIndex is the raft index of Member when the recovery was planned.
+	// +optional
+	RaftIndex uint64 `json:"raftIndex,omitempty"`
+
+	// Backup is the EtcdBackup the cluster is restored from when it is not rebuilt from a member.
+	// +optional
+	Backup string `json:"backup,omitempty"`
+
+	// Step is the step of the recovery in progress.
+	// +optional
+	Step string `json:"step,omitempty"`
+
+	// StartTime is when the recovery was approved.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the recovery completed or failed.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Message explains what the recovery is waiting for, or why it failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// ChangeLogStatus reports the change log writer.
+type ChangeLogStatus struct {
+	// Path is the directory or key prefix the segments are written to.
+	Path string `json:"path"`
+
+	// Available is true while the writer is running.
+	Available bool `json:"available"`
+
+	// Message explains why the writer is not running.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// UpgradePhase is the phase of a version change.
+type UpgradePhase string
+
+const (
+	// UpgradePhasePending means the version change waits for its checks to pass.
+	UpgradePhasePending UpgradePhase = "Pending"
+	// UpgradePhaseBackingUp means the snapshot before the version change is being taken.
+	UpgradePhaseBackingUp UpgradePhase = "BackingUp"
+	// UpgradePhaseUpgrading means the members are restarted on the new version.
+	UpgradePhaseUpgrading UpgradePhase = "Upgrading"
+	// UpgradePhaseCompleted means every member runs the new version.
+	UpgradePhaseCompleted UpgradePhase = "Completed"
+	// UpgradePhaseRollingBack means an upgraded member failed and the members are put
+	// back on the previous image.
+	UpgradePhaseRollingBack UpgradePhase = "RollingBack"
+	// UpgradePhaseRolledBack means every member runs the previous version again.
+	UpgradePhaseRolledBack UpgradePhase = "RolledBack"
+	// UpgradePhaseFailed means an upgraded member failed and the version change could
+	// not be rolled back. The rollout is stopped.
+	UpgradePhaseFailed UpgradePhase = "Failed"
+)
+
+// UpgradeStatus reports a version change.
+type UpgradeStatus struct {
+	Phase UpgradePhase `json:"phase"`
+
+	FromVersion string `json:"fromVersion"`
+	ToVersion   string `json:"toVersion"`
+
+	// FromImage is the image the members ran before, which a rollback puts back.
+	// +optional
+	FromImage string `json:"fromImage,omitempty"`
+
+	// ObservedGeneration is the generation of the EtcdCluster the version change was started for.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// Backup is the EtcdBackup taken before the version change.
+	// +optional
+	Backup string `json:"backup,omitempty"`
+
+	// DowngradeEnabled is true while the operator has an etcd downgrade enabled for
+	// this version change.
+	// +optional
+	DowngradeEnabled bool `json:"downgradeEnabled,omitempty"`
+
+	// UpdatedMembers is how many members were restarted on the new version.
+	// +optional
+	UpdatedMembers int32 `json:"updatedMembers,omitempty"`
+
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Message explains what the version change is waiting for, or why it failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// QuiescedMemberStatus reports a member that is stopped for a volume snapshot.
+type QuiescedMemberStatus struct {
+	// Name is the name of the member.
+	Name string `json:"name"`
+
+	// Since is when the member was stopped. It is started again after an hour even if
+	// the annotation that asked for it stays.
+	Since metav1.Time `json:"since"`
+}
+
+// TLSStatus reports the state of the operator generated certificates.
+type TLSStatus struct {
+	// CANotAfter is when the current CA expires.
+	// +optional
+	CANotAfter *metav1.Time `json:"caNotAfter,omitempty"`
+
+	// CertificatesNotAfter is when the first member or client certificate expires.
+	// +optional
+	CertificatesNotAfter *metav1.Time `json:"certificatesNotAfter,omitempty"`
+
+	// NextRotationTime is when the next certificate is due for renewal.
+	// +optional
+	NextRotationTime *metav1.Time `json:"nextRotationTime,omitempty"`
+
+	// LastRotationTime is when certificates were last renewed. Members started
+	// before it are restarted one at a time to load the new certificates.
+	// +optional
+	LastRotationTime *metav1.Time `json:"lastRotationTime,omitempty"`
+
+	// CARotationPhase is TrustBoth or Reissue while the CA is being rotated, and empty otherwise.
+	// +optional
+	CARotationPhase string `json:"caRotationPhase,omitempty"`
+}
+
+// MemberStatus is the observed state of a single etcd member.
+type MemberStatus struct {
+	// ID is the etcd member ID in hex.
+	ID string `json:"id"`
+
+	// Name is the member name, which is also the name of its pod.
+	// It is empty for members that were added but have not started yet.
+	Name string `json:"name,omitempty"`
+
+	PeerURLs   []string `json:"peerURLs,omitempty"`
+	ClientURLs []string `json:"clientURLs,omitempty"`
+
+	// Healthy is true when the member answered a status request without errors.
+	Healthy bool `json:"healthy"`
+
+	// IsLeader is true when the member is the current raft leader.
+	IsLeader bool `json:"isLeader,omitempty"`
+
+	// IsLearner is true while the member is a raft learner that has not been promoted yet.
+	IsLearner bool `json:"isLearner,omitempty"`
+
+	// Version is the etcd server version the member reports.
+	// +optional
+	Version string `json:"version,omitempty"`
+
+	// DBSize is the size of the backend database in bytes.
+	DBSize int64 `json:"dbSize,omitempty"`
+
+	RaftTerm  uint64 `json:"raftTerm,omitempty"`
+	RaftIndex uint64 `json:"raftIndex,omitempty"`
+
+	// Message explains why the member is not healthy.
+	Message string `json:"message,omitempty"`
+
+	// UnhealthySince is when the member was first seen unhealthy.
+	// +optional
+	UnhealthySince *metav1.Time `json:"unhealthySince,omitempty"`
+}
+
+// MemberReplacementRecord is one step of an automatic member replacement.
+type MemberReplacementRecord struct {
+	// Time is when the step was taken.
+	Time metav1.Time `json:"time"`
+
+	// Member is the name of the replaced member.
+	Member string `json:"member"`
+
+	// Step is one of Removed, VolumeDeleted or Added.
+	Step string `json:"step"`
+
+	// MemberID is the etcd member ID the step applied to, in hex.
+	MemberID string `json:"memberID,omitempty"`
+
+	Message string `json:"message,omitempty"`
+}
+
+// Steps of an automatic member replacement.
+const (
+	ReplacementStepRemoved       = "Removed"
+	ReplacementStepVolumeDeleted = "VolumeDeleted"
+	ReplacementStepAdded         = "Added"
+)
+
 //+kubebuilder:object:root=true
 //+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Size",type=integer,JSONPath=`.spec.size`
+//+kubebuilder:printcolumn:name="Ready",type=integer,JSONPath=`.status.readyReplicas`
+//+kubebuilder:printcolumn:name="Version",type=string,JSONPath=`.status.version`
+//+kubebuilder:printcolumn:name="Leader",type=string,JSONPath=`.status.leader`
+//+kubebuilder:printcolumn:name="Available",type=string,JSONPath=`.status.conditions[?(@.type=="Available")].status`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
 
 // EtcdCluster is the Schema for the etcdclusters API
 type EtcdCluster struct {
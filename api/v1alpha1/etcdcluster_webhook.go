@@ -0,0 +1,121 @@
+package v1alpha1
+
+import (
+	"context"
+	"net/http"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/webhook"
+	"sigs.k8s.io/controller-runtime/pkg/webhook/admission"
+)
+
+//+kubebuilder:webhook:path=/validate-etcd-gqq-com-v1alpha1-etcdcluster,mutating=false,failurePolicy=fail,sideEffects=None,groups=etcd.gqq.com,resources=etcdclusters,verbs=create;update,versions=v1alpha1,name=vetcdcluster.kb.io,admissionReviewVersions=v1
+
+// SetupWebhookWithManager registers the validating webhook of EtcdCluster. It is a
+// plain admission handler rather than a webhook.Validator, which cannot return warnings.
+func (r *EtcdCluster) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	mgr.GetWebhookServer().Register("/validate-etcd-gqq-com-v1alpha1-etcdcluster",
+		&webhook.Admission{Handler: &etcdClusterValidator{}})
+	return nil
+}
+
+type etcdClusterValidator struct {
+	decoder *admission.Decoder
+}
+
+// InjectDecoder is called by the webhook server when the handler is registered.
+func (v *etcdClusterValidator) InjectDecoder(d *admission.Decoder) error {
+	v.decoder = d
+	return nil
+}
+
+func (v *etcdClusterValidator) Handle(ctx context.Context, req admission.Request) admission.Response {
+	var cluster EtcdCluster
+	if err := v.decoder.Decode(req, &cluster); err != nil {
+		return admission.Errored(http.StatusBadRequest, err)
+	}
+	var old *EtcdCluster
+	if req.Operation == admissionv1.Update {
+		old = &EtcdCluster{}
+		if err := v.decoder.DecodeRaw(req.OldObject, old); err != nil {
+			return admission.Errored(http.StatusBadRequest, err)
+		}
+	}
+	warnings, errs := cluster.validate(old)
+	if len(errs) > 0 {
+		status := apierrors.NewInvalid(GroupVersion.WithKind("EtcdCluster").GroupKind(), cluster.Name, errs).Status()
+		resp := admission.Denied(status.Message)
+		resp.Result = &status
+		return resp.WithWarnings(warnings...)
+	}
+	return admission.Allowed("").WithWarnings(warnings...)
+}
+
+// validate checks a new cluster, or an update of old. The warnings point out settings
+// that are allowed but most likely not intended.
+func (r *EtcdCluster) validate(old *EtcdCluster) ([]string, field.ErrorList) {
+	var warnings []string
+	var errs field.ErrorList
+	spec := field.NewPath("spec")
+
+	switch size := r.Spec.Size; {
+	case size == nil:
+		errs = append(errs, field.Required(spec.Child("size"), "the number of members must be set"))
+	case *size < 1:
+		errs = append(errs, field.Invalid(spec.Child("size"), *size, "must be at least 1"))
+	case *size%2 == 0:
+		warnings = append(warnings, "spec.size is even, a cluster of that size tolerates no more failed members than one with a member less")
+	}
+	if r.Spec.Image == "" && r.Spec.Version == "" {
+		errs = append(errs, field.Required(spec.Child("image"), "either image or version must be set"))
+	}
+	if old == nil {
+		return warnings, errs
+	}
+
+	// 打开或者关闭策略的同一次修改也按策略检查
+	if r.Spec.Size != nil && old.Spec.Size != nil && (singleStep(r) || singleStep(old)) {
+		if diff := *r.Spec.Size - *old.Spec.Size; diff > 1 || diff < -1 {
+			errs = append(errs, field.Invalid(spec.Child("size"), *r.Spec.Size,
+				"spec.scaling.singleStep only allows adding or removing one member at a time"))
+		}
+	}
+	errs = append(errs, validateTLSUpdate(r.Spec.TLS, old.Spec.TLS, spec.Child("tls"))...)
+	return warnings, errs
+}
+
+// validateTLSUpdate refuses the TLS changes members cannot follow: turning TLS on or
+// off, switching mode and, in Secrets mode, pointing at other Secrets. The lifetimes
+// of operator generated certificates are applied on the next renewal.
+func validateTLSUpdate(tls, old *TLSSpec, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if (tls == nil) != (old == nil) {
+		return append(errs, field.Forbidden(path, "TLS cannot be turned on or off after the cluster is created"))
+	}
+	if tls == nil {
+		return nil
+	}
+	if tls.Mode != old.Mode {
+		return append(errs, field.Forbidden(path.Child("mode"), "cannot be changed after the cluster is created"))
+	}
+	if tls.Mode != TLSModeSecrets {
+		return nil
+	}
+	if tls.PeerSecret != old.PeerSecret {
+		errs = append(errs, field.Forbidden(path.Child("peerSecret"), "cannot be changed after the cluster is created"))
+	}
+	if tls.ServerSecret != old.ServerSecret {
+		errs = append(errs, field.Forbidden(path.Child("serverSecret"), "cannot be changed after the cluster is created"))
+	}
+	if tls.ClientSecret != old.ClientSecret {
+		errs = append(errs, field.Forbidden(path.Child("clientSecret"), "cannot be changed after the cluster is created"))
+	}
+	return errs
+}
+
+func singleStep(cluster *EtcdCluster) bool {
+	return cluster.Spec.Scaling != nil && cluster.Spec.Scaling.SingleStep
+}
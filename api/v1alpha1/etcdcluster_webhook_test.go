@@ -0,0 +1,91 @@
+package v1alpha1
+
+import (
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestValidateEtcdCluster(t *testing.T) {
+	size := func(n int32) *int32 { return &n }
+	cluster := &EtcdCluster{Spec: EtcdClusterSpec{Size: size(3), Image: "quay.io/coreos/etcd:v3.5.1"}}
+	if warnings, errs := cluster.validate(nil); len(warnings) > 0 || len(errs) > 0 {
+		t.Errorf("valid cluster: warnings %v, errors %v", warnings, errs)
+	}
+
+	for _, n := range []int32{0, -1} {
+		invalid := cluster.DeepCopy()
+		invalid.Spec.Size = size(n)
+		if _, errs := invalid.validate(nil); len(errs) == 0 {
+			t.Errorf("size %d was accepted", n)
+		}
+	}
+	even := cluster.DeepCopy()
+	even.Spec.Size = size(4)
+	if warnings, errs := even.validate(nil); len(warnings) == 0 || len(errs) > 0 {
+		t.Errorf("size 4: warnings %v, errors %v", warnings, errs)
+	}
+	noImage := cluster.DeepCopy()
+	noImage.Spec.Image = ""
+	if _, errs := noImage.validate(nil); len(errs) == 0 {
+		t.Error("cluster without image or version was accepted")
+	}
+	noImage.Spec.Version = "3.5.1"
+	if _, errs := noImage.validate(nil); len(errs) > 0 {
+		t.Errorf("cluster with a version: %v", errs)
+	}
+
+	// 扩缩容一次只能差一个成员
+	scaled := cluster.DeepCopy()
+	scaled.Spec.Size = size(5)
+	if _, errs := scaled.validate(cluster); len(errs) > 0 {
+		t.Errorf("scaling without a policy: %v", errs)
+	}
+	scaled.Spec.Scaling = &ScalingSpec{SingleStep: true}
+	if _, errs := scaled.validate(cluster); len(errs) == 0 {
+		t.Error("scaling from 3 to 5 members was accepted with singleStep")
+	}
+	scaled.Spec.Size = size(4)
+	if _, errs := scaled.validate(cluster); len(errs) > 0 {
+		t.Errorf("scaling from 3 to 4 members with singleStep: %v", errs)
+	}
+
+	withTLS := cluster.DeepCopy()
+	withTLS.Spec.TLS = &TLSSpec{}
+	if _, errs := withTLS.validate(cluster); len(errs) == 0 {
+		t.Error("enabling TLS on an existing cluster was accepted")
+	}
+	if _, errs := withTLS.validate(nil); len(errs) > 0 {
+		t.Errorf("new cluster with TLS: %v", errs)
+	}
+	if _, errs := cluster.validate(withTLS); len(errs) == 0 {
+		t.Error("disabling TLS on an existing cluster was accepted")
+	}
+
+	// 证书的有效期和续期时间随时可以改
+	operatorTLS := cluster.DeepCopy()
+	operatorTLS.Spec.TLS = &TLSSpec{Mode: TLSModeOperator}
+	renewed := operatorTLS.DeepCopy()
+	renewed.Spec.TLS.RenewAtPercent = size(50)
+	renewed.Spec.TLS.CertificateValidity = &metav1.Duration{Duration: 30 * 24 * time.Hour}
+	renewed.Spec.TLS.CAValidity = &metav1.Duration{Duration: 365 * 24 * time.Hour}
+	if _, errs := renewed.validate(operatorTLS); len(errs) > 0 {
+		t.Errorf("changing renewAtPercent and the validities: %v", errs)
+	}
+	secretsTLS := cluster.DeepCopy()
+	secretsTLS.Spec.TLS = &TLSSpec{Mode: TLSModeSecrets, PeerSecret: "peer", ServerSecret: "server", ClientSecret: "client"}
+	if _, errs := secretsTLS.validate(operatorTLS); len(errs) == 0 {
+		t.Error("changing the TLS mode was accepted")
+	}
+	otherSecret := secretsTLS.DeepCopy()
+	otherSecret.Spec.TLS.ServerSecret = "server-2"
+	if _, errs := otherSecret.validate(secretsTLS); len(errs) == 0 {
+		t.Error("changing the server Secret was accepted")
+	}
+	otherSecret = secretsTLS.DeepCopy()
+	otherSecret.Spec.TLS.RenewAtPercent = size(80)
+	if _, errs := otherSecret.validate(secretsTLS); len(errs) > 0 {
+		t.Errorf("changing renewAtPercent in Secrets mode: %v", errs)
+	}
+}
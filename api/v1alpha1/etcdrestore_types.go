@@ -0,0 +1,139 @@
+/*
+Copyright 2023 fpf.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EtcdRestoreSpec defines the desired state of EtcdRestore
+type EtcdRestoreSpec struct {
+	// Source is the snapshot to restore.
+	Source RestoreSource `json:"source"`
+
+	// ClusterName is the name of the EtcdCluster the restore creates. It must not exist yet.
+	ClusterName string `json:"clusterName"`
+
+	// ClusterSpec is the spec of the created EtcdCluster. Its bootstrap is set to
+	// restore from Source, so every one of its Size members is seeded with the snapshot.
+	ClusterSpec EtcdClusterSpec `json:"clusterSpec"`
+}
+
+// RestoreSource is a snapshot to restore. Exactly one of Backup, PVC, S3 and
+// VolumeSnapshot must be set, and PVC.Path, S3.Key or VolumeSnapshot.Name must point
+// at the snapshot. Member volumes are provisioned from a VolumeSnapshot, which needs
+// the same storage class it was taken with.
+type RestoreSource struct {
+	// Backup is a completed EtcdBackup in the same namespace. The SHA-256 it recorded is
+	// verified before the snapshot is restored.
+	// +optional
+	Backup string `json:"backup,omitempty"`
+
+	BackupDestination `json:",inline"`
+
+	// PointInTime replays a change log kept in the same volume or bucket as the
+	// snapshot on top of it, up to a revision or a time.
+	// +optional
+	PointInTime *PointInTime `json:"pointInTime,omitempty"`
+}
+
+// PointInTime selects how much of a change log is replayed on top of a snapshot. The
+// replay stops at Revision or Time, whichever comes first, and at the end of the
+// change log when neither is set. It cannot be used with VolumeSnapshot sources.
+type PointInTime struct {
+	// ChangeLogPath is the directory or key prefix of the change log. Defaults to the
+	// change log directory of the cluster Backup was taken of, when Backup is set. It
+	// is read from the same destination, and decrypted with the same keys, as the snapshot.
+	// +optional
+	ChangeLogPath string `json:"changeLogPath,omitempty"`
+
+	// Revision is the last revision replayed.
+	// +kubebuilder:validation:Minimum=1
+	// +optional
+	Revision int64 `json:"revision,omitempty"`
+
+	// Time stops the replay at the last revision the writer received at or before it.
+	// +optional
+	Time *metav1.Time `json:"time,omitempty"`
+}
+
+// RestorePhase is the lifecycle phase of an EtcdRestore.
+type RestorePhase string
+
+const (
+	RestorePhasePending   RestorePhase = "Pending"
+	RestorePhaseRestoring RestorePhase = "Restoring"
+	RestorePhaseCompleted RestorePhase = "Completed"
+	RestorePhaseFailed    RestorePhase = "Failed"
+)
+
+// EtcdRestoreStatus defines the observed state of EtcdRestore
+type EtcdRestoreStatus struct {
+	// Phase is Pending until the snapshot is available, Restoring while the member
+	// volumes of the created EtcdCluster are seeded, and Completed or Failed at the end.
+	// +optional
+	Phase RestorePhase `json:"phase,omitempty"`
+
+	// RestoredMembers is how many member volumes were seeded so far.
+	// +optional
+	RestoredMembers int32 `json:"restoredMembers,omitempty"`
+
+	// Revision is the etcd revision of the restored snapshot.
+	// +optional
+	Revision int64 `json:"revision,omitempty"`
+
+	// StartTime is when the restore started.
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// CompletionTime is when the last member was seeded or the restore failed.
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Message explains why the restore is pending or failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.clusterName`
+//+kubebuilder:printcolumn:name="Phase",type=string,JSONPath=`.status.phase`
+//+kubebuilder:printcolumn:name="Revision",type=integer,JSONPath=`.status.revision`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// EtcdRestore is the Schema for the etcdrestores API
+type EtcdRestore struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EtcdRestoreSpec   `json:"spec,omitempty"`
+	Status EtcdRestoreStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// EtcdRestoreList contains a list of EtcdRestore
+type EtcdRestoreList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []EtcdRestore `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&EtcdRestore{}, &EtcdRestoreList{})
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2023 fpf.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EtcdRestoreTestSpec defines the desired state of EtcdRestoreTest
+type EtcdRestoreTestSpec struct {
+	// ClusterName is the EtcdCluster in the same namespace whose latest completed
+	// EtcdBackup is restored.
+	ClusterName string `json:"clusterName"`
+
+	// Schedule is a cron expression, for example "0 4 * * *".
+	// +kubebuilder:validation:MinLength=1
+	Schedule string `json:"schedule"`
+
+	// KeyPrefixes are checked on the restored member, on top of the checksum, the
+	// revision and the number of keys recorded by the backup.
+	// +optional
+	KeyPrefixes []KeyPrefixCheck `json:"keyPrefixes,omitempty"`
+
+	// Timeout bounds a single drill. Defaults to 30m.
+	// +optional
+	Timeout *metav1.Duration `json:"timeout,omitempty"`
+
+	// Suspend stops new drills from being started.
+	// +optional
+	Suspend bool `json:"suspend,omitempty"`
+}
+
+// KeyPrefixCheck expects a number of keys below a prefix, for example the Kubernetes
+// resources every healthy cluster has.
+type KeyPrefixCheck struct {
+	// +kubebuilder:validation:MinLength=1
+	Prefix string `json:"prefix"`
+
+	// MinKeys is how many keys at least have to be below Prefix.
+	// +kubebuilder:validation:Minimum=0
+	// +kubebuilder:default=1
+	// +optional
+	MinKeys int64 `json:"minKeys,omitempty"`
+}
+
+// RestoreTestResult is the outcome of a drill.
+type RestoreTestResult string
+
+const (
+	RestoreTestPassed RestoreTestResult = "Passed"
+	RestoreTestFailed RestoreTestResult = "Failed"
+)
+
+// RestoreTestRun is a single drill.
+type RestoreTestRun struct {
+	// Backup is the EtcdBackup that was restored.
+	// +optional
+	Backup string `json:"backup,omitempty"`
+
+	// Job runs the drill.
+	// +optional
+	Job string `json:"job,omitempty"`
+
+	// Result is empty while the drill runs.
+	// +optional
+	Result RestoreTestResult `json:"result,omitempty"`
+
+	// Revision is the revision the restored member served.
+	// +optional
+	Revision int64 `json:"revision,omitempty"`
+
+	// Keys is the number of keys the restored member served.
+	// +optional
+	Keys int64 `json:"keys,omitempty"`
+
+	// +optional
+	StartTime *metav1.Time `json:"startTime,omitempty"`
+
+	// +optional
+	CompletionTime *metav1.Time `json:"completionTime,omitempty"`
+
+	// Duration is how long the drill took.
+	// +optional
+	Duration *metav1.Duration `json:"duration,omitempty"`
+
+	// Message explains why the drill failed.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+// EtcdRestoreTestStatus defines the observed state of EtcdRestoreTest
+type EtcdRestoreTestStatus struct {
+	// LastScheduleTime is the scheduled time of the latest drill.
+	// +optional
+	LastScheduleTime *metav1.Time `json:"lastScheduleTime,omitempty"`
+
+	// LastRun is the running or latest drill.
+	// +optional
+	LastRun *RestoreTestRun `json:"lastRun,omitempty"`
+
+	// LastPassedTime is when a drill passed last.
+	// +optional
+	LastPassedTime *metav1.Time `json:"lastPassedTime,omitempty"`
+
+	// LastFailedTime is when a drill failed last.
+	// +optional
+	LastFailedTime *metav1.Time `json:"lastFailedTime,omitempty"`
+
+	// Message explains why no drills are started, for example an invalid schedule.
+	// +optional
+	Message string `json:"message,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+//+kubebuilder:subresource:status
+//+kubebuilder:printcolumn:name="Cluster",type=string,JSONPath=`.spec.clusterName`
+//+kubebuilder:printcolumn:name="Schedule",type=string,JSONPath=`.spec.schedule`
+//+kubebuilder:printcolumn:name="Result",type=string,JSONPath=`.status.lastRun.result`
+//+kubebuilder:printcolumn:name="Last Passed",type=date,JSONPath=`.status.lastPassedTime`
+//+kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+
+// EtcdRestoreTest is the Schema for the etcdrestoretests API. It periodically restores
+// the latest snapshot of a cluster into a scratch member and checks what it serves.
+type EtcdRestoreTest struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   EtcdRestoreTestSpec   `json:"spec,omitempty"`
+	Status EtcdRestoreTestStatus `json:"status,omitempty"`
+}
+
+//+kubebuilder:object:root=true
+
+// EtcdRestoreTestList contains a list of EtcdRestoreTest
+type EtcdRestoreTestList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []EtcdRestoreTest `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&EtcdRestoreTest{}, &EtcdRestoreTestList{})
+}
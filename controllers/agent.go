@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	"github.com/gqq/etcd-operator/pkg/backup"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// The agent is the manager binary started with the agent command. It runs in Jobs
+// because only a pod can reach the members directly and mount the volume a snapshot lives on.
+const (
+	agentContainerName = "agent"
+	agentScratchDir    = "/var/run/etcd-agent/scratch"
+	agentDataDir       = "/var/run/etcd-agent/data"
+	agentClientTLSDir  = "/etc/etcd/tls/client"
+	agentKeysDir       = "/etc/etcd-agent/keys"
+
+	agentScratchVolumeName   = "scratch"
+	agentDataVolumeName      = "data"
+	agentClientTLSVolumeName = "client-tls"
+	agentKeysVolumeName      = "encryption-keys"
+
+	// agentUser is the nonroot user of the distroless manager image.
+	agentUser int64 = 65532
+
+	agentBackoffLimit int32 = 2
+
+	s3AccessKeyIDKey     = "accessKeyID"
+	s3SecretAccessKeyKey = "secretAccessKey"
+)
+
+// newAgentJob returns a Job that runs one agent command.
+func newAgentJob(namespace, name, image string, labels map[string]string, args []string) *batchv1.Job {
+	backoffLimit := agentBackoffLimit
+	job := &batchv1.Job{}
+	job.Namespace = namespace
+	job.Name = name
+	job.Labels = labels
+	job.Spec = batchv1.JobSpec{
+		BackoffLimit: &backoffLimit,
+		Template: corev1.PodTemplateSpec{
+			Spec: newAgentPodSpec(image, args),
+		},
+	}
+	job.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+	return job
+}
+
+// newAgentPodSpec returns the spec of a pod that runs one agent command.
+func newAgentPodSpec(image string, args []string) corev1.PodSpec {
+	user := agentUser
+	return corev1.PodSpec{
+		SecurityContext: &corev1.PodSecurityContext{
+			RunAsUser: &user,
+			FSGroup:   &user,
+		},
+		Containers: []corev1.Container{
+			corev1.Container{
+				Name:    agentContainerName,
+				Image:   image,
+				Command: append([]string{"/manager", backup.AgentCommand}, args...),
+				// 失败时把最后几行日志当作结束信息，operator 可以直接读到错误原因
+				TerminationMessagePolicy: corev1.TerminationMessageFallbackToLogsOnError,
+				VolumeMounts: []corev1.VolumeMount{
+					corev1.VolumeMount{
+						Name:      agentScratchVolumeName,
+						MountPath: agentScratchDir,
+					},
+				},
+			},
+		},
+		Volumes: []corev1.Volume{
+			corev1.Volume{
+				Name: agentScratchVolumeName,
+				VolumeSource: corev1.VolumeSource{
+					EmptyDir: &corev1.EmptyDirVolumeSource{},
+				},
+			},
+		},
+	}
+}
+
+// agentEtcdArgs returns the flags that point the agent at a member, and mounts the
+// client certificate Secret into the pod when the cluster uses TLS.
+func agentEtcdArgs(spec *corev1.PodSpec, cluster *etcdv1alpha1.EtcdCluster, member, clientSecret string) []string {
+	args := []string{"--endpoint", memberClientURL(cluster, member)}
+	return append(args, agentTLSArgs(spec, cluster, clientSecret)...)
+}
+
+// agentTLSArgs returns the flags that make the agent present the client certificate
+// in the Secret, and mounts it. It returns nothing for clusters without TLS.
+func agentTLSArgs(spec *corev1.PodSpec, cluster *etcdv1alpha1.EtcdCluster, clientSecret string) []string {
+	if !tlsEnabled(cluster) {
+		return nil
+	}
+	addSecretVolume(spec, agentClientTLSVolumeName, clientSecret, agentClientTLSDir)
+	return []string{
+		"--cacert", agentClientTLSDir + "/" + caCertKey,
+		"--cert", agentClientTLSDir + "/" + corev1.TLSCertKey,
+		"--key", agentClientTLSDir + "/" + corev1.TLSPrivateKeyKey,
+	}
+}
+
+// agentStorageArgs returns the flags that select a backup destination and its
+// encryption, and sets up the pod for them.
+func agentStorageArgs(spec *corev1.PodSpec, dest *etcdv1alpha1.BackupDestination) []string {
+	return append(agentLocationArgs(spec, dest), agentEncryptionArgs(spec, dest.Encryption)...)
+}
+
+// agentLocationArgs returns the flags that select a backup destination, and mounts the
+// volume or passes the credentials it needs into the pod.
+func agentLocationArgs(spec *corev1.PodSpec, dest *etcdv1alpha1.BackupDestination) []string {
+	if dest.PVC != nil {
+		spec.Volumes = append(spec.Volumes, corev1.Volume{
+			Name: agentDataVolumeName,
+			VolumeSource: corev1.VolumeSource{
+				PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+					ClaimName: dest.PVC.ClaimName,
+				},
+			},
+		})
+		spec.Containers[0].VolumeMounts = append(spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+			Name:      agentDataVolumeName,
+			MountPath: agentDataDir,
+		})
+		return []string{"--dir", agentDataDir}
+	}
+
+	s3 := dest.S3
+	spec.Containers[0].Env = append(spec.Containers[0].Env,
+		secretEnv(backup.AccessKeyIDEnv, s3.CredentialsSecret, s3AccessKeyIDKey),
+		secretEnv(backup.SecretAccessKeyEnv, s3.CredentialsSecret, s3SecretAccessKeyKey),
+	)
+	args := []string{"--s3-endpoint", s3.Endpoint, "--s3-bucket", s3.Bucket}
+	if s3.Region != "" {
+		args = append(args, "--s3-region", s3.Region)
+	}
+	if s3.Insecure {
+		args = append(args, "--s3-insecure")
+	}
+	return args
+}
+
+// agentEncryptionArgs mounts the key Secret and returns the flags that make the agent
+// encrypt what it writes and decrypt what it reads.
+func agentEncryptionArgs(spec *corev1.PodSpec, enc *etcdv1alpha1.BackupEncryption) []string {
+	if enc == nil {
+		return nil
+	}
+	addSecretVolume(spec, agentKeysVolumeName, enc.KeySecret, agentKeysDir)
+	args := []string{"--keys-dir", agentKeysDir}
+	if enc.KeyID != "" {
+		args = append(args, "--key-id", enc.KeyID)
+	}
+	return args
+}
+
+func secretEnv(name, secret, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: secret},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+// validateDestination checks that exactly one destination is set.
+func validateDestination(dest *etcdv1alpha1.BackupDestination) error {
+	set := 0
+	for _, ok := range []bool{dest.PVC != nil, dest.S3 != nil, dest.VolumeSnapshot != nil} {
+		if ok {
+			set++
+		}
+	}
+	switch {
+	case set > 1:
+		return fmt.Errorf("only one of pvc, s3 and volumeSnapshot may be set")
+	case set == 0:
+		return fmt.Errorf("one of pvc, s3 and volumeSnapshot must be set")
+	case dest.PVC != nil && dest.PVC.ClaimName == "":
+		return fmt.Errorf("pvc.claimName must be set")
+	case dest.S3 != nil && (dest.S3.Endpoint == "" || dest.S3.Bucket == "" || dest.S3.CredentialsSecret == ""):
+		return fmt.Errorf("s3.endpoint, s3.bucket and s3.credentialsSecret must be set")
+	case dest.VolumeSnapshot != nil && dest.Encryption != nil:
+		return fmt.Errorf("volume snapshots cannot be encrypted")
+	case dest.Encryption != nil && dest.Encryption.KeySecret == "":
+		return fmt.Errorf("encryption.keySecret must be set")
+	}
+	return nil
+}
+
+// validateWritableDestination additionally checks that a destination snapshots are
+// written to says which key they are encrypted with.
+func validateWritableDestination(dest *etcdv1alpha1.BackupDestination) error {
+	if err := validateDestination(dest); err != nil {
+		return err
+	}
+	if dest.Encryption != nil && dest.Encryption.KeyID == "" {
+		return fmt.Errorf("encryption.keyID must be set")
+	}
+	return nil
+}
+
+// jobFinished reports whether a Job completed or failed.
+func jobFinished(job *batchv1.Job) (finished bool, failed bool) {
+	for _, c := range job.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			return true, false
+		case batchv1.JobFailed:
+			return true, true
+		}
+	}
+	return false, false
+}
+
+// agentMessage returns the termination message of the last agent pod of a Job that
+// ended in the given phase. It is the JSON result on success and the error otherwise.
+func agentMessage(ctx context.Context, c client.Client, job *batchv1.Job, phase corev1.PodPhase) (string, error) {
+	var pods corev1.PodList
+	if err := c.List(ctx, &pods, client.InNamespace(job.Namespace),
+		client.MatchingLabels{"job-name": job.Name}); err != nil {
+		return "", err
+	}
+	var latest *corev1.Pod
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if pod.Status.Phase != phase {
+			continue
+		}
+		if latest == nil || latest.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			latest = pod
+		}
+	}
+	if latest == nil {
+		return "", fmt.Errorf("job %s has no %s pod", job.Name, phase)
+	}
+	for _, s := range latest.Status.ContainerStatuses {
+		if s.Name == agentContainerName && s.State.Terminated != nil {
+			return s.State.Terminated.Message, nil
+		}
+	}
+	return "", fmt.Errorf("pod %s has no termination message", latest.Name)
+}
+
+// agentResult decodes the result of a completed agent Job into out.
+func agentResult(ctx context.Context, c client.Client, job *batchv1.Job, out interface{}) error {
+	msg, err := agentMessage(ctx, c, job, corev1.PodSucceeded)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(msg), out); err != nil {
+		return fmt.Errorf("decode result of job %s: %w", job.Name, err)
+	}
+	return nil
+}
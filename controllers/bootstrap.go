@@ -0,0 +1,269 @@
+package controllers
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// CloneNamespacesAnnotation on an EtcdCluster lists, comma separated, the namespaces
+// whose EtcdClusters may be cloned from it, "*" allows every namespace. A cluster can
+// always be cloned within its own namespace.
+var CloneNamespacesAnnotation = "etcd.gqq.com/clone-namespaces"
+
+// cloneCertValidity is how long the client certificate of a clone from another
+// namespace is valid. It is renewed while the clone waits for longer.
+const cloneCertValidity = time.Hour
+
+// initialMembers is how many members a new cluster starts with. A clone starts with
+// the seeded member only and grows to Spec.Size like in a scale up.
+func initialMembers(cluster *etcdv1alpha1.EtcdCluster) int32 {
+	if cluster.Spec.Bootstrap != nil && cluster.Spec.Bootstrap.CloneFrom != nil {
+		return 1
+	}
+	return *cluster.Spec.Size
+}
+
+// bootstrapSource is where the members of a new cluster are seeded from.
+type bootstrapSource struct {
+	// description names the source in the status and in events.
+	description string
+	// args returns the flags that make a restore Job read the source. It is nil while
+	// the source is not available.
+	args func(job *batchv1.Job) []string
+	// dataSource is what the member volumes are provisioned from, if anything.
+	dataSource *corev1.TypedLocalObjectReference
+}
+
+// bootstrap seeds the members of a new cluster that is restored from a snapshot or
+// cloned from another cluster. It runs until the StatefulSet exists and returns true
+// once the StatefulSet may be created. Until then the returned result says when to
+// look again.
+func (r *EtcdClusterReconciler) bootstrap(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster) (bool, ctrl.Result, error) {
+	spec := cluster.Spec.Bootstrap
+	if spec == nil || (spec.RestoreFrom == nil && spec.CloneFrom == nil) {
+		return true, ctrl.Result{}, nil
+	}
+	sts, err := r.getStatefulSet(ctx, cluster)
+	if err != nil || sts != nil {
+		return err == nil, ctrl.Result{}, err
+	}
+	if cluster.Status.Bootstrap == nil {
+		cluster.Status.Bootstrap = &etcdv1alpha1.BootstrapStatus{Phase: etcdv1alpha1.BootstrapPhasePending}
+	}
+	status := cluster.Status.Bootstrap
+	switch status.Phase {
+	case etcdv1alpha1.BootstrapPhaseCompleted:
+		return true, ctrl.Result{}, nil
+	case etcdv1alpha1.BootstrapPhaseFailed:
+		return false, ctrl.Result{}, nil
+	}
+
+	var source bootstrapSource
+	var pending, failure string
+	switch {
+	case spec.RestoreFrom != nil && spec.CloneFrom != nil:
+		failure = "bootstrap.restoreFrom and bootstrap.cloneFrom cannot be combined"
+	case spec.RestoreFrom != nil:
+		var snapshot *snapshotSource
+		snapshot, pending, failure, err = resolveSnapshotSource(ctx, r.Client, cluster.Namespace, spec.RestoreFrom)
+		if snapshot != nil {
+			source = bootstrapSource{description: snapshot.path, args: snapshot.args, dataSource: snapshot.dataSource()}
+		}
+	default:
+		source, pending, failure, err = r.resolveCloneSource(ctx, cluster)
+	}
+	if err != nil {
+		return false, ctrl.Result{}, err
+	}
+	if failure != "" {
+		r.failBootstrap(cluster, failure)
+		return false, ctrl.Result{}, nil
+	}
+	if pending == "" && r.AgentImage == "" {
+		pending = "the operator was started without --agent-image"
+	}
+	// 已经开始的 Job 不需要再访问数据源，可以继续等它结束
+	if pending != "" && status.Phase != etcdv1alpha1.BootstrapPhaseSeeding {
+		status.Message = pending
+		setCondition(cluster, etcdv1alpha1.ConditionProgressing, metav1.ConditionTrue, etcdv1alpha1.ReasonBootstrapping, pending)
+		return false, ctrl.Result{RequeueAfter: backupPendingRequeuePeriod}, nil
+	}
+
+	members := initialMembers(cluster)
+	if status.Phase == etcdv1alpha1.BootstrapPhasePending {
+		status.Source = source.description
+		r.Recorder.Eventf(cluster, corev1.EventTypeNormal, "Bootstrapping", "seeding %d members from %s", members, source.description)
+	}
+	status.Phase = etcdv1alpha1.BootstrapPhaseSeeding
+	status.Message = pending
+	// 初始 token 和成员配置里的一致，恢复出来的集群有新的 cluster ID
+	seeder := &memberSeeder{
+		Client:     r.Client,
+		scheme:     r.Scheme,
+		image:      r.AgentImage,
+		owner:      cluster,
+		name:       cluster.Name,
+		cluster:    cluster,
+		token:      string(cluster.UID),
+		sourceArgs: source.args,
+		dataSource: source.dataSource,
+	}
+	seeded, result, failure, err := seeder.seed(ctx, int(members))
+	status.SeededMembers = int32(seeded)
+	if err != nil {
+		return false, ctrl.Result{}, err
+	}
+	if failure != "" {
+		if err := seeder.cleanup(ctx); err != nil {
+			return false, ctrl.Result{}, err
+		}
+		if err := r.deleteCloneClientSecret(ctx, cluster); err != nil {
+			return false, ctrl.Result{}, err
+		}
+		r.failBootstrap(cluster, failure)
+		return false, ctrl.Result{}, nil
+	}
+	if seeded < int(members) {
+		setCondition(cluster, etcdv1alpha1.ConditionProgressing, metav1.ConditionTrue, etcdv1alpha1.ReasonBootstrapping,
+			"seeding member volumes from "+status.Source)
+		if pending != "" {
+			return false, ctrl.Result{RequeueAfter: backupPendingRequeuePeriod}, nil
+		}
+		return false, ctrl.Result{}, nil
+	}
+
+	if err := r.deleteCloneClientSecret(ctx, cluster); err != nil {
+		return false, ctrl.Result{}, err
+	}
+	status.Phase = etcdv1alpha1.BootstrapPhaseCompleted
+	status.Revision = result.Revision
+	status.Message = ""
+	r.Recorder.Eventf(cluster, corev1.EventTypeNormal, "Bootstrapped", "seeded %d members at revision %d", seeded, result.Revision)
+	return true, ctrl.Result{}, nil
+}
+
+// resolveCloneSource picks the member of the source cluster the snapshot is streamed
+// from. It waits while the source has no healthy member, or while a source in another
+// namespace does not allow clones into the namespace of the new cluster.
+func (r *EtcdClusterReconciler) resolveCloneSource(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster) (
+	source bootstrapSource, pending string, failure string, err error) {
+	ref := cluster.Spec.Bootstrap.CloneFrom
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = cluster.Namespace
+	}
+	if namespace == cluster.Namespace && ref.Name == cluster.Name {
+		return source, "", "a cluster cannot be cloned from itself", nil
+	}
+	var sourceCluster etcdv1alpha1.EtcdCluster
+	err = r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: ref.Name}, &sourceCluster)
+	if apierrors.IsNotFound(err) {
+		return source, fmt.Sprintf("waiting for EtcdCluster %s/%s", namespace, ref.Name), "", nil
+	}
+	if err != nil {
+		return source, "", "", err
+	}
+	if namespace != cluster.Namespace {
+		if !cloneAllowed(&sourceCluster, cluster.Namespace) {
+			return source, fmt.Sprintf("waiting for EtcdCluster %s/%s to allow clones into namespace %s with the %s annotation",
+				namespace, ref.Name, cluster.Namespace, CloneNamespacesAnnotation), "", nil
+		}
+		if tlsEnabled(&sourceCluster) && !operatorManagedTLS(&sourceCluster) {
+			return source, "", fmt.Sprintf("EtcdCluster %s/%s uses its own certificates, it can only be cloned within its namespace",
+				namespace, ref.Name), nil
+		}
+	}
+	member := snapshotMember(&sourceCluster)
+	if member == "" {
+		return source, fmt.Sprintf("waiting for a healthy member of EtcdCluster %s/%s", namespace, ref.Name), "", nil
+	}
+
+	secret := ""
+	if tlsEnabled(&sourceCluster) {
+		if secret, err = r.cloneClientSecret(ctx, cluster, &sourceCluster); err != nil {
+			return source, "", "", err
+		}
+	}
+	source.description = fmt.Sprintf("%s/%s member %s", namespace, ref.Name, member)
+	source.args = func(job *batchv1.Job) []string {
+		return agentEtcdArgs(&job.Spec.Template.Spec, &sourceCluster, member, secret)
+	}
+	return source, "", "", nil
+}
+
+// cloneAllowed reports whether the annotation of source allows clones into namespace.
+func cloneAllowed(source *etcdv1alpha1.EtcdCluster, namespace string) bool {
+	for _, allowed := range strings.Split(source.Annotations[CloneNamespacesAnnotation], ",") {
+		if allowed = strings.TrimSpace(allowed); allowed == "*" || allowed == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// cloneClientSecret returns the Secret with a client certificate of the source
+// cluster. Secrets cannot be mounted across namespaces, and the operator's own client
+// key never leaves the namespace of its cluster, so a source in another namespace gets
+// a certificate of its own signed by the source CA. etcd has no read-only permission
+// that allows snapshots, so the certificate is short lived and deleted once the
+// members are seeded.
+func (r *EtcdClusterReconciler) cloneClientSecret(ctx context.Context, cluster, source *etcdv1alpha1.EtcdCluster) (string, error) {
+	if source.Namespace == cluster.Namespace {
+		return clientSecretName(source), nil
+	}
+	var ca corev1.Secret
+	if err := r.Get(ctx, secretKey(source, caSecretName(source)), &ca); err != nil {
+		return "", fmt.Errorf("get CA of %s/%s: %w", source.Namespace, source.Name, err)
+	}
+	signer, bundle := caSigner(&ca)
+	secret := newOwnedSecret(cluster, cloneClientSecretName(cluster))
+	secret.Type = corev1.SecretTypeTLS
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, secret, func() error {
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		// 快过期的时候重新签发，Job 启动时读到的一定还有效
+		if cert, err := parseCertificate(secret.Data[corev1.TLSCertKey]); err != nil || time.Until(cert.NotAfter) < cloneCertValidity/2 {
+			commonName := fmt.Sprintf("clone:%s/%s", cluster.Namespace, cluster.Name)
+			cert, err := newSignedCert(signer, commonName, nil, nil, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, cloneCertValidity)
+			if err != nil {
+				return err
+			}
+			secret.Data[corev1.TLSCertKey] = cert.certPEM
+			secret.Data[corev1.TLSPrivateKeyKey] = cert.keyPEM
+		}
+		secret.Data[caCertKey] = bundle
+		return controllerutil.SetControllerReference(cluster, secret, r.Schemes())
+	})
+	return secret.Name, err
+}
+
+func cloneClientSecretName(cluster *etcdv1alpha1.EtcdCluster) string {
+	return cluster.Name + "-clone-source-tls"
+}
+
+// deleteCloneClientSecret deletes the client certificate of a clone once it is not needed any more.
+func (r *EtcdClusterReconciler) deleteCloneClientSecret(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster) error {
+	return client.IgnoreNotFound(r.Delete(ctx, newOwnedSecret(cluster, cloneClientSecretName(cluster))))
+}
+
+func (r *EtcdClusterReconciler) failBootstrap(cluster *etcdv1alpha1.EtcdCluster, msg string) {
+	cluster.Status.Bootstrap.Phase = etcdv1alpha1.BootstrapPhaseFailed
+	cluster.Status.Bootstrap.Message = msg
+	setCondition(cluster, etcdv1alpha1.ConditionProgressing, metav1.ConditionFalse, etcdv1alpha1.ReasonBootstrapFailed, msg)
+	setCondition(cluster, etcdv1alpha1.ConditionDegraded, metav1.ConditionTrue, etcdv1alpha1.ReasonBootstrapFailed, msg)
+	r.Recorder.Event(cluster, corev1.EventTypeWarning, "BootstrapFailed", msg)
+}
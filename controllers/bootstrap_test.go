@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"strings"
+	"testing"
+	"time"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCloneAcrossNamespaces(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = etcdv1alpha1.AddToScheme(scheme)
+
+	size := int32(3)
+	sourceCluster := &etcdv1alpha1.EtcdCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "prod", Namespace: "team-a"},
+		Spec: etcdv1alpha1.EtcdClusterSpec{Size: &size, Image: "quay.io/coreos/etcd:v3.5.1",
+			TLS: &etcdv1alpha1.TLSSpec{Mode: etcdv1alpha1.TLSModeOperator}},
+	}
+	sourceCluster.Status.Members = []etcdv1alpha1.MemberStatus{{Name: "prod-0", Healthy: true}}
+	ca, err := newCA("prod-ca", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caSecret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "prod-ca", Namespace: "team-a"},
+		Data: map[string][]byte{caCertKey: ca.certPEM, caKeyKey: ca.keyPEM}}
+	operatorSecret := &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "prod-client-tls", Namespace: "team-a"},
+		Data: map[string][]byte{corev1.TLSPrivateKeyKey: []byte("operator key")}}
+	cluster := &etcdv1alpha1.EtcdCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "copy", Namespace: "team-b"},
+		Spec: etcdv1alpha1.EtcdClusterSpec{Size: &size, Image: "quay.io/coreos/etcd:v3.5.1",
+			Bootstrap: &etcdv1alpha1.BootstrapSpec{CloneFrom: &etcdv1alpha1.CloneSource{Name: "prod", Namespace: "team-a"}}},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(sourceCluster, caSecret, operatorSecret, cluster.DeepCopy()).Build()
+	r := &EtcdClusterReconciler{Client: c, Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+
+	// 源集群没有允许之前一直等待
+	_, pending, failure, err := r.resolveCloneSource(ctx, cluster)
+	if err != nil || failure != "" || !strings.Contains(pending, CloneNamespacesAnnotation) {
+		t.Fatalf("pending %q, failure %q, error %v", pending, failure, err)
+	}
+
+	sourceCluster.Annotations = map[string]string{CloneNamespacesAnnotation: "team-c, team-b"}
+	if err := c.Update(ctx, sourceCluster); err != nil {
+		t.Fatal(err)
+	}
+	source, pending, failure, err := r.resolveCloneSource(ctx, cluster)
+	if err != nil || failure != "" || pending != "" || source.args == nil {
+		t.Fatalf("pending %q, failure %q, error %v", pending, failure, err)
+	}
+	var secret corev1.Secret
+	if err := c.Get(ctx, secretKey(cluster, cloneClientSecretName(cluster)), &secret); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(secret.Data[corev1.TLSPrivateKeyKey], operatorSecret.Data[corev1.TLSPrivateKeyKey]) {
+		t.Error("the operator's client key was copied into the namespace of the clone")
+	}
+	cert, err := parseCertificate(secret.Data[corev1.TLSCertKey])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.NotAfter.After(time.Now().Add(cloneCertValidity)) || cert.CheckSignatureFrom(mustParse(t, ca.certPEM)) != nil {
+		t.Errorf("clone certificate valid until %s, signed by %s", cert.NotAfter, cert.Issuer)
+	}
+
+	if err := r.deleteCloneClientSecret(ctx, cluster); err != nil {
+		t.Fatal(err)
+	}
+	sourceCluster.Spec.TLS.Mode = etcdv1alpha1.TLSModeSecrets
+	if err := c.Update(ctx, sourceCluster); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, failure, _ := r.resolveCloneSource(ctx, cluster); failure == "" {
+		t.Error("cloned a cluster with user provided certificates across namespaces")
+	}
+}
+
+func mustParse(t *testing.T, certPEM []byte) *x509.Certificate {
+	t.Helper()
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
@@ -0,0 +1,350 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// CARotationPhaseAnnotation and LastRotationAnnotation on the CA Secret are the source of
+	// truth for certificate rotation; Status.TLS only mirrors them.
+	CARotationPhaseAnnotation = "etcd.gqq.com/ca-rotation-phase"
+	LastRotationAnnotation    = "etcd.gqq.com/last-rotation"
+
+	defaultRenewAtPercent = 67
+)
+
+// certManager issues and renews the operator generated certificates of a cluster.
+//
+// Member and client certificates are renewed once RenewAtPercent of their lifetime has
+// passed. The CA is rotated in phases so that members never stop trusting each other:
+// first members trust the old and the new CA while certificates are still signed by the
+// old one (TrustBoth), then every certificate is reissued by the new CA (Reissue), and
+// finally the old CA is dropped. Every renewal moves the last rotation time forward, and
+// a phase only advances once every member has been restarted after it.
+type certManager struct {
+	r       *EtcdClusterReconciler
+	cluster *etcdv1alpha1.EtcdCluster
+	now     time.Time
+
+	// signer signs member and client certificates, bundle is what everybody trusts.
+	signer keyPair
+	bundle []byte
+
+	lastRotation  time.Time
+	nextRotation  time.Time
+	certsNotAfter time.Time
+}
+
+// reconcileCertificates makes sure every certificate of an Operator mode cluster exists
+// and is not due for renewal, and records their state in the status.
+func (r *EtcdClusterReconciler) reconcileCertificates(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster) error {
+	if !operatorManagedTLS(cluster) {
+		cluster.Status.TLS = nil
+		return nil
+	}
+	m := &certManager{r: r, cluster: cluster, now: time.Now()}
+	return m.reconcile(ctx)
+}
+
+func (m *certManager) reconcile(ctx context.Context) error {
+	// 扩容之前新成员的证书就要存在
+	members := int(*m.cluster.Spec.Size)
+	sts, err := m.r.getStatefulSet(ctx, m.cluster)
+	if err != nil {
+		return err
+	}
+	restarted := true
+	if sts != nil {
+		if int(*sts.Spec.Replicas) > members {
+			members = int(*sts.Spec.Replicas)
+		}
+		if restarted, err = m.r.allMembersStartedAfter(ctx, m.cluster, m.lastRotationOf(ctx)); err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, members)
+	for i := 0; i < members; i++ {
+		names = append(names, memberName(m.cluster, i))
+	}
+
+	phase, caNotAfter, err := m.reconcileCA(ctx, restarted)
+	if err != nil {
+		return err
+	}
+
+	peerUsages := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	peerRenewed, err := m.reconcileMemberCerts(ctx, peerSecretName(m.cluster), names, peerUsages, false)
+	if err != nil {
+		return err
+	}
+	serverUsages := []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	serverRenewed, err := m.reconcileMemberCerts(ctx, serverSecretName(m.cluster), names, serverUsages, true)
+	if err != nil {
+		return err
+	}
+	if err := m.reconcileClientCert(ctx); err != nil {
+		return err
+	}
+	if peerRenewed || serverRenewed {
+		if err := m.markRotated(ctx); err != nil {
+			return err
+		}
+	}
+
+	status := &etcdv1alpha1.TLSStatus{
+		CANotAfter:           &metav1.Time{Time: caNotAfter},
+		CertificatesNotAfter: &metav1.Time{Time: m.certsNotAfter},
+		NextRotationTime:     &metav1.Time{Time: m.nextRotation},
+		CARotationPhase:      phase,
+	}
+	if !m.lastRotation.IsZero() {
+		status.LastRotationTime = &metav1.Time{Time: m.lastRotation}
+	}
+	m.cluster.Status.TLS = status
+	return nil
+}
+
+func (m *certManager) renewAtPercent() int32 {
+	if m.cluster.Spec.TLS.RenewAtPercent != nil {
+		return *m.cluster.Spec.TLS.RenewAtPercent
+	}
+	return defaultRenewAtPercent
+}
+
+func (m *certManager) certValidity() time.Duration {
+	if m.cluster.Spec.TLS.CertificateValidity != nil {
+		return m.cluster.Spec.TLS.CertificateValidity.Duration
+	}
+	return defaultCertValidity
+}
+
+func (m *certManager) caValidity() time.Duration {
+	if m.cluster.Spec.TLS.CAValidity != nil {
+		return m.cluster.Spec.TLS.CAValidity.Duration
+	}
+	return defaultCAValidity
+}
+
+// track records the renewal time and expiry of a certificate.
+func (m *certManager) track(cert *x509.Certificate, leaf bool) {
+	renewAt := renewalTime(cert, m.renewAtPercent())
+	if m.nextRotation.IsZero() || renewAt.Before(m.nextRotation) {
+		m.nextRotation = renewAt
+	}
+	if leaf && (m.certsNotAfter.IsZero() || cert.NotAfter.Before(m.certsNotAfter)) {
+		m.certsNotAfter = cert.NotAfter
+	}
+}
+
+// lastRotationOf reads the last rotation time from the CA Secret.
+func (m *certManager) lastRotationOf(ctx context.Context) time.Time {
+	var secret corev1.Secret
+	if err := m.r.Get(ctx, secretKey(m.cluster, caSecretName(m.cluster)), &secret); err != nil {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339, secret.Annotations[LastRotationAnnotation])
+	return t
+}
+
+// reconcileCA creates the CA, advances a CA rotation whose previous phase every member
+// has picked up, and prepares the signer and trust bundle for the leaf certificates.
+func (m *certManager) reconcileCA(ctx context.Context, restarted bool) (string, time.Time, error) {
+	var phase string
+	var caNotAfter time.Time
+	secret := newOwnedSecret(m.cluster, caSecretName(m.cluster))
+	_, err := controllerutil.CreateOrUpdate(ctx, m.r.Client, secret, func() error {
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+		if len(secret.Data[caCertKey]) == 0 || len(secret.Data[caKeyKey]) == 0 {
+			ca, err := newCA(fmt.Sprintf("%s-ca", m.cluster.Name), m.caValidity())
+			if err != nil {
+				return err
+			}
+			secret.Data = map[string][]byte{caCertKey: ca.certPEM, caKeyKey: ca.keyPEM}
+		}
+		caCert, err := parseCertificate(secret.Data[caCertKey])
+		if err != nil {
+			return fmt.Errorf("parse CA certificate: %w", err)
+		}
+
+		phase = secret.Annotations[CARotationPhaseAnnotation]
+		switch {
+		case phase == "" && !m.now.Before(renewalTime(caCert, m.renewAtPercent())):
+			ca, err := newCA(fmt.Sprintf("%s-ca", m.cluster.Name), m.caValidity())
+			if err != nil {
+				return err
+			}
+			secret.Data[previousCACertKey] = secret.Data[caCertKey]
+			secret.Data[previousCAKeyKey] = secret.Data[caKeyKey]
+			secret.Data[caCertKey], secret.Data[caKeyKey] = ca.certPEM, ca.keyPEM
+			phase = etcdv1alpha1.CARotationTrustBoth
+			m.rotated(secret)
+		case phase == etcdv1alpha1.CARotationTrustBoth && restarted:
+			phase = etcdv1alpha1.CARotationReissue
+			m.rotated(secret)
+		case phase == etcdv1alpha1.CARotationReissue && restarted:
+			delete(secret.Data, previousCACertKey)
+			delete(secret.Data, previousCAKeyKey)
+			phase = ""
+			m.rotated(secret)
+		}
+		if phase == "" {
+			delete(secret.Annotations, CARotationPhaseAnnotation)
+		} else {
+			secret.Annotations[CARotationPhaseAnnotation] = phase
+		}
+		m.lastRotation, _ = time.Parse(time.RFC3339, secret.Annotations[LastRotationAnnotation])
+
+		m.signer, m.bundle = caSigner(secret)
+
+		if caCert, err = parseCertificate(secret.Data[caCertKey]); err != nil {
+			return fmt.Errorf("parse CA certificate: %w", err)
+		}
+		caNotAfter = caCert.NotAfter
+		m.track(caCert, false)
+		return controllerutil.SetControllerReference(m.cluster, secret, m.r.Schemes())
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if phase != "" {
+		log.FromContext(ctx).Info("rotating the cluster CA", "phase", phase)
+	}
+	return phase, caNotAfter, nil
+}
+
+// caSigner returns the CA that signs leaf certificates and the bundle every member
+// trusts, for the rotation phase the CA Secret is in.
+func caSigner(secret *corev1.Secret) (keyPair, []byte) {
+	signer := keyPair{certPEM: secret.Data[caCertKey], keyPEM: secret.Data[caKeyKey]}
+	// 轮换 CA 的第一阶段还用旧的 CA 签发证书
+	if secret.Annotations[CARotationPhaseAnnotation] == etcdv1alpha1.CARotationTrustBoth {
+		signer = keyPair{certPEM: secret.Data[previousCACertKey], keyPEM: secret.Data[previousCAKeyKey]}
+	}
+	return signer, append(append([]byte{}, secret.Data[caCertKey]...), secret.Data[previousCACertKey]...)
+}
+
+// rotated stamps the CA Secret with the current time as the last rotation.
+func (m *certManager) rotated(secret *corev1.Secret) {
+	secret.Annotations[LastRotationAnnotation] = m.now.UTC().Format(time.RFC3339)
+}
+
+// markRotated records that member certificates were renewed.
+func (m *certManager) markRotated(ctx context.Context) error {
+	secret := newOwnedSecret(m.cluster, caSecretName(m.cluster))
+	_, err := controllerutil.CreateOrUpdate(ctx, m.r.Client, secret, func() error {
+		if secret.Annotations == nil {
+			secret.Annotations = map[string]string{}
+		}
+		m.rotated(secret)
+		return nil
+	})
+	m.lastRotation = m.now
+	return err
+}
+
+// needsRenewal reports whether a certificate is missing, due, or not signed by the current signer.
+func (m *certManager) needsRenewal(certPEM []byte) (bool, *x509.Certificate) {
+	if len(certPEM) == 0 {
+		return true, nil
+	}
+	cert, err := parseCertificate(certPEM)
+	if err != nil {
+		return true, nil
+	}
+	signer, err := parseCertificate(m.signer.certPEM)
+	if err != nil || cert.CheckSignatureFrom(signer) != nil {
+		return true, cert
+	}
+	return !m.now.Before(renewalTime(cert, m.renewAtPercent())), cert
+}
+
+// reconcileMemberCerts issues a certificate for every member that has none and renews the
+// ones that are due. It returns true when an existing certificate was renewed, which means
+// the running members have to be restarted.
+func (m *certManager) reconcileMemberCerts(ctx context.Context, secretName string, names []string,
+	usages []x509.ExtKeyUsage, server bool) (bool, error) {
+	renewed := false
+	secret := newOwnedSecret(m.cluster, secretName)
+	_, err := controllerutil.CreateOrUpdate(ctx, m.r.Client, secret, func() error {
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		if !bytes.Equal(secret.Data[caCertKey], m.bundle) {
+			secret.Data[caCertKey] = m.bundle
+		}
+		for _, name := range names {
+			renew, old := m.needsRenewal(secret.Data[name+".crt"])
+			if !renew {
+				m.track(old, true)
+				continue
+			}
+			dnsNames := []string{memberHost(m.cluster, name)}
+			var ips []net.IP
+			if server {
+				// 客户端也可能通过 service 名字或者本地地址访问
+				dnsNames = append(dnsNames,
+					fmt.Sprintf("%s.%s.svc", m.cluster.Name, m.cluster.Namespace),
+					fmt.Sprintf("%s.%s.svc.cluster.local", m.cluster.Name, m.cluster.Namespace),
+					"localhost")
+				ips = []net.IP{net.ParseIP("127.0.0.1")}
+			}
+			cert, err := newSignedCert(m.signer, name, dnsNames, ips, usages, m.certValidity())
+			if err != nil {
+				return err
+			}
+			secret.Data[name+".crt"] = cert.certPEM
+			secret.Data[name+".key"] = cert.keyPEM
+			if old != nil {
+				renewed = true
+			}
+			parsed, err := parseCertificate(cert.certPEM)
+			if err != nil {
+				return err
+			}
+			m.track(parsed, true)
+		}
+		return controllerutil.SetControllerReference(m.cluster, secret, m.r.Schemes())
+	})
+	return renewed, err
+}
+
+// reconcileClientCert issues or renews the client certificate the operator authenticates to etcd with.
+func (m *certManager) reconcileClientCert(ctx context.Context) error {
+	secret := newOwnedSecret(m.cluster, clientSecretName(m.cluster))
+	secret.Type = corev1.SecretTypeTLS
+	_, err := controllerutil.CreateOrUpdate(ctx, m.r.Client, secret, func() error {
+		if secret.Data == nil {
+			secret.Data = map[string][]byte{}
+		}
+		renew, old := m.needsRenewal(secret.Data[corev1.TLSCertKey])
+		if renew {
+			cert, err := newSignedCert(m.signer, "etcd-operator", nil, nil,
+				[]x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}, m.certValidity())
+			if err != nil {
+				return err
+			}
+			secret.Data[corev1.TLSCertKey] = cert.certPEM
+			secret.Data[corev1.TLSPrivateKeyKey] = cert.keyPEM
+			if old, _ = parseCertificate(cert.certPEM); old == nil {
+				return fmt.Errorf("parse client certificate")
+			}
+		}
+		m.track(old, true)
+		secret.Data[caCertKey] = m.bundle
+		return controllerutil.SetControllerReference(m.cluster, secret, m.r.Schemes())
+	})
+	return err
+}
@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestCARotationWaitsForRestarts(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = etcdv1alpha1.AddToScheme(scheme)
+
+	size := int32(2)
+	cluster := &etcdv1alpha1.EtcdCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "etcd", Namespace: "default", UID: "uid"},
+		Spec: etcdv1alpha1.EtcdClusterSpec{Size: &size, Image: "quay.io/coreos/etcd:v3.5.1",
+			TLS: &etcdv1alpha1.TLSSpec{Mode: etcdv1alpha1.TLSModeOperator, CAValidity: &metav1.Duration{Duration: 10 * time.Hour}}},
+	}
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "etcd", Namespace: "default"}}
+	sts.Spec.Replicas = &size
+	start := time.Now().Truncate(time.Second)
+	var pods []*corev1.Pod
+	for _, name := range []string{"etcd-0", "etcd-1"} {
+		pods = append(pods, &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default",
+			Labels: map[string]string{EtcdClusterLabelKey: "etcd"}, CreationTimestamp: metav1.NewTime(start.Add(-time.Hour))}})
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cluster.DeepCopy(), sts, pods[0], pods[1]).Build()
+	r := &EtcdClusterReconciler{Client: c, Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+
+	reconcile := func(now time.Time) *certManager {
+		t.Helper()
+		m := &certManager{r: r, cluster: cluster, now: now}
+		if err := m.reconcile(ctx); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	getSecret := func(name string) *corev1.Secret {
+		t.Helper()
+		var secret corev1.Secret
+		if err := c.Get(ctx, client.ObjectKey{Namespace: "default", Name: name}, &secret); err != nil {
+			t.Fatal(err)
+		}
+		return &secret
+	}
+	restart := func(pod *corev1.Pod, at time.Time) {
+		t.Helper()
+		pod.CreationTimestamp = metav1.NewTime(at)
+		if err := c.Update(ctx, pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// check 检查阶段、签发证书的 CA、信任的 CA 以及成员证书的签发者
+	check := func(m *certManager, phase string, signer []byte, trusted ...[]byte) {
+		t.Helper()
+		if got := cluster.Status.TLS.CARotationPhase; got != phase {
+			t.Fatalf("rotation phase %q, want %q", got, phase)
+		}
+		if !bytes.Equal(m.signer.certPEM, signer) {
+			t.Fatalf("%q: certificates are signed by the wrong CA", phase)
+		}
+		bundle := bytes.Join(trusted, nil)
+		if !bytes.Equal(m.bundle, bundle) {
+			t.Fatalf("%q: members trust the wrong CAs", phase)
+		}
+		peer := getSecret(peerSecretName(cluster))
+		if !bytes.Equal(peer.Data[caCertKey], bundle) {
+			t.Fatalf("%q: peer Secret trusts the wrong CAs", phase)
+		}
+		ca := mustParse(t, signer)
+		for _, name := range []string{"etcd-0", "etcd-1"} {
+			if err := mustParse(t, peer.Data[name+".crt"]).CheckSignatureFrom(ca); err != nil {
+				t.Fatalf("%q: peer certificate of %s: %v", phase, name, err)
+			}
+		}
+	}
+
+	m := reconcile(start)
+	oldCA := getSecret(caSecretName(cluster)).Data[caCertKey]
+	check(m, "", oldCA, oldCA)
+
+	// CA 过了 RenewAtPercent，先同时信任新旧 CA，证书还由旧 CA 签发
+	rotation := start.Add(8 * time.Hour)
+	m = reconcile(rotation)
+	newCA := getSecret(caSecretName(cluster)).Data[caCertKey]
+	if bytes.Equal(newCA, oldCA) {
+		t.Fatal("CA was not rotated")
+	}
+	check(m, etcdv1alpha1.CARotationTrustBoth, oldCA, newCA, oldCA)
+
+	// 只重启了一个成员，不能进入下一阶段
+	restart(pods[0], rotation.Add(time.Minute))
+	m = reconcile(rotation.Add(2 * time.Minute))
+	check(m, etcdv1alpha1.CARotationTrustBoth, oldCA, newCA, oldCA)
+
+	restart(pods[1], rotation.Add(3*time.Minute))
+	reissue := rotation.Add(4 * time.Minute)
+	m = reconcile(reissue)
+	check(m, etcdv1alpha1.CARotationReissue, newCA, newCA, oldCA)
+
+	restart(pods[0], reissue.Add(time.Minute))
+	restart(pods[1], reissue.Add(-time.Minute))
+	m = reconcile(reissue.Add(2 * time.Minute))
+	check(m, etcdv1alpha1.CARotationReissue, newCA, newCA, oldCA)
+
+	// 所有成员都用新证书启动之后才不再信任旧 CA
+	restart(pods[1], reissue.Add(3*time.Minute))
+	m = reconcile(reissue.Add(4 * time.Minute))
+	check(m, "", newCA, newCA)
+	if secret := getSecret(caSecretName(cluster)); len(secret.Data[previousCACertKey]) > 0 || len(secret.Data[previousCAKeyKey]) > 0 {
+		t.Error("old CA was kept after the rotation")
+	}
+}
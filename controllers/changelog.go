@@ -0,0 +1,129 @@
+package controllers
+
+import (
+	"context"
+	"path"
+	"strings"
+	"time"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// ChangeLogLabelKey marks the pods of the change log writer of a cluster. They must not
+// carry EtcdClusterLabelKey, or the headless Service would route clients to them.
+var ChangeLogLabelKey = "etcd.gqq.com/changelog"
+
+// defaultSegmentInterval is used when Spec.ChangeLog.SegmentInterval is not set.
+const defaultSegmentInterval = 10 * time.Second
+
+func changeLogName(cluster *etcdv1alpha1.EtcdCluster) string {
+	return cluster.Name + "-changelog"
+}
+
+// changeLogPath returns the directory the change log of a cluster is written to.
+func changeLogPath(cluster *etcdv1alpha1.EtcdCluster) string {
+	dest := &cluster.Spec.ChangeLog.Destination
+	if p := sourcePath(dest); p != "" {
+		return p
+	}
+	return defaultChangeLogPath(dest, cluster.Namespace, cluster.Name)
+}
+
+// defaultChangeLogPath puts the change log next to the snapshots EtcdBackups write by default.
+func defaultChangeLogPath(dest *etcdv1alpha1.BackupDestination, namespace, cluster string) string {
+	if dest.S3 != nil {
+		return path.Join(namespace, cluster, "changelog")
+	}
+	return path.Join(cluster, "changelog")
+}
+
+// reconcileChangeLog runs the change log writer of the cluster in a Deployment with a
+// single pod, and removes it when the change log is turned off.
+func (r *EtcdClusterReconciler) reconcileChangeLog(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster) error {
+	var deploy appsv1.Deployment
+	deploy.Namespace = cluster.Namespace
+	deploy.Name = changeLogName(cluster)
+	if cluster.Spec.ChangeLog == nil {
+		cluster.Status.ChangeLog = nil
+		if err := r.Delete(ctx, &deploy); err != nil && !apierrors.IsNotFound(err) {
+			return err
+		}
+		return nil
+	}
+
+	status := &etcdv1alpha1.ChangeLogStatus{Path: changeLogPath(cluster)}
+	cluster.Status.ChangeLog = status
+	if err := validateWritableDestination(&cluster.Spec.ChangeLog.Destination); err != nil {
+		status.Message = "changeLog.destination: " + err.Error()
+		return nil
+	}
+	if cluster.Spec.ChangeLog.Destination.VolumeSnapshot != nil {
+		status.Message = "changeLog.destination: the change log cannot be kept in a volume snapshot"
+		return nil
+	}
+	if r.AgentImage == "" {
+		status.Message = "the operator was started without --agent-image"
+		return nil
+	}
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, &deploy, func() error {
+		mutateChangeLogDeployment(cluster, &deploy, r.AgentImage)
+		return controllerutil.SetControllerReference(cluster, &deploy, r.Schemes())
+	})
+	if err != nil {
+		return err
+	}
+	status.Available = deploy.Status.AvailableReplicas > 0
+	if !status.Available {
+		status.Message = "waiting for the writer to start"
+	}
+	return nil
+}
+
+// mutateChangeLogDeployment only touches the pod template when it changes, like MutateStatefulSet.
+func mutateChangeLogDeployment(cluster *etcdv1alpha1.EtcdCluster, deploy *appsv1.Deployment, image string) {
+	labels := map[string]string{
+		EtcdClusterCommonLabelKey: "etcd-changelog",
+		ChangeLogLabelKey:         cluster.Name,
+	}
+	deploy.Labels = labels
+	if deploy.CreationTimestamp.IsZero() {
+		replicas := int32(1)
+		deploy.Spec.Replicas = &replicas
+		deploy.Spec.Selector = &metav1.LabelSelector{MatchLabels: labels}
+		// 同一时间只能有一个 writer，否则会写出重叠的 segment
+		deploy.Spec.Strategy = appsv1.DeploymentStrategy{Type: appsv1.RecreateDeploymentStrategyType}
+	}
+
+	interval := defaultSegmentInterval
+	if cluster.Spec.ChangeLog.SegmentInterval != nil {
+		interval = cluster.Spec.ChangeLog.SegmentInterval.Duration
+	}
+	spec := newAgentPodSpec(image, nil)
+	args := []string{"changelog",
+		"--path", changeLogPath(cluster),
+		"--segment-interval", interval.String(),
+		"--endpoint", strings.Join(clientEndpoints(cluster, *cluster.Spec.Size), ","),
+	}
+	args = append(args, agentTLSArgs(&spec, cluster, clientSecretName(cluster))...)
+	args = append(args, agentStorageArgs(&spec, &cluster.Spec.ChangeLog.Destination)...)
+	spec.Containers[0].Command = append(spec.Containers[0].Command, args...)
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{Labels: labels},
+		Spec:       spec,
+	}
+
+	hash := podTemplateHash(&template)
+	if deploy.Annotations[TemplateHashAnnotation] == hash {
+		return
+	}
+	if deploy.Annotations == nil {
+		deploy.Annotations = map[string]string{}
+	}
+	deploy.Annotations[TemplateHashAnnotation] = hash
+	deploy.Spec.Template = template
+}
@@ -0,0 +1,126 @@
+package controllers
+
+import (
+	"fmt"
+	"strings"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// quorum returns the number of voting members needed to commit a write.
+func quorum(members int) int {
+	return members/2 + 1
+}
+
+// setCondition sets a condition on the cluster, stamping it with the observed generation.
+func setCondition(cluster *etcdv1alpha1.EtcdCluster, conditionType string, status metav1.ConditionStatus, reason, message string) {
+	meta.SetStatusCondition(&cluster.Status.Conditions, metav1.Condition{
+		Type:               conditionType,
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		ObservedGeneration: cluster.Generation,
+	})
+}
+
+// applyConditions derives the standard conditions from the observed etcd state and the StatefulSet.
+// A nil state means the cluster could not be reached, in which case reachErr explains why.
+func applyConditions(cluster *etcdv1alpha1.EtcdCluster, sts *appsv1.StatefulSet, state *clusterState, reachErr error) {
+	applyAvailable(cluster, state, reachErr)
+	applyProgressing(cluster, sts, state)
+	applyDegraded(cluster, state, reachErr)
+	applyQuorumAtRisk(cluster, state)
+}
+
+func applyAvailable(cluster *etcdv1alpha1.EtcdCluster, state *clusterState, reachErr error) {
+	switch {
+	case state == nil:
+		setCondition(cluster, etcdv1alpha1.ConditionAvailable, metav1.ConditionFalse, etcdv1alpha1.ReasonUnreachable,
+			fmt.Sprintf("cannot reach the etcd cluster: %v", reachErr))
+	case state.healthyVoterCount() < quorum(state.voterCount()):
+		setCondition(cluster, etcdv1alpha1.ConditionAvailable, metav1.ConditionFalse, etcdv1alpha1.ReasonQuorumLost,
+			fmt.Sprintf("%d of %d voting members are healthy, %d needed for quorum", state.healthyVoterCount(), state.voterCount(), quorum(state.voterCount())))
+	case state.leaderID == 0:
+		setCondition(cluster, etcdv1alpha1.ConditionAvailable, metav1.ConditionFalse, etcdv1alpha1.ReasonNoLeader,
+			"no member reports a raft leader")
+	default:
+		setCondition(cluster, etcdv1alpha1.ConditionAvailable, metav1.ConditionTrue, etcdv1alpha1.ReasonQuorumHealthy,
+			fmt.Sprintf("%d of %d members are healthy, leader is %s", state.healthyCount(), len(state.members), state.leaderName()))
+	}
+}
+
+func applyProgressing(cluster *etcdv1alpha1.EtcdCluster, sts *appsv1.StatefulSet, state *clusterState) {
+	size := *cluster.Spec.Size
+	switch {
+	case state == nil || len(state.members) != int(size) || sts.Status.ReadyReplicas != size:
+		members := 0
+		if state != nil {
+			members = len(state.members)
+		}
+		setCondition(cluster, etcdv1alpha1.ConditionProgressing, metav1.ConditionTrue, etcdv1alpha1.ReasonScaling,
+			fmt.Sprintf("%d members and %d ready pods, want %d", members, sts.Status.ReadyReplicas, size))
+	case len(state.learners()) > 0:
+		var learners []string
+		for _, m := range state.learners() {
+			if lag, ok := state.memberLag(m); ok {
+				learners = append(learners, fmt.Sprintf("%s is %d entries behind the leader", m.Name, lag))
+			} else {
+				learners = append(learners, fmt.Sprintf("%x has not reported its progress", m.ID))
+			}
+		}
+		setCondition(cluster, etcdv1alpha1.ConditionProgressing, metav1.ConditionTrue, etcdv1alpha1.ReasonLearnerCatchingUp,
+			"waiting for learners to catch up: "+strings.Join(learners, ", "))
+	case sts.Status.UpdateRevision != "" && sts.Status.CurrentRevision != sts.Status.UpdateRevision &&
+		sts.Status.UpdatedReplicas < sts.Status.Replicas:
+		setCondition(cluster, etcdv1alpha1.ConditionProgressing, metav1.ConditionTrue, etcdv1alpha1.ReasonRollingUpdate,
+			fmt.Sprintf("%d of %d pods run the current template", sts.Status.UpdatedReplicas, size))
+	default:
+		setCondition(cluster, etcdv1alpha1.ConditionProgressing, metav1.ConditionFalse, etcdv1alpha1.ReasonReconciled,
+			"cluster matches the desired state")
+	}
+}
+
+func applyDegraded(cluster *etcdv1alpha1.EtcdCluster, state *clusterState, reachErr error) {
+	if state == nil {
+		setCondition(cluster, etcdv1alpha1.ConditionDegraded, metav1.ConditionTrue, etcdv1alpha1.ReasonUnreachable,
+			fmt.Sprintf("cannot reach the etcd cluster: %v", reachErr))
+		return
+	}
+	var unhealthy []string
+	for _, m := range state.members {
+		if reason, ok := state.errors[m.ID]; ok {
+			name := m.Name
+			if name == "" {
+				name = fmt.Sprintf("%x", m.ID)
+			}
+			unhealthy = append(unhealthy, fmt.Sprintf("%s (%s)", name, reason))
+		}
+	}
+	if len(unhealthy) > 0 {
+		setCondition(cluster, etcdv1alpha1.ConditionDegraded, metav1.ConditionTrue, etcdv1alpha1.ReasonMembersUnhealthy,
+			"unhealthy members: "+strings.Join(unhealthy, ", "))
+		return
+	}
+	setCondition(cluster, etcdv1alpha1.ConditionDegraded, metav1.ConditionFalse, etcdv1alpha1.ReasonMembersHealthy,
+		"all members are healthy")
+}
+
+func applyQuorumAtRisk(cluster *etcdv1alpha1.EtcdCluster, state *clusterState) {
+	if state == nil {
+		setCondition(cluster, etcdv1alpha1.ConditionQuorumAtRisk, metav1.ConditionUnknown, etcdv1alpha1.ReasonUnreachable,
+			"cannot reach the etcd cluster")
+		return
+	}
+	// 再失去一个成员就会丢失 quorum
+	spare := state.healthyVoterCount() - quorum(state.voterCount())
+	if spare < 1 {
+		setCondition(cluster, etcdv1alpha1.ConditionQuorumAtRisk, metav1.ConditionTrue, etcdv1alpha1.ReasonNoFaultTolerance,
+			fmt.Sprintf("%d healthy voting members, losing one more leaves fewer than the %d needed for quorum", state.healthyVoterCount(), quorum(state.voterCount())))
+		return
+	}
+	setCondition(cluster, etcdv1alpha1.ConditionQuorumAtRisk, metav1.ConditionFalse, etcdv1alpha1.ReasonFaultTolerant,
+		fmt.Sprintf("the cluster tolerates the loss of %d more members", spare))
+}
@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/coreos/go-semver/semver"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+)
+
+// downgradeAPIVersion is the first etcd version that can lower its cluster version.
+var downgradeAPIVersion = semver.Version{Major: 3, Minor: 5}
+
+// minorDowngrade reports whether going from one version to another lowers the cluster
+// version, which members on the older version need to join.
+func minorDowngrade(from, to *semver.Version) bool {
+	return to.Major == from.Major && to.Minor < from.Minor
+}
+
+// enableDowngrade validates and enables a downgrade of the cluster to version. etcd
+// lowers the cluster version right away and ends the downgrade by itself once every
+// member runs the older version.
+func (r *EtcdClusterReconciler) enableDowngrade(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, state *clusterState, version string) error {
+	err := r.downgrade(ctx, cluster, state, etcdserverpb.DowngradeRequest_VALIDATE, version)
+	if rpctypes.Error(err) == rpctypes.ErrDowngradeInProcess {
+		// 上一轮已经开启了，只是状态没有写回去
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("validate downgrade to %s: %w", version, err)
+	}
+	if err := r.downgrade(ctx, cluster, state, etcdserverpb.DowngradeRequest_ENABLE, version); err != nil {
+		return fmt.Errorf("enable downgrade to %s: %w", version, err)
+	}
+	return nil
+}
+
+// cancelDowngrade cancels the downgrade of the cluster. A downgrade that etcd already
+// ended is not an error.
+func (r *EtcdClusterReconciler) cancelDowngrade(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, state *clusterState) error {
+	err := r.downgrade(ctx, cluster, state, etcdserverpb.DowngradeRequest_CANCEL, "")
+	if err != nil && rpctypes.Error(err) != rpctypes.ErrNoInflightDowngrade {
+		return fmt.Errorf("cancel downgrade: %w", err)
+	}
+	return nil
+}
+
+// downgrade sends a downgrade request to the healthy members. The client of etcd 3.5
+// does not wrap the call, so it goes through the generated maintenance client.
+func (r *EtcdClusterReconciler) downgrade(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, state *clusterState,
+	action etcdserverpb.DowngradeRequest_DowngradeAction, version string) error {
+	var endpoints []string
+	for _, m := range state.members {
+		if _, ok := state.statuses[m.ID]; ok && len(m.ClientURLs) > 0 {
+			endpoints = append(endpoints, m.ClientURLs[0])
+		}
+	}
+	if len(endpoints) == 0 {
+		return fmt.Errorf("no healthy member to send the request to")
+	}
+	cli, err := r.newClusterClient(ctx, cluster, endpoints)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	reqCtx, cancel := withEtcdTimeout(ctx)
+	defer cancel()
+	_, err = etcdserverpb.NewMaintenanceClient(cli.ActiveConnection()).Downgrade(reqCtx,
+		&etcdserverpb.DowngradeRequest{Action: action, Version: version})
+	return err
+}
@@ -0,0 +1,77 @@
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+)
+
+const (
+	etcdDialTimeout    = 5 * time.Second
+	etcdRequestTimeout = 5 * time.Second
+)
+
+// memberName returns the name of the pod, and therefore of the etcd member, with the given ordinal.
+func memberName(cluster *etcdv1alpha1.EtcdCluster, ordinal int) string {
+	return fmt.Sprintf("%s-%d", cluster.Name, ordinal)
+}
+
+// memberHost returns the stable DNS name the headless service gives to a member.
+func memberHost(cluster *etcdv1alpha1.EtcdCluster, name string) string {
+	return fmt.Sprintf("%s.%s.%s.svc.cluster.local", name, cluster.Name, cluster.Namespace)
+}
+
+func memberClientURL(cluster *etcdv1alpha1.EtcdCluster, name string) string {
+	return fmt.Sprintf("%s://%s:2379", urlScheme(cluster), memberHost(cluster, name))
+}
+
+func memberPeerURL(cluster *etcdv1alpha1.EtcdCluster, name string) string {
+	return fmt.Sprintf("%s://%s:2380", urlScheme(cluster), memberHost(cluster, name))
+}
+
+func urlScheme(cluster *etcdv1alpha1.EtcdCluster) string {
+	if cluster.Spec.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// clientEndpoints returns the client URLs of the first replicas members.
+func clientEndpoints(cluster *etcdv1alpha1.EtcdCluster, replicas int32) []string {
+	endpoints := make([]string, 0, replicas)
+	for i := 0; i < int(replicas); i++ {
+		endpoints = append(endpoints, memberClientURL(cluster, memberName(cluster, i)))
+	}
+	return endpoints
+}
+
+// newEtcdClient dials the given endpoints. tlsConfig is nil for clusters without TLS.
+// The caller must close the client.
+func newEtcdClient(endpoints []string, tlsConfig *tls.Config) (*clientv3.Client, error) {
+	return clientv3.New(clientv3.Config{
+		Endpoints:   endpoints,
+		DialTimeout: etcdDialTimeout,
+		TLS:         tlsConfig,
+		// the grpc client logs every failed dial, which is expected while members start
+		Logger: zap.NewNop(),
+	})
+}
+
+// newClusterClient dials the given endpoints of a cluster with the operator's client certificate.
+func (r *EtcdClusterReconciler) newClusterClient(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, endpoints []string) (*clientv3.Client, error) {
+	tlsConfig, err := r.clientTLSConfig(ctx, cluster)
+	if err != nil {
+		return nil, err
+	}
+	return newEtcdClient(endpoints, tlsConfig)
+}
+
+// withEtcdTimeout bounds a single etcd request.
+func withEtcdTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, etcdRequestTimeout)
+}
@@ -0,0 +1,392 @@
+/*
+Copyright 2023 fpf.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	"github.com/gqq/etcd-operator/pkg/backup"
+)
+
+// EtcdBackupReconciler reconciles a EtcdBackup object
+type EtcdBackupReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// AgentImage is the image of the Jobs that take the snapshots, normally the image of the operator itself.
+	AgentImage string
+}
+
+const (
+	// backupPendingRequeuePeriod is how often a backup waiting for its cluster is looked at again.
+	backupPendingRequeuePeriod = 15 * time.Second
+
+	// SnapshotCleanupFinalizer keeps an EtcdBackup with the Delete policy around until its snapshot is deleted.
+	SnapshotCleanupFinalizer = "etcd.gqq.com/snapshot-cleanup"
+)
+
+//+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdbackups,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdbackups/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdbackups/finalizers,verbs=update
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile takes one snapshot per EtcdBackup. The snapshot is streamed from a healthy
+// member by an agent Job, which reports the size, revision and checksum back, or taken
+// as a VolumeSnapshot of a stopped member's volume.
+func (r *EtcdBackupReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	backuplog := log.FromContext(ctx).WithValues("etcdbackup", req.NamespacedName)
+
+	var etcdbackup etcdv1alpha1.EtcdBackup
+	if err := r.Get(ctx, req.NamespacedName, &etcdbackup); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	// 正在进行的快照先等它结束，再按删除策略清理
+	if !etcdbackup.DeletionTimestamp.IsZero() && etcdbackup.Status.Phase != etcdv1alpha1.BackupPhaseRunning {
+		return ctrl.Result{}, r.deleteSnapshot(ctx, &etcdbackup)
+	}
+	if etcdbackup.Spec.DeletionPolicy == etcdv1alpha1.BackupDeletionDelete &&
+		!controllerutil.ContainsFinalizer(&etcdbackup, SnapshotCleanupFinalizer) {
+		controllerutil.AddFinalizer(&etcdbackup, SnapshotCleanupFinalizer)
+		return ctrl.Result{}, r.Update(ctx, &etcdbackup)
+	}
+	// 换了密钥的快照要重新加密
+	if etcdbackup.Status.Phase == etcdv1alpha1.BackupPhaseCompleted && needsRekey(&etcdbackup) {
+		return ctrl.Result{}, r.rekeySnapshot(ctx, &etcdbackup)
+	}
+	// 备份只做一次，结束之后不再处理
+	if etcdbackup.Status.Phase == etcdv1alpha1.BackupPhaseCompleted || etcdbackup.Status.Phase == etcdv1alpha1.BackupPhaseFailed {
+		return ctrl.Result{}, nil
+	}
+	patch := client.MergeFrom(etcdbackup.DeepCopy())
+
+	var result ctrl.Result
+	var job batchv1.Job
+	var err error
+	if etcdbackup.Spec.Destination.VolumeSnapshot == nil {
+		err = r.Get(ctx, types.NamespacedName{Namespace: etcdbackup.Namespace, Name: backupJobName(&etcdbackup)}, &job)
+	}
+	switch {
+	case etcdbackup.Spec.Destination.VolumeSnapshot != nil:
+		result, err = r.reconcileVolumeSnapshot(ctx, &etcdbackup)
+	case apierrors.IsNotFound(err) && !etcdbackup.DeletionTimestamp.IsZero():
+		r.failBackup(&etcdbackup, fmt.Sprintf("job %s was deleted", backupJobName(&etcdbackup)))
+		err = nil
+	case apierrors.IsNotFound(err):
+		result, err = r.startBackup(ctx, &etcdbackup)
+	case err == nil:
+		err = r.observeBackupJob(ctx, &etcdbackup, &job)
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.Status().Patch(ctx, &etcdbackup, patch); err != nil {
+		return ctrl.Result{}, err
+	}
+	backuplog.Info("backup reconciled", "phase", etcdbackup.Status.Phase)
+	return result, nil
+}
+
+// startBackup creates the Job that takes the snapshot once the cluster has a healthy member.
+func (r *EtcdBackupReconciler) startBackup(ctx context.Context, etcdbackup *etcdv1alpha1.EtcdBackup) (ctrl.Result, error) {
+	if err := validateWritableDestination(&etcdbackup.Spec.Destination); err != nil {
+		r.failBackup(etcdbackup, err.Error())
+		return ctrl.Result{}, nil
+	}
+	var cluster etcdv1alpha1.EtcdCluster
+	err := r.Get(ctx, types.NamespacedName{Namespace: etcdbackup.Namespace, Name: etcdbackup.Spec.ClusterName}, &cluster)
+	if apierrors.IsNotFound(err) {
+		etcdbackup.Status.Phase = etcdv1alpha1.BackupPhasePending
+		etcdbackup.Status.Message = fmt.Sprintf("EtcdCluster %s not found", etcdbackup.Spec.ClusterName)
+		return ctrl.Result{RequeueAfter: backupPendingRequeuePeriod}, nil
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if r.AgentImage == "" {
+		etcdbackup.Status.Phase = etcdv1alpha1.BackupPhasePending
+		etcdbackup.Status.Message = "the operator was started without --agent-image"
+		return ctrl.Result{RequeueAfter: backupPendingRequeuePeriod}, nil
+	}
+	member := snapshotMember(&cluster)
+	if member == "" {
+		etcdbackup.Status.Phase = etcdv1alpha1.BackupPhasePending
+		etcdbackup.Status.Message = "waiting for a healthy member"
+		return ctrl.Result{RequeueAfter: backupPendingRequeuePeriod}, nil
+	}
+
+	path := backupPath(etcdbackup)
+	job := newAgentJob(etcdbackup.Namespace, backupJobName(etcdbackup), r.AgentImage,
+		map[string]string{EtcdClusterLabelKey: cluster.Name}, nil)
+	args := []string{"backup", "--path", path, "--scratch-dir", agentScratchDir}
+	args = append(args, agentEtcdArgs(&job.Spec.Template.Spec, &cluster, member, clientSecretName(&cluster))...)
+	args = append(args, agentStorageArgs(&job.Spec.Template.Spec, &etcdbackup.Spec.Destination)...)
+	job.Spec.Template.Spec.Containers[0].Command = append(job.Spec.Template.Spec.Containers[0].Command, args...)
+	if err := controllerutil.SetControllerReference(etcdbackup, job, r.Scheme); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.Create(ctx, job); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	now := metav1.Now()
+	etcdbackup.Status.Phase = etcdv1alpha1.BackupPhaseRunning
+	etcdbackup.Status.Member = member
+	etcdbackup.Status.Path = path
+	etcdbackup.Status.StartTime = &now
+	etcdbackup.Status.Message = ""
+	r.Recorder.Eventf(etcdbackup, corev1.EventTypeNormal, "BackupStarted", "taking a snapshot of %s from member %s", cluster.Name, member)
+	return ctrl.Result{}, nil
+}
+
+// observeBackupJob copies the result of a finished Job into the status.
+func (r *EtcdBackupReconciler) observeBackupJob(ctx context.Context, etcdbackup *etcdv1alpha1.EtcdBackup, job *batchv1.Job) error {
+	finished, failed := jobFinished(job)
+	if !finished {
+		return nil
+	}
+	if failed {
+		msg, err := agentMessage(ctx, r.Client, job, corev1.PodFailed)
+		if err != nil {
+			msg = fmt.Sprintf("job %s failed", job.Name)
+		}
+		r.failBackup(etcdbackup, msg)
+		return nil
+	}
+	var res backup.Result
+	if err := agentResult(ctx, r.Client, job, &res); err != nil {
+		return err
+	}
+	now := metav1.Now()
+	etcdbackup.Status.Phase = etcdv1alpha1.BackupPhaseCompleted
+	etcdbackup.Status.Path = res.Path
+	etcdbackup.Status.Size = res.Size
+	etcdbackup.Status.Revision = res.Revision
+	etcdbackup.Status.SHA256 = res.SHA256
+	etcdbackup.Status.Keys = res.Keys
+	etcdbackup.Status.KeyID = res.KeyID
+	etcdbackup.Status.CompletionTime = &now
+	etcdbackup.Status.Message = ""
+	r.Recorder.Eventf(etcdbackup, corev1.EventTypeNormal, "BackupCompleted", "stored snapshot at revision %d, %d bytes", res.Revision, res.Size)
+	return nil
+}
+
+// deleteSnapshot deletes the snapshot of a backup with the Delete policy from its
+// destination and then lets the EtcdBackup go.
+func (r *EtcdBackupReconciler) deleteSnapshot(ctx context.Context, etcdbackup *etcdv1alpha1.EtcdBackup) error {
+	if !controllerutil.ContainsFinalizer(etcdbackup, SnapshotCleanupFinalizer) {
+		return nil
+	}
+	if etcdbackup.Status.Phase == etcdv1alpha1.BackupPhaseCompleted && etcdbackup.Spec.Destination.VolumeSnapshot != nil {
+		if err := r.deleteVolumeSnapshot(ctx, etcdbackup); err != nil {
+			return err
+		}
+	} else if etcdbackup.Status.Phase == etcdv1alpha1.BackupPhaseCompleted && etcdbackup.Status.Path != "" {
+		var job batchv1.Job
+		err := r.Get(ctx, types.NamespacedName{Namespace: etcdbackup.Namespace, Name: cleanupJobName(etcdbackup)}, &job)
+		if apierrors.IsNotFound(err) {
+			if r.AgentImage == "" {
+				return fmt.Errorf("cannot delete snapshot %s: the operator was started without --agent-image", etcdbackup.Status.Path)
+			}
+			job := newAgentJob(etcdbackup.Namespace, cleanupJobName(etcdbackup), r.AgentImage,
+				map[string]string{EtcdClusterLabelKey: etcdbackup.Spec.ClusterName}, nil)
+			args := append([]string{"delete", "--path", etcdbackup.Status.Path},
+				agentLocationArgs(&job.Spec.Template.Spec, &etcdbackup.Spec.Destination)...)
+			job.Spec.Template.Spec.Containers[0].Command = append(job.Spec.Template.Spec.Containers[0].Command, args...)
+			if err := controllerutil.SetControllerReference(etcdbackup, job, r.Scheme); err != nil {
+				return err
+			}
+			return r.Create(ctx, job)
+		}
+		if err != nil {
+			return err
+		}
+		finished, failed := jobFinished(&job)
+		if !finished {
+			return nil
+		}
+		if failed {
+			// 删除失败不能一直卡住 EtcdBackup 的删除
+			r.Recorder.Eventf(etcdbackup, corev1.EventTypeWarning, "SnapshotCleanupFailed",
+				"could not delete snapshot %s, it has to be removed by hand", etcdbackup.Status.Path)
+		}
+	}
+	controllerutil.RemoveFinalizer(etcdbackup, SnapshotCleanupFinalizer)
+	return r.Update(ctx, etcdbackup)
+}
+
+// needsRekey reports whether the snapshot is not encrypted with the key the spec asks for.
+func needsRekey(etcdbackup *etcdv1alpha1.EtcdBackup) bool {
+	enc := etcdbackup.Spec.Destination.Encryption
+	return enc != nil && enc.KeyID != "" && enc.KeyID != etcdbackup.Status.KeyID && etcdbackup.Status.Path != ""
+}
+
+// rekeySnapshot re-encrypts the snapshot of a completed backup with the key the spec
+// asks for, through an agent Job per pair of old and new key. A failed Job is left in
+// place, so that deleting it retries. A finished Job is deleted, and only trusted when
+// its result names keyID.
+func (r *EtcdBackupReconciler) rekeySnapshot(ctx context.Context, etcdbackup *etcdv1alpha1.EtcdBackup) error {
+	keyID := etcdbackup.Spec.Destination.Encryption.KeyID
+	name := rekeyJobName(etcdbackup, keyID)
+	var job batchv1.Job
+	err := r.Get(ctx, types.NamespacedName{Namespace: etcdbackup.Namespace, Name: name}, &job)
+	if apierrors.IsNotFound(err) {
+		if r.AgentImage == "" {
+			return fmt.Errorf("cannot re-key snapshot %s: the operator was started without --agent-image", etcdbackup.Status.Path)
+		}
+		job := newAgentJob(etcdbackup.Namespace, name, r.AgentImage,
+			map[string]string{EtcdClusterLabelKey: etcdbackup.Spec.ClusterName}, nil)
+		args := []string{"rekey", "--path", etcdbackup.Status.Path, "--scratch-dir", agentScratchDir}
+		if etcdbackup.Status.SHA256 != "" {
+			args = append(args, "--sha256", etcdbackup.Status.SHA256)
+		}
+		args = append(args, agentStorageArgs(&job.Spec.Template.Spec, &etcdbackup.Spec.Destination)...)
+		job.Spec.Template.Spec.Containers[0].Command = append(job.Spec.Template.Spec.Containers[0].Command, args...)
+		if err := controllerutil.SetControllerReference(etcdbackup, job, r.Scheme); err != nil {
+			return err
+		}
+		if err := r.Create(ctx, job); err != nil {
+			return err
+		}
+		r.Recorder.Eventf(etcdbackup, corev1.EventTypeNormal, "RekeyStarted", "re-encrypting snapshot %s with key %s", etcdbackup.Status.Path, keyID)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	finished, failed := jobFinished(&job)
+	if !finished {
+		return nil
+	}
+	patch := client.MergeFrom(etcdbackup.DeepCopy())
+	if failed {
+		msg, err := agentMessage(ctx, r.Client, &job, corev1.PodFailed)
+		if err != nil {
+			msg = fmt.Sprintf("job %s failed", job.Name)
+		}
+		msg = fmt.Sprintf("re-keying failed, delete job %s to retry: %s", job.Name, msg)
+		if etcdbackup.Status.Message == msg {
+			return nil
+		}
+		etcdbackup.Status.Message = msg
+		r.Recorder.Event(etcdbackup, corev1.EventTypeWarning, "RekeyFailed", msg)
+		return r.Status().Patch(ctx, etcdbackup, patch)
+	}
+	// 只相信结果里写明是这把 key 的 Job，结果记下之前先删掉 Job，
+	// 以后同样的轮换不会再找到它；删掉后没记下来只会再加密一次
+	var res backup.Result
+	resErr := agentResult(ctx, r.Client, &job, &res)
+	if err := r.Delete(ctx, &job, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+		return err
+	}
+	if resErr != nil || res.KeyID != keyID || res.Path != etcdbackup.Status.Path {
+		log.FromContext(ctx).Info("discarding re-key job without a matching result", "job", job.Name, "keyID", res.KeyID, "error", resErr)
+		return nil
+	}
+	etcdbackup.Status.KeyID = keyID
+	etcdbackup.Status.Message = ""
+	r.Recorder.Eventf(etcdbackup, corev1.EventTypeNormal, "RekeyCompleted", "snapshot %s is encrypted with key %s", etcdbackup.Status.Path, keyID)
+	return r.Status().Patch(ctx, etcdbackup, patch)
+}
+
+func (r *EtcdBackupReconciler) failBackup(etcdbackup *etcdv1alpha1.EtcdBackup, msg string) {
+	now := metav1.Now()
+	etcdbackup.Status.CompletionTime = &now
+	etcdbackup.Status.Phase = etcdv1alpha1.BackupPhaseFailed
+	etcdbackup.Status.Message = msg
+	r.Recorder.Event(etcdbackup, corev1.EventTypeWarning, "BackupFailed", msg)
+}
+
+func cleanupJobName(etcdbackup *etcdv1alpha1.EtcdBackup) string {
+	return etcdbackup.Name + "-cleanup"
+}
+
+func backupJobName(etcdbackup *etcdv1alpha1.EtcdBackup) string {
+	return etcdbackup.Name + "-backup"
+}
+
+// rekeyJobName is unique per change from the key the snapshot is encrypted with to
+// keyID, key IDs themselves may not be valid in a name.
+func rekeyJobName(etcdbackup *etcdv1alpha1.EtcdBackup, keyID string) string {
+	h := fnv.New32a()
+	h.Write([]byte(etcdbackup.Status.KeyID))
+	h.Write([]byte{0})
+	h.Write([]byte(keyID))
+	return etcdbackup.Name + "-rekey-" + rand.SafeEncodeString(fmt.Sprint(h.Sum32()))
+}
+
+// backupPath returns where in the destination the snapshot is written.
+func backupPath(etcdbackup *etcdv1alpha1.EtcdBackup) string {
+	dest := etcdbackup.Spec.Destination
+	switch {
+	case dest.PVC != nil && dest.PVC.Path != "":
+		return dest.PVC.Path
+	case dest.S3 != nil && dest.S3.Key != "":
+		return dest.S3.Key
+	case dest.S3 != nil:
+		return fmt.Sprintf("%s/%s/%s.db", etcdbackup.Namespace, etcdbackup.Spec.ClusterName, etcdbackup.Name)
+	}
+	return fmt.Sprintf("%s/%s.db", etcdbackup.Spec.ClusterName, etcdbackup.Name)
+}
+
+// snapshotMember picks the member to take a snapshot from: the healthy follower that
+// applied the most raft entries, so that the leader does not have to stream the
+// database as well. A single member cluster falls back to its leader.
+func snapshotMember(cluster *etcdv1alpha1.EtcdCluster) string {
+	var leader, follower string
+	var index uint64
+	for _, m := range cluster.Status.Members {
+		if !m.Healthy || m.IsLearner || m.Name == "" {
+			continue
+		}
+		if m.IsLeader {
+			leader = m.Name
+			continue
+		}
+		if follower == "" || m.RaftIndex > index {
+			follower, index = m.Name, m.RaftIndex
+		}
+	}
+	if follower != "" {
+		return follower
+	}
+	return leader
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *EtcdBackupReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&etcdv1alpha1.EtcdBackup{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
@@ -0,0 +1,93 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRekeySnapshot(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = etcdv1alpha1.AddToScheme(scheme)
+
+	etcdbackup := &etcdv1alpha1.EtcdBackup{
+		ObjectMeta: metav1.ObjectMeta{Name: "etcd-backup", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdBackupSpec{
+			ClusterName: "etcd",
+			Destination: etcdv1alpha1.BackupDestination{
+				PVC:        &etcdv1alpha1.PVCDestination{ClaimName: "backups"},
+				Encryption: &etcdv1alpha1.BackupEncryption{KeySecret: "keys", KeyID: "b"},
+			},
+		},
+		Status: etcdv1alpha1.EtcdBackupStatus{Phase: etcdv1alpha1.BackupPhaseCompleted, Path: "etcd-backup.db", KeyID: "a"},
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(etcdbackup.DeepCopy()).Build()
+	r := &EtcdBackupReconciler{Client: c, Scheme: scheme, Recorder: record.NewFakeRecorder(10), AgentImage: "agent"}
+
+	back := etcdbackup.DeepCopy()
+	back.Status.KeyID, back.Spec.Destination.Encryption.KeyID = "b", "a"
+	if rekeyJobName(etcdbackup, "b") == rekeyJobName(back, "a") {
+		t.Fatal("re-keying back and forth uses the same job")
+	}
+
+	finish := func(result string) {
+		t.Helper()
+		job := &batchv1.Job{}
+		job.Namespace, job.Name = "default", rekeyJobName(etcdbackup, "b")
+		job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+		if err := c.Create(ctx, job); err != nil {
+			t.Fatal(err)
+		}
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: job.Name + "-abc", Namespace: "default",
+			Labels: map[string]string{"job-name": job.Name}}}
+		pod.Status.Phase = corev1.PodSucceeded
+		pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: agentContainerName,
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: result}}}}
+		if err := c.Create(ctx, pod); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.rekeySnapshot(ctx, etcdbackup); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(job), job); err == nil {
+			t.Fatalf("finished job %s was not deleted", job.Name)
+		}
+		if err := c.Delete(ctx, pod); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 之前轮换留下的 Job，结果是另一把 key
+	finish(`{"path":"etcd-backup.db","keyID":"a"}`)
+	if etcdbackup.Status.KeyID != "a" {
+		t.Fatalf("a job re-keying with another key set the key to %s", etcdbackup.Status.KeyID)
+	}
+
+	if err := r.rekeySnapshot(ctx, etcdbackup); err != nil {
+		t.Fatal(err)
+	}
+	var job batchv1.Job
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "default", Name: rekeyJobName(etcdbackup, "b")}, &job); err != nil {
+		t.Fatalf("re-key job was not created: %v", err)
+	}
+	if err := c.Delete(ctx, &job); err != nil {
+		t.Fatal(err)
+	}
+
+	finish(`{"path":"etcd-backup.db","keyID":"b"}`)
+	if etcdbackup.Status.KeyID != "b" {
+		t.Fatalf("snapshot key is %s, want b", etcdbackup.Status.KeyID)
+	}
+}
@@ -0,0 +1,294 @@
+/*
+Copyright 2023 fpf.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+)
+
+// BackupScheduleLabelKey is set on every EtcdBackup a schedule creates. The backups are
+// deliberately not owned by the schedule, so deleting a schedule keeps its snapshots.
+var BackupScheduleLabelKey = "etcd.gqq.com/backup-schedule"
+
+// EtcdBackupScheduleReconciler reconciles a EtcdBackupSchedule object
+type EtcdBackupScheduleReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdbackupschedules,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdbackupschedules/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdbackupschedules/finalizers,verbs=update
+
+// Reconcile creates an EtcdBackup whenever the schedule is due and prunes the
+// snapshots that fall out of the retention policy.
+func (r *EtcdBackupScheduleReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	schedulelog := log.FromContext(ctx).WithValues("etcdbackupschedule", req.NamespacedName)
+
+	var schedule etcdv1alpha1.EtcdBackupSchedule
+	if err := r.Get(ctx, req.NamespacedName, &schedule); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	patch := client.MergeFrom(schedule.DeepCopy())
+	now := time.Now()
+
+	var backups etcdv1alpha1.EtcdBackupList
+	if err := r.List(ctx, &backups, client.InNamespace(schedule.Namespace),
+		client.MatchingLabels{BackupScheduleLabelKey: schedule.Name}); err != nil {
+		return ctrl.Result{}, err
+	}
+	active := observeScheduledBackups(&schedule, backups.Items)
+	expiry, err := r.pruneBackups(ctx, &schedule, backups.Items, now)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.propagateEncryption(ctx, &schedule, backups.Items); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	var result ctrl.Result
+	if err := validateWritableDestination(&schedule.Spec.Destination); err != nil {
+		schedule.Status.Message = err.Error()
+	} else if sched, err := cron.ParseStandard(schedule.Spec.Schedule); err != nil {
+		schedule.Status.Message = fmt.Sprintf("invalid schedule %q: %v", schedule.Spec.Schedule, err)
+	} else if schedule.Spec.Suspend {
+		schedule.Status.Message = "suspended"
+	} else {
+		schedule.Status.Message = ""
+		missed, next := scheduledTimes(sched, &schedule, now)
+		if !missed.IsZero() {
+			if active != "" {
+				// 上一个备份还没结束，跳过这一次
+				r.Recorder.Eventf(&schedule, corev1.EventTypeWarning, "BackupSkipped",
+					"skipped the snapshot scheduled at %s, %s is still running", missed.Format(time.RFC3339), active)
+			} else if err := r.createScheduledBackup(ctx, &schedule, missed); err != nil {
+				return ctrl.Result{}, err
+			}
+			schedule.Status.LastScheduleTime = &metav1.Time{Time: missed}
+		}
+		result.RequeueAfter = next.Sub(now)
+		schedulelog.Info("next snapshot scheduled", "time", next)
+	}
+	// 暂停或者配置错误的时候也要按时清理过期的备份
+	if !expiry.IsZero() && (result.RequeueAfter == 0 || expiry.Sub(now) < result.RequeueAfter) {
+		result.RequeueAfter = expiry.Sub(now)
+	}
+
+	if err := r.Status().Patch(ctx, &schedule, patch); err != nil {
+		return ctrl.Result{}, err
+	}
+	return result, nil
+}
+
+// scheduledTimes returns the latest run that is due but was not started yet, or the
+// zero time, and the next run after now. Runs missed while the operator was down are
+// collapsed into the latest one.
+func scheduledTimes(sched cron.Schedule, schedule *etcdv1alpha1.EtcdBackupSchedule, now time.Time) (time.Time, time.Time) {
+	return cronTimes(sched, schedule.CreationTimestamp.Time, schedule.Status.LastScheduleTime, now)
+}
+
+// cronTimes is scheduledTimes for anything that runs on a schedule since it was created.
+func cronTimes(sched cron.Schedule, created time.Time, lastScheduled *metav1.Time, now time.Time) (time.Time, time.Time) {
+	earliest := created
+	if lastScheduled != nil {
+		earliest = lastScheduled.Time
+	}
+	var missed time.Time
+	for t := sched.Next(earliest); !t.After(now); t = sched.Next(t) {
+		missed = t
+	}
+	return missed, sched.Next(now)
+}
+
+// observeScheduledBackups records the latest success and failure in the status and
+// returns the name of a backup that has not finished yet.
+func observeScheduledBackups(schedule *etcdv1alpha1.EtcdBackupSchedule, backups []etcdv1alpha1.EtcdBackup) string {
+	var active string
+	status := &schedule.Status
+	for i := range backups {
+		b := &backups[i]
+		switch b.Status.Phase {
+		case etcdv1alpha1.BackupPhaseCompleted:
+			if b.Status.CompletionTime != nil && (status.LastSuccessfulTime == nil || status.LastSuccessfulTime.Before(b.Status.CompletionTime)) {
+				status.LastSuccessfulTime = b.Status.CompletionTime
+			}
+		case etcdv1alpha1.BackupPhaseFailed:
+			if b.Status.CompletionTime != nil && (status.LastFailureTime == nil || status.LastFailureTime.Before(b.Status.CompletionTime)) {
+				status.LastFailureTime = b.Status.CompletionTime
+				status.LastFailureMessage = b.Status.Message
+			}
+		default:
+			if b.DeletionTimestamp.IsZero() {
+				active = b.Name
+			}
+		}
+	}
+	return active
+}
+
+// pruneBackups deletes the completed backups beyond the retention policy, and the
+// failed ones older than the latest completed backup. Their snapshots go with them
+// because scheduled backups use the Delete policy. It returns when the oldest backup
+// that is kept passes the maximum age, or the zero time.
+func (r *EtcdBackupScheduleReconciler) pruneBackups(ctx context.Context, schedule *etcdv1alpha1.EtcdBackupSchedule,
+	backups []etcdv1alpha1.EtcdBackup, now time.Time) (time.Time, error) {
+	var completed []*etcdv1alpha1.EtcdBackup
+	var failed []*etcdv1alpha1.EtcdBackup
+	for i := range backups {
+		b := &backups[i]
+		if !b.DeletionTimestamp.IsZero() || b.Status.CompletionTime == nil {
+			continue
+		}
+		switch b.Status.Phase {
+		case etcdv1alpha1.BackupPhaseCompleted:
+			completed = append(completed, b)
+		case etcdv1alpha1.BackupPhaseFailed:
+			failed = append(failed, b)
+		}
+	}
+	// 最新的排在前面
+	sort.Slice(completed, func(i, j int) bool {
+		return completed[j].Status.CompletionTime.Before(completed[i].Status.CompletionTime)
+	})
+
+	var prune []*etcdv1alpha1.EtcdBackup
+	var expiry time.Time
+	if retention := schedule.Spec.Retention; retention != nil {
+		for i, b := range completed {
+			tooMany := retention.MaxCount != nil && i >= int(*retention.MaxCount)
+			tooOld := retention.MaxAge != nil && now.Sub(b.Status.CompletionTime.Time) > retention.MaxAge.Duration
+			if tooMany || tooOld {
+				prune = append(prune, b)
+			} else if retention.MaxAge != nil {
+				// 越往后越旧，最后一个留下来的最先过期，超过 MaxAge 才会被清理
+				expiry = b.Status.CompletionTime.Add(retention.MaxAge.Duration + time.Second)
+			}
+		}
+	}
+	if len(completed) > 0 {
+		for _, b := range failed {
+			if b.Status.CompletionTime.Before(completed[0].Status.CompletionTime) {
+				prune = append(prune, b)
+			}
+		}
+	}
+	for _, b := range prune {
+		if err := r.Delete(ctx, b); client.IgnoreNotFound(err) != nil {
+			return time.Time{}, err
+		}
+		r.Recorder.Eventf(schedule, corev1.EventTypeNormal, "BackupPruned", "pruned backup %s", b.Name)
+	}
+	return expiry, nil
+}
+
+// propagateEncryption moves the completed backups of the schedule to its current
+// encryption key, which makes the backup controller re-encrypt their snapshots.
+func (r *EtcdBackupScheduleReconciler) propagateEncryption(ctx context.Context, schedule *etcdv1alpha1.EtcdBackupSchedule,
+	backups []etcdv1alpha1.EtcdBackup) error {
+	enc := schedule.Spec.Destination.Encryption
+	if enc == nil || enc.KeyID == "" {
+		return nil
+	}
+	for i := range backups {
+		b := &backups[i]
+		if !b.DeletionTimestamp.IsZero() || b.Status.Phase != etcdv1alpha1.BackupPhaseCompleted ||
+			equality.Semantic.DeepEqual(b.Spec.Destination.Encryption, enc) {
+			continue
+		}
+		patch := client.MergeFrom(b.DeepCopy())
+		b.Spec.Destination.Encryption = enc.DeepCopy()
+		// 刚被清理掉的备份不用管
+		if err := r.Patch(ctx, b, patch); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createScheduledBackup creates the EtcdBackup of the run scheduled at t. Its name is
+// derived from t, so a run is never taken twice.
+func (r *EtcdBackupScheduleReconciler) createScheduledBackup(ctx context.Context, schedule *etcdv1alpha1.EtcdBackupSchedule, t time.Time) error {
+	name := fmt.Sprintf("%s-%d", schedule.Name, t.Unix())
+	dest := schedule.Spec.Destination.DeepCopy()
+	if dest.PVC != nil && dest.PVC.Path != "" {
+		dest.PVC.Path = path.Join(dest.PVC.Path, name+".db")
+	}
+	if dest.S3 != nil && dest.S3.Key != "" {
+		dest.S3.Key = path.Join(dest.S3.Key, name+".db")
+	}
+	if dest.VolumeSnapshot != nil {
+		dest.VolumeSnapshot.Name = ""
+	}
+	etcdbackup := &etcdv1alpha1.EtcdBackup{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: schedule.Namespace,
+			Name:      name,
+			Labels: map[string]string{
+				BackupScheduleLabelKey: schedule.Name,
+				EtcdClusterLabelKey:    schedule.Spec.ClusterName,
+			},
+		},
+		Spec: etcdv1alpha1.EtcdBackupSpec{
+			ClusterName:    schedule.Spec.ClusterName,
+			Destination:    *dest,
+			DeletionPolicy: etcdv1alpha1.BackupDeletionDelete,
+		},
+	}
+	if err := r.Create(ctx, etcdbackup); err != nil && !apierrors.IsAlreadyExists(err) {
+		return err
+	}
+	schedule.Status.LastBackup = name
+	r.Recorder.Eventf(schedule, corev1.EventTypeNormal, "BackupCreated", "created backup %s", name)
+	return nil
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *EtcdBackupScheduleReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&etcdv1alpha1.EtcdBackupSchedule{}).
+		Watches(&source.Kind{Type: &etcdv1alpha1.EtcdBackup{}},
+			handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+				name, ok := obj.GetLabels()[BackupScheduleLabelKey]
+				if !ok {
+					return nil
+				}
+				return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}}}
+			})).
+		Complete(r)
+}
@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	"github.com/robfig/cron/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestScheduledTimesCollapsesMissedRuns(t *testing.T) {
+	sched, err := cron.ParseStandard("0 * * * *")
+	if err != nil {
+		t.Fatal(err)
+	}
+	created := time.Date(2023, 1, 1, 0, 30, 0, 0, time.UTC)
+	schedule := &etcdv1alpha1.EtcdBackupSchedule{
+		ObjectMeta: metav1.ObjectMeta{CreationTimestamp: metav1.Time{Time: created}},
+	}
+
+	missed, next := scheduledTimes(sched, schedule, created.Add(10*time.Minute))
+	if !missed.IsZero() {
+		t.Errorf("run missed before the first scheduled time: %s", missed)
+	}
+	if want := time.Date(2023, 1, 1, 1, 0, 0, 0, time.UTC); !next.Equal(want) {
+		t.Errorf("next run %s, want %s", next, want)
+	}
+
+	// the operator was down for three runs, only the latest one is taken
+	missed, _ = scheduledTimes(sched, schedule, time.Date(2023, 1, 1, 3, 15, 0, 0, time.UTC))
+	if want := time.Date(2023, 1, 1, 3, 0, 0, 0, time.UTC); !missed.Equal(want) {
+		t.Errorf("missed run %s, want %s", missed, want)
+	}
+
+	schedule.Status.LastScheduleTime = &metav1.Time{Time: missed}
+	if missed, _ = scheduledTimes(sched, schedule, time.Date(2023, 1, 1, 3, 15, 0, 0, time.UTC)); !missed.IsZero() {
+		t.Errorf("run %s taken twice", missed)
+	}
+}
+
+func TestSuspendedScheduleKeepsPruning(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = etcdv1alpha1.AddToScheme(scheme)
+
+	now := time.Now()
+	schedule := &etcdv1alpha1.EtcdBackupSchedule{
+		ObjectMeta: metav1.ObjectMeta{Name: "nightly", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdBackupScheduleSpec{
+			ClusterName: "etcd",
+			Schedule:    "0 0 * * *",
+			Destination: etcdv1alpha1.BackupDestination{PVC: &etcdv1alpha1.PVCDestination{ClaimName: "backups"}},
+			Retention:   &etcdv1alpha1.BackupRetention{MaxAge: &metav1.Duration{Duration: time.Hour}},
+			Suspend:     true,
+		},
+	}
+	completed := func(name string, age time.Duration) *etcdv1alpha1.EtcdBackup {
+		return &etcdv1alpha1.EtcdBackup{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default",
+				Labels: map[string]string{BackupScheduleLabelKey: "nightly"}},
+			Status: etcdv1alpha1.EtcdBackupStatus{Phase: etcdv1alpha1.BackupPhaseCompleted,
+				CompletionTime: &metav1.Time{Time: now.Add(-age)}},
+		}
+	}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(schedule,
+		completed("old", 2*time.Hour), completed("older", 3*time.Hour),
+		completed("recent", 30*time.Minute), completed("newest", 10*time.Minute)).Build()
+	r := &EtcdBackupScheduleReconciler{Client: c, Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+
+	result, err := r.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(schedule)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var backups etcdv1alpha1.EtcdBackupList
+	if err := c.List(ctx, &backups); err != nil || len(backups.Items) != 2 {
+		t.Fatalf("%d backups left after pruning, want 2: %v", len(backups.Items), err)
+	}
+	// recent 在半小时后过期
+	if result.RequeueAfter < 29*time.Minute || result.RequeueAfter > 31*time.Minute {
+		t.Errorf("suspended schedule requeued after %s, want when recent expires", result.RequeueAfter)
+	}
+}
@@ -18,9 +18,14 @@ package controllers
 
 import (
 	"context"
+	"time"
+
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
@@ -32,7 +37,10 @@ import (
 // EtcdClusterReconciler reconciles a EtcdCluster object
 type EtcdClusterReconciler struct {
 	client.Client
-	Scheme *runtime.Scheme
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// AgentImage is the image of the Jobs that seed the members of restored clusters.
+	AgentImage string
 }
 
 func (r *EtcdClusterReconciler) Schemes() *runtime.Scheme {
@@ -42,6 +50,11 @@ func (r *EtcdClusterReconciler) Schemes() *runtime.Scheme {
 //+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdclusters,verbs=get;list;watch;create;update;patch;delete
 //+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdclusters/status,verbs=get;update;patch
 //+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdclusters/finalizers,verbs=update
+//+kubebuilder:rbac:groups=apps,resources=statefulsets;deployments,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=services;configmaps;secrets,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=core,resources=persistentvolumeclaims,verbs=get;list;watch;create;delete;deletecollection
+//+kubebuilder:rbac:groups=core,resources=pods,verbs=get;list;watch;delete
+//+kubebuilder:rbac:groups=core,resources=events,verbs=create;patch
 
 // Reconcile is part of the main kubernetes reconciliation loop which aims to
 // move the current state of the cluster closer to the desired state.
@@ -67,6 +80,8 @@ func (r *EtcdClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 		return ctrl.Result{}, client.IgnoreNotFound(err)
 	}
 
+	patch := client.MergeFrom(etcdcluster.DeepCopy())
+
 	// 一斤获取到etcdcluster 实例
 	// 创建或者更新 statefulset 以及service 对象
 	// CreateOrUpdate
@@ -86,6 +101,37 @@ func (r *EtcdClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	}
 	clusetrlog.Info("Create Or Update Result", "service", or)
 
+	// 证书和每个成员的启动配置都要在创建 pod 之前准备好
+	if err := r.reconcileCertificates(ctx, &etcdcluster); err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.ensureMemberConfigs(ctx, &etcdcluster); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// 新集群直接运行 spec.version，已有集群的版本由升级流程决定
+	if etcdcluster.Spec.Version != "" && etcdcluster.Status.Version == "" {
+		sts, err := r.getStatefulSet(ctx, &etcdcluster)
+		if err != nil {
+			return ctrl.Result{}, err
+		}
+		if sts == nil {
+			etcdcluster.Status.Version = specVersion(&etcdcluster)
+		}
+	}
+
+	// 从快照启动的集群，先把每个成员的数据目录准备好再创建 statefulset
+	ready, result, err := r.bootstrap(ctx, &etcdcluster)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if !ready {
+		if err := r.Status().Patch(ctx, &etcdcluster, patch); err != nil {
+			return ctrl.Result{}, err
+		}
+		return result, nil
+	}
+
 	var statefulset appsv1.StatefulSet
 	statefulset.Name = etcdcluster.Name
 	statefulset.Namespace = etcdcluster.Namespace
@@ -101,14 +147,86 @@ func (r *EtcdClusterReconciler) Reconcile(ctx context.Context, req ctrl.Request)
 	}
 	clusetrlog.Info("create Or Update Result", "StatefulSet", stateresult)
 
-	return ctrl.Result{}, nil
+	// 持续把每个 revision 的修改写到快照旁边
+	if err := r.reconcileChangeLog(ctx, &etcdcluster); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	// 通过 etcd client 获取集群的真实状态，写回 status
+	cli, err := r.newClusterClient(ctx, &etcdcluster, clientEndpoints(&etcdcluster, *statefulset.Spec.Replicas))
+	var state *clusterState
+	if err == nil {
+		defer cli.Close()
+		state, err = observeCluster(ctx, cli)
+	}
+	if err != nil {
+		clusetrlog.Info("etcd cluster is not reachable", "reason", err.Error())
+	}
+	applyClusterState(&etcdcluster, state, metav1.Now())
+	applyConditions(&etcdcluster, &statefulset, state, err)
+
+	// 丢失 quorum 之后由恢复流程接管成员管理
+	var recovering, quiescing, changed bool
+	var memberErr error
+	if cli != nil || quorumRecoveryInProgress(&etcdcluster) {
+		recovering, changed, memberErr = r.reconcileQuorumRecovery(ctx, &etcdcluster, &statefulset, cli, state)
+	}
+	// 卷快照期间停掉一个成员，这时不做其他成员变更
+	if !recovering && memberErr == nil {
+		quiescing, memberErr = r.reconcileQuiesce(ctx, &etcdcluster, state)
+		changed = quiescing
+	}
+	// 成员的增减都通过 etcd API 完成，每次只变更一个成员
+	if !recovering && !quiescing && memberErr == nil && state != nil {
+		changed, memberErr = r.reconcileMembers(ctx, &etcdcluster, &statefulset, cli, state)
+	}
+	// 成员数量稳定之后再升级版本
+	if !recovering && !quiescing && !changed && memberErr == nil {
+		changed, memberErr = r.reconcileUpgrade(ctx, &etcdcluster, &statefulset, state)
+	}
+	// pod 模板变化之后逐个重启成员
+	if !recovering && !quiescing && !changed && memberErr == nil && state != nil {
+		changed, memberErr = r.rollOutTemplate(ctx, &etcdcluster, &statefulset, state)
+	}
+	// 证书更新之后逐个重启成员
+	if !recovering && !quiescing && !changed && memberErr == nil && state != nil && etcdcluster.Status.TLS != nil && etcdcluster.Status.TLS.LastRotationTime != nil {
+		changed, memberErr = r.restartMembers(ctx, &etcdcluster, state,
+			startedBefore(etcdcluster.Status.TLS.LastRotationTime.Time), "certificates were renewed")
+	}
+	if memberErr != nil {
+		setCondition(&etcdcluster, etcdv1alpha1.ConditionProgressing, metav1.ConditionTrue,
+			etcdv1alpha1.ReasonMemberReconcileFailed, memberErr.Error())
+	}
+	if err := r.Status().Patch(ctx, &etcdcluster, patch); err != nil {
+		return ctrl.Result{}, err
+	}
+	if memberErr != nil {
+		return ctrl.Result{}, memberErr
+	}
+	if changed {
+		return ctrl.Result{RequeueAfter: memberChangeRequeuePeriod}, nil
+	}
+
+	// etcd 的状态变化不会触发 watch 事件，需要定期重新观察
+	return ctrl.Result{RequeueAfter: statusResyncPeriod}, nil
 }
 
+const (
+	// statusResyncPeriod is how often the etcd cluster is polled to keep the status current.
+	statusResyncPeriod = 30 * time.Second
+	// memberChangeRequeuePeriod is how soon the cluster is looked at again after a membership change.
+	memberChangeRequeuePeriod = 5 * time.Second
+)
+
 // SetupWithManager sets up the controller with the Manager.
 func (r *EtcdClusterReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
 		For(&etcdv1alpha1.EtcdCluster{}).
 		Owns(&appsv1.StatefulSet{}).
+		Owns(&appsv1.Deployment{}).
 		Owns(&corev1.Service{}).
+		Owns(&corev1.ConfigMap{}).
+		Owns(&corev1.Secret{}).
+		Owns(&batchv1.Job{}).
 		Complete(r)
 }
@@ -0,0 +1,198 @@
+/*
+Copyright 2023 fpf.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+	"sigs.k8s.io/controller-runtime/pkg/source"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+)
+
+// RestoredFromAnnotation is set on an EtcdCluster created by an EtcdRestore.
+var RestoredFromAnnotation = "etcd.gqq.com/restored-from"
+
+// EtcdRestoreReconciler reconciles a EtcdRestore object
+type EtcdRestoreReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+}
+
+//+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdrestores,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdrestores/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdrestores/finalizers,verbs=update
+
+// Reconcile creates an EtcdCluster that bootstraps from the snapshot and follows it
+// until every member was seeded. The members then start from the restored data under
+// a new cluster ID.
+func (r *EtcdRestoreReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	restorelog := log.FromContext(ctx).WithValues("etcdrestore", req.NamespacedName)
+
+	var restore etcdv1alpha1.EtcdRestore
+	if err := r.Get(ctx, req.NamespacedName, &restore); err != nil {
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	if restore.Status.Phase == etcdv1alpha1.RestorePhaseCompleted || restore.Status.Phase == etcdv1alpha1.RestorePhaseFailed {
+		return ctrl.Result{}, nil
+	}
+	patch := client.MergeFrom(restore.DeepCopy())
+
+	result, err := r.restore(ctx, &restore)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if err := r.Status().Patch(ctx, &restore, patch); err != nil {
+		return ctrl.Result{}, err
+	}
+	restorelog.Info("restore reconciled", "phase", restore.Status.Phase, "restoredMembers", restore.Status.RestoredMembers)
+	return result, nil
+}
+
+func (r *EtcdRestoreReconciler) restore(ctx context.Context, restore *etcdv1alpha1.EtcdRestore) (ctrl.Result, error) {
+	var cluster etcdv1alpha1.EtcdCluster
+	err := r.Get(ctx, types.NamespacedName{Namespace: restore.Namespace, Name: restore.Spec.ClusterName}, &cluster)
+	if apierrors.IsNotFound(err) {
+		return r.createCluster(ctx, restore)
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if cluster.Annotations[RestoredFromAnnotation] != restore.Name {
+		r.failRestore(restore, fmt.Sprintf("EtcdCluster %s already exists", cluster.Name))
+		return ctrl.Result{}, nil
+	}
+
+	// 进度以集群的 bootstrap 状态为准
+	status := cluster.Status.Bootstrap
+	if status == nil {
+		return ctrl.Result{}, nil
+	}
+	restore.Status.RestoredMembers = status.SeededMembers
+	restore.Status.Message = status.Message
+	switch status.Phase {
+	case etcdv1alpha1.BootstrapPhaseCompleted:
+		restore.Status.Revision = status.Revision
+		r.completeRestore(restore)
+	case etcdv1alpha1.BootstrapPhaseFailed:
+		r.failRestore(restore, status.Message)
+	case etcdv1alpha1.BootstrapPhasePending:
+		restore.Status.Phase = etcdv1alpha1.RestorePhasePending
+	default:
+		restore.Status.Phase = etcdv1alpha1.RestorePhaseRestoring
+	}
+	return ctrl.Result{}, nil
+}
+
+// createCluster creates the EtcdCluster once the snapshot is available.
+func (r *EtcdRestoreReconciler) createCluster(ctx context.Context, restore *etcdv1alpha1.EtcdRestore) (ctrl.Result, error) {
+	if restore.Status.Phase == etcdv1alpha1.RestorePhaseRestoring {
+		r.failRestore(restore, fmt.Sprintf("EtcdCluster %s was deleted during the restore", restore.Spec.ClusterName))
+		return ctrl.Result{}, nil
+	}
+	if restore.Spec.ClusterSpec.Size == nil || *restore.Spec.ClusterSpec.Size < 1 {
+		r.failRestore(restore, "clusterSpec.size must be at least 1")
+		return ctrl.Result{}, nil
+	}
+	source, pending, failure, err := resolveSnapshotSource(ctx, r.Client, restore.Namespace, &restore.Spec.Source)
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+	if failure != "" {
+		r.failRestore(restore, failure)
+		return ctrl.Result{}, nil
+	}
+	if pending != "" {
+		restore.Status.Phase = etcdv1alpha1.RestorePhasePending
+		restore.Status.Message = pending
+		return ctrl.Result{RequeueAfter: backupPendingRequeuePeriod}, nil
+	}
+
+	if err := r.Create(ctx, restoredCluster(restore)); err != nil {
+		return ctrl.Result{}, err
+	}
+	now := metav1.Now()
+	restore.Status.Phase = etcdv1alpha1.RestorePhaseRestoring
+	restore.Status.StartTime = &now
+	restore.Status.Message = ""
+	r.Recorder.Eventf(restore, corev1.EventTypeNormal, "RestoreStarted", "created EtcdCluster %s to restore %s into",
+		restore.Spec.ClusterName, source.path)
+	return ctrl.Result{}, nil
+}
+
+// restoredCluster returns the EtcdCluster a restore creates.
+func restoredCluster(restore *etcdv1alpha1.EtcdRestore) *etcdv1alpha1.EtcdCluster {
+	cluster := &etcdv1alpha1.EtcdCluster{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace: restore.Namespace,
+			Name:      restore.Spec.ClusterName,
+			Annotations: map[string]string{
+				RestoredFromAnnotation: restore.Name,
+			},
+		},
+		Spec: *restore.Spec.ClusterSpec.DeepCopy(),
+	}
+	cluster.Spec.Bootstrap = &etcdv1alpha1.BootstrapSpec{
+		RestoreFrom: restore.Spec.Source.DeepCopy(),
+	}
+	return cluster
+}
+
+func (r *EtcdRestoreReconciler) completeRestore(restore *etcdv1alpha1.EtcdRestore) {
+	now := metav1.Now()
+	restore.Status.Phase = etcdv1alpha1.RestorePhaseCompleted
+	restore.Status.CompletionTime = &now
+	restore.Status.Message = ""
+	r.Recorder.Eventf(restore, corev1.EventTypeNormal, "RestoreCompleted", "restored EtcdCluster %s at revision %d",
+		restore.Spec.ClusterName, restore.Status.Revision)
+}
+
+func (r *EtcdRestoreReconciler) failRestore(restore *etcdv1alpha1.EtcdRestore, msg string) {
+	now := metav1.Now()
+	restore.Status.Phase = etcdv1alpha1.RestorePhaseFailed
+	restore.Status.CompletionTime = &now
+	restore.Status.Message = msg
+	r.Recorder.Event(restore, corev1.EventTypeWarning, "RestoreFailed", msg)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *EtcdRestoreReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&etcdv1alpha1.EtcdRestore{}).
+		Watches(&source.Kind{Type: &etcdv1alpha1.EtcdCluster{}},
+			handler.EnqueueRequestsFromMapFunc(func(obj client.Object) []reconcile.Request {
+				name, ok := obj.GetAnnotations()[RestoredFromAnnotation]
+				if !ok {
+					return nil
+				}
+				return []reconcile.Request{{NamespacedName: types.NamespacedName{Namespace: obj.GetNamespace(), Name: name}}}
+			})).
+		Complete(r)
+}
@@ -0,0 +1,242 @@
+/*
+Copyright 2023 fpf.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	"github.com/gqq/etcd-operator/pkg/backup"
+)
+
+// RestoreTestLabelKey is set on the Jobs of an EtcdRestoreTest.
+var RestoreTestLabelKey = "etcd.gqq.com/restore-test"
+
+const defaultRestoreTestTimeout = 30 * time.Minute
+
+// EtcdRestoreTestReconciler reconciles a EtcdRestoreTest object
+type EtcdRestoreTestReconciler struct {
+	client.Client
+	Scheme   *runtime.Scheme
+	Recorder record.EventRecorder
+	// AgentImage is the image the drill Jobs run.
+	AgentImage string
+}
+
+//+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdrestoretests,verbs=get;list;watch;create;update;patch;delete
+//+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdrestoretests/status,verbs=get;update;patch
+//+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdrestoretests/finalizers,verbs=update
+//+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdbackups,verbs=get;list;watch
+//+kubebuilder:rbac:groups=batch,resources=jobs,verbs=get;list;watch;create;update;patch;delete
+
+// Reconcile runs a restore drill on every scheduled time. A drill restores the latest
+// completed snapshot of the cluster into a scratch member in an agent Job and checks
+// it against what the backup recorded.
+func (r *EtcdRestoreTestReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
+	testlog := log.FromContext(ctx).WithValues("etcdrestoretest", req.NamespacedName)
+
+	var test etcdv1alpha1.EtcdRestoreTest
+	if err := r.Get(ctx, req.NamespacedName, &test); err != nil {
+		if apierrors.IsNotFound(err) {
+			forgetRestoreTestMetrics(req.Namespace, req.Name)
+		}
+		return ctrl.Result{}, client.IgnoreNotFound(err)
+	}
+	patch := client.MergeFrom(test.DeepCopy())
+	now := time.Now()
+
+	run := test.Status.LastRun
+	if run != nil && run.Result == "" {
+		if err := r.observeDrill(ctx, &test, run); err != nil {
+			return ctrl.Result{}, err
+		}
+	}
+
+	var result ctrl.Result
+	if sched, err := cron.ParseStandard(test.Spec.Schedule); err != nil {
+		test.Status.Message = fmt.Sprintf("invalid schedule %q: %v", test.Spec.Schedule, err)
+	} else if test.Spec.Suspend {
+		test.Status.Message = "suspended"
+	} else {
+		test.Status.Message = ""
+		missed, next := cronTimes(sched, test.CreationTimestamp.Time, test.Status.LastScheduleTime, now)
+		if !missed.IsZero() {
+			if run != nil && run.Result == "" {
+				// 上一次演练还没结束，跳过这一次
+				r.Recorder.Eventf(&test, corev1.EventTypeWarning, "DrillSkipped",
+					"skipped the drill scheduled at %s, job %s is still running", missed.Format(time.RFC3339), run.Job)
+			} else if err := r.startDrill(ctx, &test); err != nil {
+				return ctrl.Result{}, err
+			}
+			test.Status.LastScheduleTime = &metav1.Time{Time: missed}
+		}
+		result.RequeueAfter = next.Sub(now)
+		testlog.Info("next drill scheduled", "time", next)
+	}
+
+	if err := r.Status().Patch(ctx, &test, patch); err != nil {
+		return ctrl.Result{}, err
+	}
+	return result, nil
+}
+
+// startDrill creates the Job that restores the latest snapshot of the cluster. Not
+// having a snapshot to restore fails the drill.
+func (r *EtcdRestoreTestReconciler) startDrill(ctx context.Context, test *etcdv1alpha1.EtcdRestoreTest) error {
+	// 只保留最近一次演练的 Job，方便看日志
+	if prev := test.Status.LastRun; prev != nil && prev.Job != "" {
+		job := &batchv1.Job{}
+		job.Namespace = test.Namespace
+		job.Name = prev.Job
+		if err := r.Delete(ctx, job, client.PropagationPolicy(metav1.DeletePropagationBackground)); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+	}
+	now := metav1.Now()
+	run := &etcdv1alpha1.RestoreTestRun{StartTime: &now}
+	test.Status.LastRun = run
+
+	latest, err := latestBackup(ctx, r.Client, test.Namespace, test.Spec.ClusterName)
+	if err != nil {
+		return err
+	}
+	if latest == nil {
+		r.finishDrill(test, run, fmt.Sprintf("there is no completed EtcdBackup of %s to restore", test.Spec.ClusterName))
+		return nil
+	}
+	run.Backup = latest.Name
+	if latest.Spec.Destination.VolumeSnapshot != nil {
+		r.finishDrill(test, run, fmt.Sprintf("EtcdBackup %s is a volume snapshot, which drills cannot restore", latest.Name))
+		return nil
+	}
+	if r.AgentImage == "" {
+		r.finishDrill(test, run, "the operator was started without --agent-image")
+		return nil
+	}
+
+	name := fmt.Sprintf("%s-%d", test.Name, now.Unix())
+	job := newAgentJob(test.Namespace, name, r.AgentImage,
+		map[string]string{EtcdClusterLabelKey: test.Spec.ClusterName, RestoreTestLabelKey: test.Name}, nil)
+	timeout := int64(defaultRestoreTestTimeout.Seconds())
+	if test.Spec.Timeout != nil {
+		timeout = int64(test.Spec.Timeout.Seconds())
+	}
+	job.Spec.ActiveDeadlineSeconds = &timeout
+	// 演练失败就是结果，不用重试
+	backoffLimit := int32(0)
+	job.Spec.BackoffLimit = &backoffLimit
+	args := []string{"verify", "--path", latest.Status.Path, "--scratch-dir", agentScratchDir}
+	if latest.Status.SHA256 != "" {
+		args = append(args, "--sha256", latest.Status.SHA256)
+	}
+	if latest.Status.Revision != 0 {
+		args = append(args, "--revision", strconv.FormatInt(latest.Status.Revision, 10))
+	}
+	if latest.Status.Keys != 0 {
+		args = append(args, "--keys", strconv.FormatInt(latest.Status.Keys, 10))
+	}
+	for _, p := range test.Spec.KeyPrefixes {
+		args = append(args, "--prefix", fmt.Sprintf("%s=%d", p.Prefix, p.MinKeys))
+	}
+	args = append(args, agentStorageArgs(&job.Spec.Template.Spec, &latest.Spec.Destination)...)
+	job.Spec.Template.Spec.Containers[0].Command = append(job.Spec.Template.Spec.Containers[0].Command, args...)
+	if err := controllerutil.SetControllerReference(test, job, r.Scheme); err != nil {
+		return err
+	}
+	if err := r.Create(ctx, job); err != nil {
+		return err
+	}
+	run.Job = name
+	r.Recorder.Eventf(test, corev1.EventTypeNormal, "DrillStarted", "restoring backup %s in job %s", latest.Name, name)
+	return nil
+}
+
+// observeDrill finishes the running drill once its Job finished.
+func (r *EtcdRestoreTestReconciler) observeDrill(ctx context.Context, test *etcdv1alpha1.EtcdRestoreTest, run *etcdv1alpha1.RestoreTestRun) error {
+	var job batchv1.Job
+	err := r.Get(ctx, types.NamespacedName{Namespace: test.Namespace, Name: run.Job}, &job)
+	if apierrors.IsNotFound(err) {
+		r.finishDrill(test, run, fmt.Sprintf("job %s was deleted", run.Job))
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	finished, failed := jobFinished(&job)
+	if !finished {
+		return nil
+	}
+	if failed {
+		msg, err := agentMessage(ctx, r.Client, &job, corev1.PodFailed)
+		if err != nil || msg == "" {
+			msg = fmt.Sprintf("job %s failed", job.Name)
+		}
+		r.finishDrill(test, run, msg)
+		return nil
+	}
+	var res backup.VerifyResult
+	if err := agentResult(ctx, r.Client, &job, &res); err != nil {
+		return err
+	}
+	run.Revision = res.Revision
+	run.Keys = res.Keys
+	r.finishDrill(test, run, "")
+	return nil
+}
+
+// finishDrill records the outcome of a drill, which failed unless msg is empty.
+func (r *EtcdRestoreTestReconciler) finishDrill(test *etcdv1alpha1.EtcdRestoreTest, run *etcdv1alpha1.RestoreTestRun, msg string) {
+	now := metav1.Now()
+	run.CompletionTime = &now
+	run.Duration = &metav1.Duration{Duration: now.Sub(run.StartTime.Time).Round(time.Second)}
+	run.Message = msg
+	if msg == "" {
+		run.Result = etcdv1alpha1.RestoreTestPassed
+		test.Status.LastPassedTime = &now
+		r.Recorder.Eventf(test, corev1.EventTypeNormal, "DrillPassed", "restored backup %s at revision %d with %d keys in %s",
+			run.Backup, run.Revision, run.Keys, run.Duration.Duration)
+	} else {
+		run.Result = etcdv1alpha1.RestoreTestFailed
+		test.Status.LastFailedTime = &now
+		r.Recorder.Event(test, corev1.EventTypeWarning, "DrillFailed", msg)
+	}
+	recordRestoreTestMetrics(test, run)
+}
+
+// SetupWithManager sets up the controller with the Manager.
+func (r *EtcdRestoreTestReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewControllerManagedBy(mgr).
+		For(&etcdv1alpha1.EtcdRestoreTest{}).
+		Owns(&batchv1.Job{}).
+		Complete(r)
+}
@@ -0,0 +1,59 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// pickTransferee returns the healthy voting member, other than the leader, that applied
+// the most raft entries, so that the new leader has the least to catch up on.
+func (s *clusterState) pickTransferee(leaderID uint64) *etcdserverpb.Member {
+	var transferee *etcdserverpb.Member
+	var index uint64
+	for _, m := range s.members {
+		if m.ID == leaderID || m.IsLearner {
+			continue
+		}
+		if st, ok := s.statuses[m.ID]; ok && (transferee == nil || st.RaftIndex > index) {
+			transferee, index = m, st.RaftIndex
+		}
+	}
+	return transferee
+}
+
+// transferLeadership asks the current leader to hand leadership to a healthy follower,
+// so that restarting or removing the leader does not leave the cluster waiting for an
+// election timeout. MoveLeader must be served by the leader itself, so the request is
+// sent to its endpoint only.
+func (r *EtcdClusterReconciler) transferLeadership(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, state *clusterState, leaderID uint64) error {
+	transferee := state.pickTransferee(leaderID)
+	if transferee == nil {
+		return fmt.Errorf("no healthy follower to take over leadership")
+	}
+	var leader *etcdserverpb.Member
+	for _, m := range state.members {
+		if m.ID == leaderID {
+			leader = m
+		}
+	}
+	if leader == nil || len(leader.ClientURLs) == 0 {
+		return fmt.Errorf("leader %x has no client URL", leaderID)
+	}
+
+	cli, err := r.newClusterClient(ctx, cluster, leader.ClientURLs)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	moveCtx, cancel := withEtcdTimeout(ctx)
+	defer cancel()
+	if _, err := cli.MoveLeader(moveCtx, transferee.ID); err != nil {
+		return err
+	}
+	r.Recorder.Eventf(cluster, corev1.EventTypeNormal, "LeadershipTransferred", "moved leadership from %s to %s", leader.Name, transferee.Name)
+	return nil
+}
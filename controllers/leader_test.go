@@ -0,0 +1,35 @@
+package controllers
+
+import (
+	"testing"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestPickTransfereePrefersMostUpToDate(t *testing.T) {
+	state := &clusterState{
+		leaderID: 1,
+		members: []*etcdserverpb.Member{
+			{ID: 1, Name: "etcd-0"}, {ID: 2, Name: "etcd-1"}, {ID: 3, Name: "etcd-2"}, {ID: 4, Name: "etcd-3", IsLearner: true},
+		},
+		statuses: map[uint64]*clientv3.StatusResponse{
+			1: {RaftIndex: 500},
+			2: {RaftIndex: 480},
+			3: {RaftIndex: 495},
+			4: {RaftIndex: 500},
+		},
+	}
+	if m := state.pickTransferee(1); m == nil || m.Name != "etcd-2" {
+		t.Errorf("picked %v, want etcd-2", m)
+	}
+	// 不健康的成员不能接任
+	delete(state.statuses, 3)
+	if m := state.pickTransferee(1); m == nil || m.Name != "etcd-1" {
+		t.Errorf("picked %v, want etcd-1", m)
+	}
+	delete(state.statuses, 2)
+	if m := state.pickTransferee(1); m != nil {
+		t.Errorf("picked %s without a healthy follower", m.Name)
+	}
+}
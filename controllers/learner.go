@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// defaultLearnerMaxLag is used when Spec.Scaling.LearnerMaxLag is not set.
+const defaultLearnerMaxLag = 1000
+
+// learners returns the members that are still raft learners.
+func (s *clusterState) learners() []*etcdserverpb.Member {
+	var learners []*etcdserverpb.Member
+	for _, m := range s.members {
+		if m.IsLearner {
+			learners = append(learners, m)
+		}
+	}
+	return learners
+}
+
+// memberLag returns how many raft entries a member trails the leader by.
+// The second result is false when either of them did not report its status.
+func (s *clusterState) memberLag(m *etcdserverpb.Member) (uint64, bool) {
+	leader, ok := s.statuses[s.leaderID]
+	if !ok {
+		return 0, false
+	}
+	st, ok := s.statuses[m.ID]
+	if !ok {
+		return 0, false
+	}
+	if st.RaftIndex >= leader.RaftIndex {
+		return 0, true
+	}
+	return leader.RaftIndex - st.RaftIndex, true
+}
+
+func learnerMaxLag(cluster *etcdv1alpha1.EtcdCluster) uint64 {
+	if cluster.Spec.Scaling != nil && cluster.Spec.Scaling.LearnerMaxLag != nil {
+		return uint64(*cluster.Spec.Scaling.LearnerMaxLag)
+	}
+	return defaultLearnerMaxLag
+}
+
+// promoteLearners promotes the learners that caught up with the leader to voting members.
+// It returns true when a learner was promoted.
+func (r *EtcdClusterReconciler) promoteLearners(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	cli *clientv3.Client, state *clusterState, learners []*etcdserverpb.Member) (bool, error) {
+	for _, m := range learners {
+		lag, ok := state.memberLag(m)
+		if !ok || lag > learnerMaxLag(cluster) {
+			// 还没有追上 leader，下次再看
+			continue
+		}
+		log.FromContext(ctx).Info("promoting learner", "member", m.Name, "lag", lag)
+		promoteCtx, cancel := withEtcdTimeout(ctx)
+		_, err := cli.MemberPromote(promoteCtx, m.ID)
+		cancel()
+		if err != nil {
+			return false, fmt.Errorf("promote learner %s: %w", m.Name, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,144 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	appsv1 "k8s.io/api/apps/v1"
+)
+
+// fakeEtcdCluster records the membership changes sent through clientv3.Client.Cluster.
+type fakeEtcdCluster struct {
+	clientv3.Cluster
+	members  []*etcdserverpb.Member
+	added    []string
+	removed  []uint64
+	promoted []uint64
+}
+
+func (f *fakeEtcdCluster) MemberAdd(ctx context.Context, peerURLs []string) (*clientv3.MemberAddResponse, error) {
+	return f.add(peerURLs, false), nil
+}
+
+func (f *fakeEtcdCluster) MemberAddAsLearner(ctx context.Context, peerURLs []string) (*clientv3.MemberAddResponse, error) {
+	return f.add(peerURLs, true), nil
+}
+
+func (f *fakeEtcdCluster) add(peerURLs []string, learner bool) *clientv3.MemberAddResponse {
+	m := &etcdserverpb.Member{ID: uint64(100 + len(f.added)), PeerURLs: peerURLs, IsLearner: learner}
+	f.added = append(f.added, peerURLs...)
+	f.members = append(f.members, m)
+	return &clientv3.MemberAddResponse{Member: m, Members: f.members}
+}
+
+func (f *fakeEtcdCluster) MemberRemove(ctx context.Context, id uint64) (*clientv3.MemberRemoveResponse, error) {
+	f.removed = append(f.removed, id)
+	return &clientv3.MemberRemoveResponse{}, nil
+}
+
+func (f *fakeEtcdCluster) MemberPromote(ctx context.Context, id uint64) (*clientv3.MemberPromoteResponse, error) {
+	f.promoted = append(f.promoted, id)
+	return &clientv3.MemberPromoteResponse{}, nil
+}
+
+func TestPromoteLearnersWithinLag(t *testing.T) {
+	lag := func(n int64) *int64 { return &n }
+	for _, tc := range []struct {
+		name          string
+		leaderIndex   uint64
+		learnerIndex  uint64
+		learnerStatus bool
+		maxLag        *int64
+		promoted      bool
+	}{
+		{"caught up", 5000, 4500, true, nil, true},
+		{"at the default lag", 5000, 4000, true, nil, true},
+		{"behind the default lag", 5000, 3999, true, nil, false},
+		{"ahead of the leader", 5000, 5001, true, nil, true},
+		{"no status", 5000, 5000, false, nil, false},
+		{"behind a lower lag", 5000, 4500, true, lag(100), false},
+		{"within a higher lag", 5000, 2000, true, lag(5000), true},
+		{"zero lag", 5000, 5000, true, lag(0), true},
+		{"behind a zero lag", 5000, 4999, true, lag(0), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cluster := &etcdv1alpha1.EtcdCluster{}
+			cluster.Name = "etcd"
+			if tc.maxLag != nil {
+				cluster.Spec.Scaling = &etcdv1alpha1.ScalingSpec{UseLearners: true, LearnerMaxLag: tc.maxLag}
+			}
+			state := &clusterState{
+				leaderID: 1,
+				members: []*etcdserverpb.Member{
+					{ID: 1, Name: "etcd-0"}, {ID: 2, Name: "etcd-1"}, {ID: 3, Name: "etcd-2", IsLearner: true},
+				},
+				statuses: map[uint64]*clientv3.StatusResponse{1: {RaftIndex: tc.leaderIndex}, 2: {RaftIndex: tc.leaderIndex}},
+				errors:   map[uint64]string{},
+			}
+			if tc.learnerStatus {
+				state.statuses[3] = &clientv3.StatusResponse{RaftIndex: tc.learnerIndex}
+			}
+			etcd := &fakeEtcdCluster{members: state.members}
+			r := &EtcdClusterReconciler{}
+			promoted, err := r.promoteLearners(context.Background(), cluster, &clientv3.Client{Cluster: etcd}, state, state.learners())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if promoted != tc.promoted || (len(etcd.promoted) == 1) != tc.promoted {
+				t.Errorf("promoted %v (%v), want %v", promoted, etcd.promoted, tc.promoted)
+			}
+		})
+	}
+
+	// leader 没有回应的时候不知道落后多少
+	state := &clusterState{
+		leaderID: 1,
+		members:  []*etcdserverpb.Member{{ID: 1, Name: "etcd-0"}, {ID: 2, Name: "etcd-1", IsLearner: true}},
+		statuses: map[uint64]*clientv3.StatusResponse{2: {RaftIndex: 5000}},
+	}
+	if _, ok := state.memberLag(state.members[1]); ok {
+		t.Error("lag known without the status of the leader")
+	}
+}
+
+func TestLearnerBlocksMembershipChanges(t *testing.T) {
+	size, replicas := int32(4), int32(3)
+	cluster := &etcdv1alpha1.EtcdCluster{}
+	cluster.Name, cluster.Namespace = "etcd", "default"
+	cluster.Spec.Size = &size
+	cluster.Spec.Scaling = &etcdv1alpha1.ScalingSpec{UseLearners: true}
+	sts := &appsv1.StatefulSet{}
+	sts.Spec.Replicas = &replicas
+	state := &clusterState{
+		leaderID: 1,
+		members: []*etcdserverpb.Member{
+			{ID: 1, Name: "etcd-0"}, {ID: 2, Name: "etcd-1"}, {ID: 3, Name: "etcd-2", IsLearner: true},
+		},
+		statuses: map[uint64]*clientv3.StatusResponse{1: {RaftIndex: 5000}, 2: {RaftIndex: 5000}, 3: {RaftIndex: 100}},
+		errors:   map[uint64]string{},
+	}
+	etcd := &fakeEtcdCluster{members: state.members}
+	r := &EtcdClusterReconciler{}
+
+	// learner 没追上之前不加新成员
+	changed, err := r.reconcileMembers(context.Background(), cluster, sts, &clientv3.Client{Cluster: etcd}, state)
+	if err != nil || changed {
+		t.Fatalf("changed %v, error %v", changed, err)
+	}
+	if len(etcd.added) > 0 || len(etcd.promoted) > 0 {
+		t.Fatalf("membership changed while a learner is behind: added %v, promoted %v", etcd.added, etcd.promoted)
+	}
+
+	// 追上之后先提升它，仍然不加新成员
+	state.statuses[3].RaftIndex = 5000
+	changed, err = r.reconcileMembers(context.Background(), cluster, sts, &clientv3.Client{Cluster: etcd}, state)
+	if err != nil || !changed {
+		t.Fatalf("changed %v, error %v", changed, err)
+	}
+	if len(etcd.promoted) != 1 || etcd.promoted[0] != 3 || len(etcd.added) > 0 {
+		t.Errorf("promoted %v and added %v, want only etcd-2 promoted", etcd.promoted, etcd.added)
+	}
+}
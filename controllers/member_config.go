@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// EtcdConfigDir is where the member configuration ConfigMap is mounted.
+	EtcdConfigDir = "/etc/etcd/config"
+	// EtcdDataDir is the etcd data directory inside the datadir volume.
+	EtcdDataDir = "/var/run/etcd/default.etcd"
+
+	initialClusterStateNew      = "new"
+	initialClusterStateExisting = "existing"
+)
+
+// etcdConfig is the subset of the etcd configuration file the operator writes for every member.
+// See https://etcd.io/docs/v3.5/op-guide/configuration/ for the meaning of each field.
+type etcdConfig struct {
+	Name                     string `json:"name"`
+	DataDir                  string `json:"data-dir"`
+	ListenPeerURLs           string `json:"listen-peer-urls"`
+	ListenClientURLs         string `json:"listen-client-urls"`
+	InitialAdvertisePeerURLs string `json:"initial-advertise-peer-urls"`
+	AdvertiseClientURLs      string `json:"advertise-client-urls"`
+	InitialCluster           string `json:"initial-cluster"`
+	InitialClusterState      string `json:"initial-cluster-state"`
+	InitialClusterToken      string `json:"initial-cluster-token"`
+	// ForceNewCluster makes the member discard the membership of its data directory
+	// and start as a single member cluster. Only used by quorum recovery.
+	ForceNewCluster bool `json:"force-new-cluster,omitempty"`
+
+	ClientTransportSecurity *transportSecurity `json:"client-transport-security,omitempty"`
+	PeerTransportSecurity   *transportSecurity `json:"peer-transport-security,omitempty"`
+}
+
+// transportSecurity is the TLS configuration of the client or the peer listener.
+type transportSecurity struct {
+	CertFile       string `json:"cert-file"`
+	KeyFile        string `json:"key-file"`
+	TrustedCAFile  string `json:"trusted-ca-file"`
+	ClientCertAuth bool   `json:"client-cert-auth"`
+}
+
+// memberConfigMapName is the name of the ConfigMap holding the configuration of every member.
+func memberConfigMapName(cluster *etcdv1alpha1.EtcdCluster) string {
+	return cluster.Name + "-config"
+}
+
+// memberConfigKey is the ConfigMap key, and therefore the file name, of a member's configuration.
+func memberConfigKey(name string) string {
+	return name + ".yaml"
+}
+
+// initialCluster renders the --initial-cluster value for the given member names.
+func initialCluster(cluster *etcdv1alpha1.EtcdCluster, names []string) string {
+	peers := make([]string, 0, len(names))
+	for _, name := range names {
+		peers = append(peers, fmt.Sprintf("%s=%s", name, memberPeerURL(cluster, name)))
+	}
+	return strings.Join(peers, ",")
+}
+
+// newMemberConfig builds the configuration a member starts with. initialMembers must include the member itself.
+func newMemberConfig(cluster *etcdv1alpha1.EtcdCluster, name string, initialMembers []string, state string) etcdConfig {
+	config := etcdConfig{
+		Name:                     name,
+		DataDir:                  EtcdDataDir,
+		ListenPeerURLs:           urlScheme(cluster) + "://0.0.0.0:2380",
+		ListenClientURLs:         urlScheme(cluster) + "://0.0.0.0:2379",
+		InitialAdvertisePeerURLs: memberPeerURL(cluster, name),
+		AdvertiseClientURLs:      memberClientURL(cluster, name),
+		InitialCluster:           initialCluster(cluster, initialMembers),
+		InitialClusterState:      state,
+		InitialClusterToken:      string(cluster.UID),
+	}
+	if tlsEnabled(cluster) {
+		config.ClientTransportSecurity = newTransportSecurity(cluster, EtcdServerTLSDir, name)
+		config.PeerTransportSecurity = newTransportSecurity(cluster, EtcdPeerTLSDir, name)
+	}
+	return config
+}
+
+func newTransportSecurity(cluster *etcdv1alpha1.EtcdCluster, dir, name string) *transportSecurity {
+	certFile, keyFile := memberCertFiles(cluster, dir, name)
+	return &transportSecurity{
+		CertFile:       certFile,
+		KeyFile:        keyFile,
+		TrustedCAFile:  dir + "/" + caCertKey,
+		ClientCertAuth: true,
+	}
+}
+
+// getMemberConfigMap returns the member configuration ConfigMap, or nil when it does not exist yet.
+func (r *EtcdClusterReconciler) getMemberConfigMap(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster) (*corev1.ConfigMap, error) {
+	var cm corev1.ConfigMap
+	err := r.Get(ctx, types.NamespacedName{Namespace: cluster.Namespace, Name: memberConfigMapName(cluster)}, &cm)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cm, nil
+}
+
+// writeMemberConfigs creates or updates the configuration of the given members.
+func (r *EtcdClusterReconciler) writeMemberConfigs(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, configs ...etcdConfig) error {
+	var cm corev1.ConfigMap
+	cm.Namespace = cluster.Namespace
+	cm.Name = memberConfigMapName(cluster)
+	_, err := controllerutil.CreateOrUpdate(ctx, r.Client, &cm, func() error {
+		cm.Labels = map[string]string{
+			EtcdClusterCommonLabelKey: "etcd",
+			EtcdClusterLabelKey:       cluster.Name,
+		}
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		for _, c := range configs {
+			data, err := yaml.Marshal(c)
+			if err != nil {
+				return err
+			}
+			cm.Data[memberConfigKey(c.Name)] = string(data)
+		}
+		return controllerutil.SetControllerReference(cluster, &cm, r.Schemes())
+	})
+	return err
+}
+
+// deleteMemberConfig drops the configuration of a member that left the cluster.
+func (r *EtcdClusterReconciler) deleteMemberConfig(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, name string) error {
+	cm, err := r.getMemberConfigMap(ctx, cluster)
+	if err != nil || cm == nil {
+		return err
+	}
+	if _, ok := cm.Data[memberConfigKey(name)]; !ok {
+		return nil
+	}
+	delete(cm.Data, memberConfigKey(name))
+	return r.Update(ctx, cm)
+}
+
+// ensureMemberConfigs writes the bootstrap configuration before the StatefulSet starts any pod.
+// A new cluster gets its initial members that bootstrap together; a cluster whose StatefulSet
+// already exists gets a configuration for every running ordinal so its pods can restart.
+func (r *EtcdClusterReconciler) ensureMemberConfigs(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster) error {
+	size, state := initialMembers(cluster), initialClusterStateNew
+	sts, err := r.getStatefulSet(ctx, cluster)
+	if err != nil {
+		return err
+	}
+	if sts != nil {
+		size, state = *sts.Spec.Replicas, initialClusterStateExisting
+	}
+
+	cm, err := r.getMemberConfigMap(ctx, cluster)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, size)
+	for i := 0; i < int(size); i++ {
+		names = append(names, memberName(cluster, i))
+	}
+	var missing []etcdConfig
+	for _, name := range names {
+		// 为卷快照停掉的成员没有配置才起不来
+		if name == quiescedMember(cluster) {
+			continue
+		}
+		if cm != nil {
+			if _, ok := cm.Data[memberConfigKey(name)]; ok {
+				continue
+			}
+		}
+		missing = append(missing, newMemberConfig(cluster, name, names, state))
+	}
+	if cm != nil && len(missing) == 0 {
+		return nil
+	}
+	return r.writeMemberConfigs(ctx, cluster, missing...)
+}
@@ -0,0 +1,228 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// memberByName finds a member by name, falling back to its peer URL for members
+// that were added but have not started yet and therefore have no name.
+func (s *clusterState) memberByName(cluster *etcdv1alpha1.EtcdCluster, name string) *etcdserverpb.Member {
+	peerURL := memberPeerURL(cluster, name)
+	for _, m := range s.members {
+		if m.Name == name {
+			return m
+		}
+		for _, u := range m.PeerURLs {
+			if u == peerURL {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+// allHealthy reports whether every member has started and answered a status request.
+func (s *clusterState) allHealthy() bool {
+	return len(s.errors) == 0 && s.healthyCount() == len(s.members)
+}
+
+// reconcileMembers moves the etcd membership one member closer to Spec.Size.
+// It returns true when it changed the membership, so that the caller requeues soon.
+//
+// A member is always added through the etcd API before its pod is created, and
+// removed through the etcd API before its pod is deleted.
+func (r *EtcdClusterReconciler) reconcileMembers(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, cli *clientv3.Client, state *clusterState) (bool, error) {
+	replicas, size := *sts.Spec.Replicas, *cluster.Spec.Size
+
+	// 上一次调谐已经 add 了成员，但是还没有来得及扩容 statefulset
+	next := memberName(cluster, int(replicas))
+	if m := state.memberByName(cluster, next); m != nil {
+		if replicas < size {
+			return true, r.startMember(ctx, cluster, sts, next, state.members)
+		}
+		// size 又被调小了，这个成员不会再启动
+		log.FromContext(ctx).Info("removing etcd member that never started", "member", next)
+		removeCtx, cancel := withEtcdTimeout(ctx)
+		defer cancel()
+		if _, err := cli.MemberRemove(removeCtx, m.ID); err != nil {
+			return false, fmt.Errorf("remove member %s: %w", next, err)
+		}
+		return true, nil
+	}
+
+	// 替换长时间不健康的成员
+	if changed, err := r.reconcileReplacement(ctx, cluster, sts, cli, state); changed || err != nil {
+		return changed, err
+	}
+
+	// 有 learner 的时候先等它追上 leader 再做其他变更
+	if learners := state.learners(); len(learners) > 0 {
+		return r.promoteLearners(ctx, cluster, cli, state, learners)
+	}
+
+	switch {
+	case replicas > size:
+		return r.scaleDown(ctx, cluster, sts, cli, state)
+	case replicas < size:
+		if len(state.members) != int(replicas) || !state.allHealthy() {
+			// 集群不稳定的时候不做成员变更
+			return false, nil
+		}
+		return true, r.addMember(ctx, cluster, sts, cli)
+	}
+	return false, nil
+}
+
+// addMember registers the member with the next ordinal and then starts its pod.
+func (r *EtcdClusterReconciler) addMember(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, cli *clientv3.Client) error {
+	name := memberName(cluster, int(*sts.Spec.Replicas))
+	log.FromContext(ctx).Info("adding etcd member", "member", name)
+
+	resp, err := memberAdd(ctx, cluster, cli, name)
+	if err != nil {
+		return fmt.Errorf("add member %s: %w", name, err)
+	}
+	return r.startMember(ctx, cluster, sts, name, resp.Members)
+}
+
+// startMember writes the configuration of a member that is already registered
+// in etcd and scales the StatefulSet up to create its pod.
+func (r *EtcdClusterReconciler) startMember(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, name string, members []*etcdserverpb.Member) error {
+	if err := r.writeJoinConfig(ctx, cluster, name, members); err != nil {
+		return err
+	}
+	return r.scaleStatefulSet(ctx, sts, *sts.Spec.Replicas+1)
+}
+
+// writeJoinConfig writes the configuration a newly added member uses to join the existing cluster.
+func (r *EtcdClusterReconciler) writeJoinConfig(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	name string, members []*etcdserverpb.Member) error {
+	peerURL := memberPeerURL(cluster, name)
+	names := make([]string, 0, len(members))
+	for _, m := range members {
+		if m.Name != "" {
+			names = append(names, m.Name)
+			continue
+		}
+		for _, u := range m.PeerURLs {
+			if u == peerURL {
+				names = append(names, name)
+			}
+		}
+	}
+	if err := r.writeMemberConfigs(ctx, cluster, newMemberConfig(cluster, name, names, initialClusterStateExisting)); err != nil {
+		return fmt.Errorf("write configuration of member %s: %w", name, err)
+	}
+	return nil
+}
+
+// memberAdd registers a new member, as a learner when the cluster is configured to use learners.
+func memberAdd(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, cli *clientv3.Client, name string) (*clientv3.MemberAddResponse, error) {
+	addCtx, cancel := withEtcdTimeout(ctx)
+	defer cancel()
+	peerURLs := []string{memberPeerURL(cluster, name)}
+	if cluster.Spec.Scaling != nil && cluster.Spec.Scaling.UseLearners {
+		return cli.MemberAddAsLearner(addCtx, peerURLs)
+	}
+	return cli.MemberAdd(addCtx, peerURLs)
+}
+
+// scaleDown removes the member with the highest ordinal, one step per call:
+// leadership is moved away from it first, then it is removed through the etcd API,
+// and only once the remaining members are healthy again are its volume and pod deleted.
+func (r *EtcdClusterReconciler) scaleDown(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, cli *clientv3.Client, state *clusterState) (bool, error) {
+	replicas := *sts.Spec.Replicas
+	name := memberName(cluster, int(replicas)-1)
+	logger := log.FromContext(ctx).WithValues("member", name)
+
+	m := state.memberByName(cluster, name)
+	if m == nil {
+		// 成员已经从 etcd 中删除，等剩下的成员恢复健康后再缩容 statefulset
+		if len(state.members) != int(replicas)-1 || !state.allHealthy() {
+			logger.Info("waiting for the remaining members to become healthy before deleting the pod")
+			return false, nil
+		}
+		if err := r.deleteMemberConfig(ctx, cluster, name); err != nil {
+			return false, err
+		}
+		// 先删除数据卷再缩容，否则删除失败后不会再重试，以后扩容时会用旧的数据目录启动。
+		// pod 还在的时候 PVC 保护的 finalizer 会留着它
+		if err := r.deleteMemberVolume(ctx, cluster, name); err != nil {
+			return false, err
+		}
+		return true, r.scaleStatefulSet(ctx, sts, replicas-1)
+	}
+
+	// 删除一个成员之后，剩下的成员必须都是健康的，否则可能丢失 quorum
+	for _, other := range state.members {
+		if other.ID == m.ID {
+			continue
+		}
+		if _, ok := state.errors[other.ID]; ok {
+			logger.Info("not removing member while another member is unhealthy", "unhealthy", other.Name)
+			return false, nil
+		}
+	}
+
+	if m.ID == state.leaderID {
+		logger.Info("moving leadership away before removing member")
+		if err := r.transferLeadership(ctx, cluster, state, m.ID); err != nil {
+			return false, fmt.Errorf("move leadership away from %s: %w", name, err)
+		}
+		return true, nil
+	}
+
+	logger.Info("removing etcd member", "id", fmt.Sprintf("%x", m.ID))
+	removeCtx, cancel := withEtcdTimeout(ctx)
+	defer cancel()
+	if _, err := cli.MemberRemove(removeCtx, m.ID); err != nil {
+		return false, fmt.Errorf("remove member %s: %w", name, err)
+	}
+	return true, nil
+}
+
+// getStatefulSet returns the StatefulSet of the cluster, or nil when it does not exist yet.
+func (r *EtcdClusterReconciler) getStatefulSet(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster) (*appsv1.StatefulSet, error) {
+	var sts appsv1.StatefulSet
+	err := r.Get(ctx, types.NamespacedName{Namespace: cluster.Namespace, Name: cluster.Name}, &sts)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sts, nil
+}
+
+func (r *EtcdClusterReconciler) scaleStatefulSet(ctx context.Context, sts *appsv1.StatefulSet, replicas int32) error {
+	patch := client.MergeFrom(sts.DeepCopy())
+	sts.Spec.Replicas = &replicas
+	return r.Patch(ctx, sts, patch)
+}
+
+// deleteMemberVolume deletes the data volume of a member; the PVC protection finalizer
+// keeps it until the pod is gone.
+func (r *EtcdClusterReconciler) deleteMemberVolume(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, name string) error {
+	var pvc corev1.PersistentVolumeClaim
+	pvc.Namespace = cluster.Namespace
+	pvc.Name = memberVolumeName(name)
+	if err := r.Delete(ctx, &pvc); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+// failingDeleteClient fails deleting claims while fail is set.
+type failingDeleteClient struct {
+	client.Client
+	fail bool
+}
+
+func (c *failingDeleteClient) Delete(ctx context.Context, obj client.Object, opts ...client.DeleteOption) error {
+	if _, ok := obj.(*corev1.PersistentVolumeClaim); ok && c.fail {
+		return errors.New("injected failure")
+	}
+	return c.Client.Delete(ctx, obj, opts...)
+}
+
+func TestScaleDownRetriesVolumeDeletion(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = etcdv1alpha1.AddToScheme(scheme)
+
+	size, replicas := int32(2), int32(3)
+	cluster := &etcdv1alpha1.EtcdCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "etcd", Namespace: "default"},
+		Spec:       etcdv1alpha1.EtcdClusterSpec{Size: &size, Image: "quay.io/coreos/etcd:v3.5.1"},
+	}
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "etcd", Namespace: "default"}}
+	sts.Spec.Replicas = &replicas
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: memberVolumeName("etcd-2"), Namespace: "default"}}
+	c := &failingDeleteClient{Client: fake.NewClientBuilder().WithScheme(scheme).WithObjects(cluster.DeepCopy(), sts, pvc).Build(), fail: true}
+	r := &EtcdClusterReconciler{Client: c, Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+
+	// etcd-2 已经从 etcd 中删除，剩下的成员都健康
+	state := &clusterState{
+		leaderID: 1,
+		members:  []*etcdserverpb.Member{{ID: 1, Name: "etcd-0"}, {ID: 2, Name: "etcd-1"}},
+		statuses: map[uint64]*clientv3.StatusResponse{1: {}, 2: {}},
+		errors:   map[uint64]string{},
+	}
+	if _, err := r.reconcileMembers(ctx, cluster, sts, nil, state); err == nil {
+		t.Fatal("failing to delete the volume was not reported")
+	}
+	if *sts.Spec.Replicas != 3 {
+		t.Fatalf("StatefulSet scaled to %d before the volume was deleted", *sts.Spec.Replicas)
+	}
+
+	// 下一次调谐重试删除
+	c.fail = false
+	if changed, err := r.reconcileMembers(ctx, cluster, sts, nil, state); err != nil || !changed {
+		t.Fatalf("changed %v, error %v", changed, err)
+	}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(pvc), pvc); !apierrors.IsNotFound(err) {
+		t.Errorf("volume of the removed member is still there: %v", err)
+	}
+	if *sts.Spec.Replicas != 2 {
+		t.Errorf("StatefulSet has %d replicas, want 2", *sts.Spec.Replicas)
+	}
+}
+
+// scaleUpFixture is a healthy cluster of three members whose Spec.Size is size.
+func scaleUpFixture(t *testing.T, size int32) (*EtcdClusterReconciler, *etcdv1alpha1.EtcdCluster, *appsv1.StatefulSet, *clusterState) {
+	t.Helper()
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = etcdv1alpha1.AddToScheme(scheme)
+
+	replicas := int32(3)
+	cluster := &etcdv1alpha1.EtcdCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "etcd", Namespace: "default", UID: "uid"},
+		Spec:       etcdv1alpha1.EtcdClusterSpec{Size: &size, Image: "quay.io/coreos/etcd:v3.5.1"},
+	}
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "etcd", Namespace: "default"}}
+	sts.Spec.Replicas = &replicas
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cluster.DeepCopy(), sts.DeepCopy()).Build()
+	r := &EtcdClusterReconciler{Client: c, Scheme: scheme, Recorder: record.NewFakeRecorder(10)}
+	state := &clusterState{
+		leaderID: 1,
+		members:  []*etcdserverpb.Member{{ID: 1, Name: "etcd-0"}, {ID: 2, Name: "etcd-1"}, {ID: 3, Name: "etcd-2"}},
+		statuses: map[uint64]*clientv3.StatusResponse{1: {}, 2: {}, 3: {}},
+		errors:   map[uint64]string{},
+	}
+	return r, cluster, sts, state
+}
+
+// storedReplicas returns the replicas of the StatefulSet as stored in the API server.
+func storedReplicas(t *testing.T, r *EtcdClusterReconciler) int32 {
+	t.Helper()
+	var sts appsv1.StatefulSet
+	if err := r.Get(context.Background(), types.NamespacedName{Namespace: "default", Name: "etcd"}, &sts); err != nil {
+		t.Fatal(err)
+	}
+	return *sts.Spec.Replicas
+}
+
+// joinConfig returns the configuration written for a member.
+func joinConfig(t *testing.T, r *EtcdClusterReconciler, cluster *etcdv1alpha1.EtcdCluster, name string) string {
+	t.Helper()
+	cm, err := r.getMemberConfigMap(context.Background(), cluster)
+	if err != nil || cm == nil {
+		t.Fatalf("member configuration: %v", err)
+	}
+	return cm.Data[memberConfigKey(name)]
+}
+
+// orderedEtcdCluster checks that a member is added before its pod is created.
+type orderedEtcdCluster struct {
+	*fakeEtcdCluster
+	t *testing.T
+	r *EtcdClusterReconciler
+}
+
+func (f *orderedEtcdCluster) MemberAdd(ctx context.Context, peerURLs []string) (*clientv3.MemberAddResponse, error) {
+	if replicas := storedReplicas(f.t, f.r); replicas != 3 {
+		f.t.Errorf("StatefulSet scaled to %d before the member was added", replicas)
+	}
+	return f.fakeEtcdCluster.MemberAdd(ctx, peerURLs)
+}
+
+func TestScaleUpAddsMemberBeforePod(t *testing.T) {
+	r, cluster, sts, state := scaleUpFixture(t, 4)
+	etcd := &fakeEtcdCluster{members: state.members}
+	cli := &clientv3.Client{Cluster: &orderedEtcdCluster{fakeEtcdCluster: etcd, t: t, r: r}}
+
+	changed, err := r.reconcileMembers(context.Background(), cluster, sts, cli, state)
+	if err != nil || !changed {
+		t.Fatalf("changed %v, error %v", changed, err)
+	}
+	if len(etcd.added) != 1 || etcd.added[0] != memberPeerURL(cluster, "etcd-3") {
+		t.Fatalf("added %v, want etcd-3", etcd.added)
+	}
+	if replicas := storedReplicas(t, r); replicas != 4 {
+		t.Errorf("StatefulSet has %d replicas, want 4", replicas)
+	}
+	config := joinConfig(t, r, cluster, "etcd-3")
+	if !strings.Contains(config, "initial-cluster-state: existing") || !strings.Contains(config, "etcd-3=") {
+		t.Errorf("etcd-3 does not join the existing cluster:\n%s", config)
+	}
+
+	// 成员不健康的时候不加成员
+	r, cluster, sts, state = scaleUpFixture(t, 4)
+	delete(state.statuses, 2)
+	state.errors[2] = "context deadline exceeded"
+	etcd = &fakeEtcdCluster{members: state.members}
+	if changed, err := r.reconcileMembers(context.Background(), cluster, sts, &clientv3.Client{Cluster: etcd}, state); err != nil || changed {
+		t.Fatalf("changed %v, error %v", changed, err)
+	}
+	if len(etcd.added) > 0 {
+		t.Errorf("added %v while a member is unhealthy", etcd.added)
+	}
+}
+
+func TestScaleUpResumesAddedMember(t *testing.T) {
+	r, cluster, sts, state := scaleUpFixture(t, 4)
+	// 上一次调谐 add 了 etcd-3，但是没有扩容 statefulset
+	state.members = append(state.members, &etcdserverpb.Member{ID: 4, PeerURLs: []string{memberPeerURL(cluster, "etcd-3")}})
+	etcd := &fakeEtcdCluster{members: state.members}
+
+	changed, err := r.reconcileMembers(context.Background(), cluster, sts, &clientv3.Client{Cluster: etcd}, state)
+	if err != nil || !changed {
+		t.Fatalf("changed %v, error %v", changed, err)
+	}
+	if len(etcd.added) > 0 || len(etcd.removed) > 0 {
+		t.Fatalf("membership changed again: added %v, removed %v", etcd.added, etcd.removed)
+	}
+	if replicas := storedReplicas(t, r); replicas != 4 {
+		t.Errorf("StatefulSet has %d replicas, want 4", replicas)
+	}
+	if config := joinConfig(t, r, cluster, "etcd-3"); !strings.Contains(config, "etcd-3=") {
+		t.Errorf("etcd-3 is not in its own initial cluster:\n%s", config)
+	}
+}
+
+func TestRemoveMemberThatNeverStarted(t *testing.T) {
+	// size 又被调回 3，已经 add 的 etcd-3 不会再启动
+	r, cluster, sts, state := scaleUpFixture(t, 3)
+	state.members = append(state.members, &etcdserverpb.Member{ID: 4, PeerURLs: []string{memberPeerURL(cluster, "etcd-3")}})
+	etcd := &fakeEtcdCluster{members: state.members}
+
+	changed, err := r.reconcileMembers(context.Background(), cluster, sts, &clientv3.Client{Cluster: etcd}, state)
+	if err != nil || !changed {
+		t.Fatalf("changed %v, error %v", changed, err)
+	}
+	if len(etcd.removed) != 1 || etcd.removed[0] != 4 {
+		t.Errorf("removed %v, want the member of etcd-3", etcd.removed)
+	}
+	if replicas := storedReplicas(t, r); replicas != 3 {
+		t.Errorf("StatefulSet has %d replicas, want 3", replicas)
+	}
+}
@@ -0,0 +1,56 @@
+package controllers
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+)
+
+// Restore drill metrics are served by the manager next to the controller-runtime ones.
+var (
+	restoreTestRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "etcd_restore_test_runs_total",
+		Help: "Restore drills that finished, by result.",
+	}, []string{"namespace", "name", "result"})
+	restoreTestPassed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "etcd_restore_test_passed",
+		Help: "Whether the latest restore drill passed (1) or failed (0).",
+	}, []string{"namespace", "name"})
+	restoreTestDuration = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "etcd_restore_test_duration_seconds",
+		Help: "How long the latest restore drill took.",
+	}, []string{"namespace", "name"})
+	restoreTestLastPassed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "etcd_restore_test_last_passed_timestamp_seconds",
+		Help: "When a restore drill passed last, as a Unix timestamp.",
+	}, []string{"namespace", "name"})
+)
+
+func init() {
+	metrics.Registry.MustRegister(restoreTestRuns, restoreTestPassed, restoreTestDuration, restoreTestLastPassed)
+}
+
+// recordRestoreTestMetrics exports the outcome of a finished drill.
+func recordRestoreTestMetrics(test *etcdv1alpha1.EtcdRestoreTest, run *etcdv1alpha1.RestoreTestRun) {
+	restoreTestRuns.WithLabelValues(test.Namespace, test.Name, string(run.Result)).Inc()
+	passed := 0.0
+	if run.Result == etcdv1alpha1.RestoreTestPassed {
+		passed = 1
+		restoreTestLastPassed.WithLabelValues(test.Namespace, test.Name).Set(float64(run.CompletionTime.Unix()))
+	}
+	restoreTestPassed.WithLabelValues(test.Namespace, test.Name).Set(passed)
+	if run.Duration != nil {
+		restoreTestDuration.WithLabelValues(test.Namespace, test.Name).Set(run.Duration.Seconds())
+	}
+}
+
+// forgetRestoreTestMetrics drops the series of a deleted EtcdRestoreTest.
+func forgetRestoreTestMetrics(namespace, name string) {
+	for _, result := range []etcdv1alpha1.RestoreTestResult{etcdv1alpha1.RestoreTestPassed, etcdv1alpha1.RestoreTestFailed} {
+		restoreTestRuns.DeleteLabelValues(namespace, name, string(result))
+	}
+	restoreTestPassed.DeleteLabelValues(namespace, name)
+	restoreTestDuration.DeleteLabelValues(namespace, name)
+	restoreTestLastPassed.DeleteLabelValues(namespace, name)
+}
@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"time"
+)
+
+const (
+	defaultCAValidity   = 10 * 365 * 24 * time.Hour
+	defaultCertValidity = 365 * 24 * time.Hour
+)
+
+// keyPair is a PEM encoded certificate and private key.
+type keyPair struct {
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// parse decodes the certificate and key of a key pair.
+func (kp keyPair) parse() (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	cert, err := parseCertificate(kp.certPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, _ := pem.Decode(kp.keyPEM)
+	if keyBlock == nil {
+		return nil, nil, errors.New("no private key found in PEM data")
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// parseCertificate decodes the first certificate of a PEM bundle.
+func parseCertificate(certPEM []byte) (*x509.Certificate, error) {
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return nil, errors.New("no certificate found in PEM data")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// renewalTime returns when a certificate is due for renewal, after percent of its lifetime.
+func renewalTime(cert *x509.Certificate, percent int32) time.Time {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return cert.NotBefore.Add(lifetime * time.Duration(percent) / 100)
+}
+
+// newCA creates a self signed certificate authority.
+func newCA(commonName string, validity time.Duration) (keyPair, error) {
+	template := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: commonName},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	return createCertificate(template, nil, nil, validity)
+}
+
+// newSignedCert creates a certificate signed by ca for the given DNS names and IP addresses.
+func newSignedCert(ca keyPair, commonName string, dnsNames []string, ips []net.IP, usages []x509.ExtKeyUsage, validity time.Duration) (keyPair, error) {
+	caCert, caKey, err := ca.parse()
+	if err != nil {
+		return keyPair{}, err
+	}
+	template := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: commonName},
+		DNSNames:    dnsNames,
+		IPAddresses: ips,
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: usages,
+	}
+	return createCertificate(template, caCert, caKey, validity)
+}
+
+// createCertificate fills in the serial number and validity of template and signs it with
+// parent, or self signs it when parent is nil.
+func createCertificate(template, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, validity time.Duration) (keyPair, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return keyPair{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return keyPair{}, err
+	}
+	template.SerialNumber = serial
+	// 允许一点时钟偏差
+	template.NotBefore = time.Now().Add(-5 * time.Minute)
+	template.NotAfter = time.Now().Add(validity)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return keyPair{}, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return keyPair{}, err
+	}
+	return keyPair{
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}, nil
+}
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+)
+
+// QuiesceMemberAnnotation on an EtcdCluster names a member to stop, so that its data
+// volume can be snapshotted while nothing writes to it. Removing it starts the member again.
+var QuiesceMemberAnnotation = "etcd.gqq.com/quiesce-member"
+
+// maxQuiesceDuration is how long a member stays stopped at most, in case whoever
+// asked for it never removes the annotation.
+const maxQuiesceDuration = time.Hour
+
+// quiescedMember returns the member that is stopped and has to stay stopped.
+func quiescedMember(cluster *etcdv1alpha1.EtcdCluster) string {
+	q := cluster.Status.QuiescedMember
+	if q == nil || cluster.Annotations[QuiesceMemberAnnotation] != q.Name {
+		return ""
+	}
+	return q.Name
+}
+
+// reconcileQuiesce stops the member QuiesceMemberAnnotation names and starts it again
+// once the annotation is gone. The member is kept down by removing its configuration,
+// without which its pod cannot start etcd, and its pod is deleted. A leader hands
+// leadership over first, and no member is stopped when that would cost quorum. It
+// returns true while a member is stopped or its state changed, other member changes
+// wait until then.
+func (r *EtcdClusterReconciler) reconcileQuiesce(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, state *clusterState) (bool, error) {
+	want := cluster.Annotations[QuiesceMemberAnnotation]
+	if q := cluster.Status.QuiescedMember; q != nil {
+		if q.Name == want && time.Since(q.Since.Time) > maxQuiesceDuration {
+			patch := client.MergeFrom(cluster.DeepCopy())
+			delete(cluster.Annotations, QuiesceMemberAnnotation)
+			if err := r.Patch(ctx, cluster, patch); err != nil {
+				return false, err
+			}
+			r.Recorder.Eventf(cluster, corev1.EventTypeWarning, "QuiesceExpired",
+				"member %s was stopped for more than %s, starting it again", q.Name, maxQuiesceDuration)
+			// 下一轮先写回配置再启动
+			return true, nil
+		}
+		if q.Name == want {
+			return true, nil
+		}
+		// ensureMemberConfigs 已经把配置写回去了，重建 pod 让它马上启动
+		if err := r.deleteMemberPod(ctx, cluster, q.Name); err != nil {
+			return false, err
+		}
+		cluster.Status.QuiescedMember = nil
+		// 停机的时间不算在自动替换的阈值里
+		now := metav1.Now()
+		for i := range cluster.Status.Members {
+			if m := &cluster.Status.Members[i]; m.Name == q.Name && m.UnhealthySince != nil {
+				m.UnhealthySince = &now
+			}
+		}
+		r.Recorder.Eventf(cluster, corev1.EventTypeNormal, "MemberResumed", "started member %s again", q.Name)
+		return true, nil
+	}
+	if want == "" || state == nil {
+		return false, nil
+	}
+
+	logger := log.FromContext(ctx)
+	m := state.memberByName(cluster, want)
+	if m == nil || m.IsLearner {
+		logger.Info("not stopping a member that is not a voting member", "member", want)
+		return false, nil
+	}
+	healthy := state.healthyVoterCount()
+	if _, ok := state.statuses[m.ID]; ok {
+		healthy--
+	}
+	if healthy < quorum(state.voterCount()) {
+		logger.Info("not stopping a member, the cluster would lose quorum", "member", want)
+		return false, nil
+	}
+	if m.ID == state.leaderID {
+		if err := r.transferLeadership(ctx, cluster, state, m.ID); err != nil {
+			return false, fmt.Errorf("transfer leadership away from %s: %w", want, err)
+		}
+		return true, nil
+	}
+	if err := r.deleteMemberConfig(ctx, cluster, want); err != nil {
+		return false, err
+	}
+	if err := r.deleteMemberPod(ctx, cluster, want); err != nil {
+		return false, err
+	}
+	cluster.Status.QuiescedMember = &etcdv1alpha1.QuiescedMemberStatus{Name: want, Since: metav1.Now()}
+	r.Recorder.Eventf(cluster, corev1.EventTypeNormal, "MemberQuiesced", "stopped member %s for a volume snapshot", want)
+	return true, nil
+}
@@ -0,0 +1,468 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// ApproveQuorumRecoveryAnnotation approves a planned quorum recovery when it is set to
+// Status.QuorumRecovery.ID. Nothing is deleted before it is set.
+var ApproveQuorumRecoveryAnnotation = "etcd.gqq.com/approve-quorum-recovery"
+
+// defaultQuorumLossThreshold is used when Spec.QuorumRecovery.LossThreshold is not set.
+const defaultQuorumLossThreshold = 5 * time.Minute
+
+func quorumRecoveryEnabled(cluster *etcdv1alpha1.EtcdCluster) bool {
+	return cluster.Spec.QuorumRecovery != nil && cluster.Spec.QuorumRecovery.Enabled
+}
+
+func quorumLossThreshold(cluster *etcdv1alpha1.EtcdCluster) time.Duration {
+	if cluster.Spec.QuorumRecovery.LossThreshold != nil {
+		return cluster.Spec.QuorumRecovery.LossThreshold.Duration
+	}
+	return defaultQuorumLossThreshold
+}
+
+// quorumLost reports whether a cluster that formed once can no longer commit writes.
+// state is nil when the members could not be listed, which needs quorum as well.
+func quorumLost(cluster *etcdv1alpha1.EtcdCluster, sts *appsv1.StatefulSet, state *clusterState) bool {
+	if cluster.Status.ClusterID == "" || *sts.Spec.Replicas == 0 {
+		return false
+	}
+	if state == nil {
+		return true
+	}
+	return state.healthyVoterCount() < quorum(state.voterCount())
+}
+
+// memberProbe is the raft progress a member reported.
+type memberProbe struct {
+	name      string
+	raftTerm  uint64
+	raftIndex uint64
+}
+
+// probeMembers asks every member for its status, one endpoint at a time. Unlike the
+// member list, the status of a member is served without quorum.
+func probeMembers(ctx context.Context, cli *clientv3.Client, cluster *etcdv1alpha1.EtcdCluster, replicas int32) []memberProbe {
+	var probes []memberProbe
+	for i := 0; i < int(replicas); i++ {
+		name := memberName(cluster, i)
+		statusCtx, cancel := withEtcdTimeout(ctx)
+		st, err := cli.Status(statusCtx, memberClientURL(cluster, name))
+		cancel()
+		if err != nil || len(st.Errors) > 0 {
+			continue
+		}
+		probes = append(probes, memberProbe{name: name, raftTerm: st.RaftTerm, raftIndex: st.RaftIndex})
+	}
+	return probes
+}
+
+// pickSurvivor returns the member that holds the most of the raft log, preferring the
+// later term and then the first probe on a tie. It returns nil when no member answered.
+func pickSurvivor(probes []memberProbe) *memberProbe {
+	var best *memberProbe
+	for i := range probes {
+		p := &probes[i]
+		if best == nil || p.raftIndex > best.raftIndex || (p.raftIndex == best.raftIndex && p.raftTerm > best.raftTerm) {
+			best = p
+		}
+	}
+	return best
+}
+
+// recoveryID identifies a recovery plan. It changes whenever the plan does.
+func recoveryID(status *etcdv1alpha1.QuorumRecoveryStatus) string {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%d/%s/%s", status.LostSince.Unix(), status.Member, status.Backup)
+	return rand.SafeEncodeString(fmt.Sprint(h.Sum32()))
+}
+
+// quorumRecoveryInProgress reports whether an approved recovery is running. It has to
+// go on while no member answers: the recovery from a backup stops every member, and
+// there is no client for a StatefulSet scaled to zero.
+func quorumRecoveryInProgress(cluster *etcdv1alpha1.EtcdCluster) bool {
+	status := cluster.Status.QuorumRecovery
+	return status != nil && status.Phase == etcdv1alpha1.QuorumRecoveryPhaseRecovering
+}
+
+// reconcileQuorumRecovery detects a sustained loss of quorum, plans a recovery and,
+// once the plan is approved, rebuilds the cluster around a single member. It returns
+// true while a recovery is in progress, in which case it owns the membership, and
+// whether it changed something. cli is nil when no member can be dialed, which only
+// a recovery in progress is called with.
+func (r *EtcdClusterReconciler) reconcileQuorumRecovery(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, cli *clientv3.Client, state *clusterState) (bool, bool, error) {
+	status := cluster.Status.QuorumRecovery
+	if quorumRecoveryInProgress(cluster) {
+		changed, err := r.recoverQuorum(ctx, cluster, sts, cli, state)
+		return true, changed, err
+	}
+	if !quorumRecoveryEnabled(cluster) || !quorumLost(cluster, sts, state) {
+		// quorum 恢复了，放弃还没有批准的计划
+		if status != nil && status.Phase != etcdv1alpha1.QuorumRecoveryPhaseCompleted &&
+			status.Phase != etcdv1alpha1.QuorumRecoveryPhaseFailed {
+			cluster.Status.QuorumRecovery = nil
+		}
+		return false, false, nil
+	}
+
+	now := metav1.Now()
+	if status == nil || status.Phase == etcdv1alpha1.QuorumRecoveryPhaseCompleted ||
+		status.Phase == etcdv1alpha1.QuorumRecoveryPhaseFailed {
+		status = &etcdv1alpha1.QuorumRecoveryStatus{
+			Phase:     etcdv1alpha1.QuorumRecoveryPhaseDetected,
+			LostSince: &now,
+		}
+		cluster.Status.QuorumRecovery = status
+		r.Recorder.Event(cluster, corev1.EventTypeWarning, "QuorumLost", "the cluster lost quorum")
+	}
+	threshold := quorumLossThreshold(cluster)
+	if now.Sub(status.LostSince.Time) < threshold {
+		status.Message = fmt.Sprintf("quorum lost since %s, a recovery is planned once it has been lost for %s",
+			status.LostSince.UTC().Format(time.RFC3339), threshold)
+		return false, false, nil
+	}
+
+	if err := r.planQuorumRecovery(ctx, cluster, sts, cli); err != nil {
+		return false, false, err
+	}
+	if status.Phase != etcdv1alpha1.QuorumRecoveryPhaseAwaitingApproval {
+		return false, false, nil
+	}
+	setCondition(cluster, etcdv1alpha1.ConditionDegraded, metav1.ConditionTrue, etcdv1alpha1.ReasonQuorumRecoveryPending, status.Message)
+	if cluster.Annotations[ApproveQuorumRecoveryAnnotation] != status.ID {
+		return false, false, nil
+	}
+
+	log.FromContext(ctx).Info("starting approved quorum recovery", "id", status.ID, "member", status.Member, "backup", status.Backup)
+	status.Phase = etcdv1alpha1.QuorumRecoveryPhaseRecovering
+	status.StartTime = &now
+	status.Message = ""
+	r.Recorder.Eventf(cluster, corev1.EventTypeWarning, "QuorumRecoveryStarted", "recovery %s was approved", status.ID)
+	changed, err := r.recoverQuorum(ctx, cluster, sts, cli, state)
+	return true, changed, err
+}
+
+// planQuorumRecovery picks what the cluster is rebuilt from and asks for approval.
+func (r *EtcdClusterReconciler) planQuorumRecovery(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, cli *clientv3.Client) error {
+	status := cluster.Status.QuorumRecovery
+	status.Member, status.RaftIndex, status.Backup = "", 0, ""
+	if cluster.Spec.QuorumRecovery.Source != etcdv1alpha1.QuorumRecoveryFromBackup {
+		if survivor := pickSurvivor(probeMembers(ctx, cli, cluster, *sts.Spec.Replicas)); survivor != nil {
+			status.Member, status.RaftIndex = survivor.name, survivor.raftIndex
+		}
+	}
+	if status.Member == "" {
+		latest, err := latestBackup(ctx, r.Client, cluster.Namespace, cluster.Name)
+		if err != nil {
+			return err
+		}
+		if latest != nil {
+			status.Backup = latest.Name
+		}
+	}
+
+	var plan string
+	switch {
+	case status.Member != "":
+		plan = fmt.Sprintf("rebuild the cluster from member %s at raft index %d with --force-new-cluster, deleting the data of every other member",
+			status.Member, status.RaftIndex)
+	case status.Backup != "" && r.AgentImage == "":
+		status.Phase, status.ID = etcdv1alpha1.QuorumRecoveryPhaseDetected, ""
+		status.Message = fmt.Sprintf("cannot restore EtcdBackup %s, the operator was started without --agent-image", status.Backup)
+		return nil
+	case status.Backup != "":
+		plan = fmt.Sprintf("restore EtcdBackup %s into a single member cluster, deleting the data of every member", status.Backup)
+	default:
+		status.Phase, status.ID = etcdv1alpha1.QuorumRecoveryPhaseDetected, ""
+		status.Message = "no member answers and the cluster has no completed EtcdBackup to restore"
+		return nil
+	}
+
+	id := recoveryID(status)
+	if status.Phase == etcdv1alpha1.QuorumRecoveryPhaseAwaitingApproval && status.ID == id {
+		return nil
+	}
+	status.Phase, status.ID = etcdv1alpha1.QuorumRecoveryPhaseAwaitingApproval, id
+	status.Message = fmt.Sprintf("set the annotation %s=%s to %s", ApproveQuorumRecoveryAnnotation, id, plan)
+	r.Recorder.Event(cluster, corev1.EventTypeWarning, "QuorumRecoveryPlanned", status.Message)
+	return nil
+}
+
+// latestBackup returns the completed EtcdBackup of the cluster that finished last, or nil.
+func latestBackup(ctx context.Context, c client.Reader, namespace, cluster string) (*etcdv1alpha1.EtcdBackup, error) {
+	var backups etcdv1alpha1.EtcdBackupList
+	if err := c.List(ctx, &backups, client.InNamespace(namespace)); err != nil {
+		return nil, err
+	}
+	var latest *etcdv1alpha1.EtcdBackup
+	for i := range backups.Items {
+		b := &backups.Items[i]
+		if b.Spec.ClusterName != cluster || b.Status.Phase != etcdv1alpha1.BackupPhaseCompleted ||
+			b.Status.CompletionTime == nil || b.DeletionTimestamp != nil {
+			continue
+		}
+		if latest == nil || latest.Status.CompletionTime.Before(b.Status.CompletionTime) {
+			latest = b
+		}
+	}
+	return latest, nil
+}
+
+// recoverQuorum takes the next step of an approved recovery. It returns true when it changed something.
+func (r *EtcdClusterReconciler) recoverQuorum(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, cli *clientv3.Client, state *clusterState) (bool, error) {
+	status := cluster.Status.QuorumRecovery
+	var changed bool
+	var err error
+	if status.Member != "" {
+		changed, err = r.recoverFromMember(ctx, cluster, sts, cli, state)
+	} else {
+		changed, err = r.recoverFromBackup(ctx, cluster, sts, state)
+	}
+	if status.Phase == etcdv1alpha1.QuorumRecoveryPhaseRecovering {
+		msg := "recovering quorum, step " + status.Step
+		if status.Message != "" {
+			msg += ": " + status.Message
+		}
+		setCondition(cluster, etcdv1alpha1.ConditionProgressing, metav1.ConditionTrue, etcdv1alpha1.ReasonRecoveringQuorum, msg)
+	}
+	return changed, err
+}
+
+// recoverFromMember restarts the surviving member with --force-new-cluster, so that
+// it forms a cluster of its own with all of its data, and adds the other members back
+// with empty volumes one at a time.
+func (r *EtcdClusterReconciler) recoverFromMember(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, cli *clientv3.Client, state *clusterState) (bool, error) {
+	status := cluster.Status.QuorumRecovery
+	survivor := status.Member
+	switch status.Step {
+	case "":
+		// 先删除其他成员的配置和数据，它们重新启动后只能以 existing 的方式加入
+		for i := 0; i < int(*sts.Spec.Replicas); i++ {
+			name := memberName(cluster, i)
+			if name == survivor {
+				continue
+			}
+			if err := r.deleteMemberConfig(ctx, cluster, name); err != nil {
+				return false, err
+			}
+			if err := r.deleteMemberVolume(ctx, cluster, name); err != nil {
+				return false, err
+			}
+			if err := r.deleteMemberPod(ctx, cluster, name); err != nil {
+				return false, err
+			}
+		}
+		config := newMemberConfig(cluster, survivor, []string{survivor}, initialClusterStateExisting)
+		config.ForceNewCluster = true
+		if err := r.writeMemberConfigs(ctx, cluster, config); err != nil {
+			return false, err
+		}
+		if err := r.deleteMemberPod(ctx, cluster, survivor); err != nil {
+			return false, err
+		}
+		r.recordRecoveryStep(cluster, etcdv1alpha1.QuorumRecoveryStepForceNewCluster,
+			fmt.Sprintf("deleted the data of every member but %s and restarted it with --force-new-cluster", survivor))
+		return true, nil
+
+	case etcdv1alpha1.QuorumRecoveryStepForceNewCluster:
+		if state == nil || len(state.members) != 1 || state.members[0].Name != survivor || !state.allHealthy() {
+			status.Message = fmt.Sprintf("waiting for member %s to come back as a single member cluster", survivor)
+			return false, nil
+		}
+		// 必须去掉 force-new-cluster，否则成员每次重启都会丢掉其他成员
+		if err := r.writeMemberConfigs(ctx, cluster, newMemberConfig(cluster, survivor, []string{survivor}, initialClusterStateExisting)); err != nil {
+			return false, err
+		}
+		r.recordRecoveryStep(cluster, etcdv1alpha1.QuorumRecoveryStepGrowing,
+			fmt.Sprintf("member %s runs as a single member cluster, adding the other members back", survivor))
+		return true, nil
+
+	default:
+		return r.growRecoveredCluster(ctx, cluster, sts, cli, state)
+	}
+}
+
+// growRecoveredCluster adds the members the recovery dropped back one at a time, and
+// completes the recovery once every ordinal of the StatefulSet is a healthy member.
+func (r *EtcdClusterReconciler) growRecoveredCluster(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, cli *clientv3.Client, state *clusterState) (bool, error) {
+	status := cluster.Status.QuorumRecovery
+	if state == nil {
+		status.Message = "waiting for the recovered cluster to answer"
+		return false, nil
+	}
+	for i := 0; i < int(*sts.Spec.Replicas); i++ {
+		if err := r.recreateStuckPod(ctx, cluster, memberName(cluster, i)); err != nil {
+			return false, err
+		}
+	}
+	if learners := state.learners(); len(learners) > 0 {
+		return r.promoteLearners(ctx, cluster, cli, state, learners)
+	}
+	if !state.allHealthy() {
+		status.Message = "waiting for every member to be healthy before adding the next one"
+		return false, nil
+	}
+	for i := 0; i < int(*sts.Spec.Replicas); i++ {
+		name := memberName(cluster, i)
+		if state.memberByName(cluster, name) != nil {
+			continue
+		}
+		status.Message = fmt.Sprintf("adding member %s", name)
+		return true, r.replaceMember(ctx, cluster, cli, name, nil)
+	}
+	r.completeQuorumRecovery(cluster)
+	return false, nil
+}
+
+// recoverFromBackup stops every member, deletes their volumes, restores the backup
+// into the volume of the first member and starts it as a single member cluster. The
+// usual scale up takes it back to Spec.Size from there.
+func (r *EtcdClusterReconciler) recoverFromBackup(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, state *clusterState) (bool, error) {
+	status := cluster.Status.QuorumRecovery
+	first := memberName(cluster, 0)
+	switch status.Step {
+	case "":
+		if err := r.scaleStatefulSet(ctx, sts, 0); err != nil {
+			return false, err
+		}
+		r.recordRecoveryStep(cluster, etcdv1alpha1.QuorumRecoveryStepStopping,
+			fmt.Sprintf("stopping every member to restore EtcdBackup %s", status.Backup))
+		return true, nil
+
+	case etcdv1alpha1.QuorumRecoveryStepStopping:
+		pods, err := r.listMemberPods(ctx, cluster)
+		if err != nil {
+			return false, err
+		}
+		if len(pods) > 0 {
+			status.Message = fmt.Sprintf("waiting for %d pods to stop", len(pods))
+			return false, nil
+		}
+		// statefulset 创建的 pvc 带有 selector 的 label
+		selector := client.MatchingLabels{EtcdClusterLabelKey: cluster.Name}
+		if err := r.DeleteAllOf(ctx, &corev1.PersistentVolumeClaim{}, client.InNamespace(cluster.Namespace), selector); err != nil {
+			return false, err
+		}
+		var pvcs corev1.PersistentVolumeClaimList
+		if err := r.List(ctx, &pvcs, client.InNamespace(cluster.Namespace), selector); err != nil {
+			return false, err
+		}
+		if len(pvcs.Items) > 0 {
+			status.Message = fmt.Sprintf("waiting for %d member volumes to be deleted", len(pvcs.Items))
+			return false, nil
+		}
+		r.recordRecoveryStep(cluster, etcdv1alpha1.QuorumRecoveryStepRestoring,
+			fmt.Sprintf("deleted the data of every member, restoring EtcdBackup %s into member %s", status.Backup, first))
+		return true, nil
+
+	case etcdv1alpha1.QuorumRecoveryStepRestoring:
+		var etcdbackup etcdv1alpha1.EtcdBackup
+		err := r.Get(ctx, types.NamespacedName{Namespace: cluster.Namespace, Name: status.Backup}, &etcdbackup)
+		if apierrors.IsNotFound(err) {
+			r.failQuorumRecovery(cluster, fmt.Sprintf("EtcdBackup %s was deleted", status.Backup))
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		source := &snapshotSource{
+			dest:   &etcdbackup.Spec.Destination,
+			path:   etcdbackup.Status.Path,
+			sha256: etcdbackup.Status.SHA256,
+		}
+		seeder := &memberSeeder{
+			Client:     r.Client,
+			scheme:     r.Scheme,
+			image:      r.AgentImage,
+			owner:      cluster,
+			name:       fmt.Sprintf("%s-recovery-%s", cluster.Name, status.ID),
+			cluster:    cluster,
+			token:      fmt.Sprintf("%s-%s", cluster.UID, status.ID),
+			sourceArgs: source.args,
+			dataSource: source.dataSource(),
+		}
+		seeded, result, failure, err := seeder.seed(ctx, 1)
+		if err != nil {
+			return false, err
+		}
+		if failure != "" {
+			if err := seeder.cleanup(ctx); err != nil {
+				return false, err
+			}
+			r.failQuorumRecovery(cluster, failure)
+			return false, nil
+		}
+		if seeded < 1 {
+			status.Message = fmt.Sprintf("restoring EtcdBackup %s into member %s", status.Backup, first)
+			return false, nil
+		}
+		// 数据目录里已经有成员信息，配置只需要包含这个成员
+		if err := r.writeMemberConfigs(ctx, cluster, newMemberConfig(cluster, first, []string{first}, initialClusterStateNew)); err != nil {
+			return false, err
+		}
+		if err := r.scaleStatefulSet(ctx, sts, 1); err != nil {
+			return false, err
+		}
+		r.recordRecoveryStep(cluster, etcdv1alpha1.QuorumRecoveryStepGrowing,
+			fmt.Sprintf("restored EtcdBackup %s at revision %d, starting member %s", status.Backup, result.Revision, first))
+		return true, nil
+
+	default:
+		if state == nil || len(state.members) != 1 || !state.allHealthy() {
+			status.Message = fmt.Sprintf("waiting for member %s to start", first)
+			return false, nil
+		}
+		r.completeQuorumRecovery(cluster)
+		return false, nil
+	}
+}
+
+// recordRecoveryStep moves the recovery to the next step and records an Event.
+func (r *EtcdClusterReconciler) recordRecoveryStep(cluster *etcdv1alpha1.EtcdCluster, step, message string) {
+	status := cluster.Status.QuorumRecovery
+	status.Step = step
+	status.Message = ""
+	r.Recorder.Event(cluster, corev1.EventTypeWarning, "QuorumRecovery"+step, message)
+}
+
+func (r *EtcdClusterReconciler) completeQuorumRecovery(cluster *etcdv1alpha1.EtcdCluster) {
+	status := cluster.Status.QuorumRecovery
+	now := metav1.Now()
+	status.Phase = etcdv1alpha1.QuorumRecoveryPhaseCompleted
+	status.Step = ""
+	status.Message = ""
+	status.CompletionTime = &now
+	r.Recorder.Event(cluster, corev1.EventTypeNormal, "QuorumRecovered", "the cluster has quorum again")
+}
+
+func (r *EtcdClusterReconciler) failQuorumRecovery(cluster *etcdv1alpha1.EtcdCluster, msg string) {
+	status := cluster.Status.QuorumRecovery
+	now := metav1.Now()
+	status.Phase = etcdv1alpha1.QuorumRecoveryPhaseFailed
+	status.Message = msg
+	status.CompletionTime = &now
+	setCondition(cluster, etcdv1alpha1.ConditionProgressing, metav1.ConditionFalse, etcdv1alpha1.ReasonQuorumRecoveryFailed, msg)
+	setCondition(cluster, etcdv1alpha1.ConditionDegraded, metav1.ConditionTrue, etcdv1alpha1.ReasonQuorumRecoveryFailed, msg)
+	r.Recorder.Event(cluster, corev1.EventTypeWarning, "QuorumRecoveryFailed", msg)
+}
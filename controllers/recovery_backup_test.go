@@ -0,0 +1,115 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+)
+
+func TestRecoverFromBackupWithoutClient(t *testing.T) {
+	ctx := context.Background()
+	scheme := runtime.NewScheme()
+	_ = clientgoscheme.AddToScheme(scheme)
+	_ = etcdv1alpha1.AddToScheme(scheme)
+
+	size := int32(3)
+	cluster := &etcdv1alpha1.EtcdCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "etcd", Namespace: "default", UID: "uid"},
+		Spec:       etcdv1alpha1.EtcdClusterSpec{Size: &size, Image: "quay.io/coreos/etcd:v3.5.1"},
+	}
+	cluster.Status.QuorumRecovery = &etcdv1alpha1.QuorumRecoveryStatus{
+		Phase:  etcdv1alpha1.QuorumRecoveryPhaseRecovering,
+		ID:     "1",
+		Backup: "etcd-backup",
+	}
+	sts := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "etcd", Namespace: "default"}}
+	sts.Spec.Replicas = &size
+	etcdbackup := &etcdv1alpha1.EtcdBackup{
+		ObjectMeta: metav1.ObjectMeta{Name: "etcd-backup", Namespace: "default"},
+		Spec: etcdv1alpha1.EtcdBackupSpec{
+			ClusterName: "etcd",
+			Destination: etcdv1alpha1.BackupDestination{PVC: &etcdv1alpha1.PVCDestination{ClaimName: "backups"}},
+		},
+		Status: etcdv1alpha1.EtcdBackupStatus{Phase: etcdv1alpha1.BackupPhaseCompleted, Path: "etcd-backup.db"},
+	}
+	pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "etcd-0", Namespace: "default",
+		Labels: map[string]string{EtcdClusterLabelKey: "etcd"}}}
+	c := fake.NewClientBuilder().WithScheme(scheme).WithObjects(cluster.DeepCopy(), sts, etcdbackup, pod).Build()
+	r := &EtcdClusterReconciler{Client: c, Scheme: scheme, Recorder: record.NewFakeRecorder(100), AgentImage: "agent"}
+	status := cluster.Status.QuorumRecovery
+
+	// 没有 client 也没有 state，每一步都不需要 etcd
+	step := func(want string) {
+		t.Helper()
+		recovering, _, err := r.reconcileQuorumRecovery(ctx, cluster, sts, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !recovering || status.Step != want {
+			t.Fatalf("recovering %v at step %q, want step %q: %s", recovering, status.Step, want, status.Message)
+		}
+	}
+	if !quorumRecoveryInProgress(cluster) {
+		t.Fatal("recovery is not in progress")
+	}
+	step(etcdv1alpha1.QuorumRecoveryStepStopping)
+	if *sts.Spec.Replicas != 0 {
+		t.Fatalf("StatefulSet has %d replicas, want 0", *sts.Spec.Replicas)
+	}
+	step(etcdv1alpha1.QuorumRecoveryStepStopping)
+	if err := c.Delete(ctx, pod); err != nil {
+		t.Fatal(err)
+	}
+	step(etcdv1alpha1.QuorumRecoveryStepRestoring)
+	step(etcdv1alpha1.QuorumRecoveryStepRestoring)
+
+	// restore job 完成
+	var jobs batchv1.JobList
+	if err := c.List(ctx, &jobs, client.InNamespace("default")); err != nil || len(jobs.Items) != 1 {
+		t.Fatalf("restore jobs: %v, %v", jobs.Items, err)
+	}
+	job := &jobs.Items[0]
+	job.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: corev1.ConditionTrue}}
+	if err := c.Status().Update(ctx, job); err != nil {
+		t.Fatal(err)
+	}
+	agentPod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: job.Name + "-abc", Namespace: "default",
+		Labels: map[string]string{"job-name": job.Name}}}
+	agentPod.Status.Phase = corev1.PodSucceeded
+	agentPod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: agentContainerName,
+		State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{Message: `{"revision":42}`}}}}
+	if err := c.Create(ctx, agentPod); err != nil {
+		t.Fatal(err)
+	}
+	step(etcdv1alpha1.QuorumRecoveryStepGrowing)
+	var updated appsv1.StatefulSet
+	if err := c.Get(ctx, types.NamespacedName{Namespace: "default", Name: "etcd"}, &updated); err != nil || *updated.Spec.Replicas != 1 {
+		t.Fatalf("StatefulSet was not scaled to the restored member: %v", err)
+	}
+
+	step(etcdv1alpha1.QuorumRecoveryStepGrowing)
+	state := &clusterState{
+		members:  []*etcdserverpb.Member{{ID: 1, Name: "etcd-0"}},
+		statuses: map[uint64]*clientv3.StatusResponse{1: {}},
+		errors:   map[uint64]string{},
+	}
+	if _, _, err := r.reconcileQuorumRecovery(ctx, cluster, sts, nil, state); err != nil {
+		t.Fatal(err)
+	}
+	if status.Phase != etcdv1alpha1.QuorumRecoveryPhaseCompleted {
+		t.Errorf("recovery is %s, want Completed: %s", status.Phase, status.Message)
+	}
+}
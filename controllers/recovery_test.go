@@ -0,0 +1,22 @@
+package controllers
+
+import "testing"
+
+func TestPickSurvivorPrefersLongestLog(t *testing.T) {
+	if s := pickSurvivor(nil); s != nil {
+		t.Errorf("picked %s without probes", s.name)
+	}
+	probes := []memberProbe{
+		{name: "etcd-0", raftTerm: 3, raftIndex: 90},
+		{name: "etcd-1", raftTerm: 3, raftIndex: 120},
+		{name: "etcd-2", raftTerm: 4, raftIndex: 120},
+	}
+	if s := pickSurvivor(probes); s.name != "etcd-2" {
+		t.Errorf("picked %s, want etcd-2", s.name)
+	}
+	// 完全相同的时候取第一个
+	probes[2].raftTerm = 3
+	if s := pickSurvivor(probes); s.name != "etcd-1" {
+		t.Errorf("picked %s, want etcd-1", s.name)
+	}
+}
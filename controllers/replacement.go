@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+const (
+	// defaultUnhealthyThreshold is used when Spec.MemberReplacement.UnhealthyThreshold is not set.
+	defaultUnhealthyThreshold = 5 * time.Minute
+	// maxReplacementHistory bounds Status.ReplacementHistory.
+	maxReplacementHistory = 20
+)
+
+func replacementEnabled(cluster *etcdv1alpha1.EtcdCluster) bool {
+	return cluster.Spec.MemberReplacement != nil && cluster.Spec.MemberReplacement.Enabled
+}
+
+func unhealthyThreshold(cluster *etcdv1alpha1.EtcdCluster) time.Duration {
+	if cluster.Spec.MemberReplacement.UnhealthyThreshold != nil {
+		return cluster.Spec.MemberReplacement.UnhealthyThreshold.Duration
+	}
+	return defaultUnhealthyThreshold
+}
+
+// reconcileReplacement replaces at most one member that has been unhealthy for longer than
+// the configured threshold. It also finishes replacements that were interrupted after the
+// old member had been removed. It returns true when it changed the membership.
+func (r *EtcdClusterReconciler) reconcileReplacement(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, cli *clientv3.Client, state *clusterState) (bool, error) {
+	if !replacementEnabled(cluster) {
+		return false, nil
+	}
+	replicas := int(*sts.Spec.Replicas)
+	if replicas > int(*cluster.Spec.Size) {
+		// 缩容的时候最后一个成员是故意删除的
+		replicas--
+	}
+
+	unhealthySince := map[string]*metav1.Time{}
+	for _, ms := range cluster.Status.Members {
+		unhealthySince[ms.ID] = ms.UnhealthySince
+	}
+
+	for i := 0; i < replicas; i++ {
+		name := memberName(cluster, i)
+		if err := r.recreateStuckPod(ctx, cluster, name); err != nil {
+			return false, err
+		}
+
+		m := state.memberByName(cluster, name)
+		if m == nil {
+			return true, r.replaceMember(ctx, cluster, cli, name, nil)
+		}
+		since := unhealthySince[fmt.Sprintf("%x", m.ID)]
+		if since == nil || time.Since(since.Time) < unhealthyThreshold(cluster) {
+			continue
+		}
+
+		// 删除这个成员之后剩下的成员必须还能组成 quorum
+		voters := state.voterCount()
+		if !m.IsLearner {
+			voters--
+		}
+		if state.healthyVoterCount() < quorum(voters) {
+			log.FromContext(ctx).Info("not replacing unhealthy member, the cluster would lose quorum", "member", name)
+			return false, nil
+		}
+		return true, r.replaceMember(ctx, cluster, cli, name, m)
+	}
+	return false, nil
+}
+
+// replaceMember removes the old member, deletes its volume and pod, and adds a fresh member
+// with the same name. old is nil when the old member has already been removed.
+func (r *EtcdClusterReconciler) replaceMember(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	cli *clientv3.Client, name string, old *etcdserverpb.Member) error {
+	log.FromContext(ctx).Info("replacing etcd member", "member", name)
+	if old != nil {
+		removeCtx, cancel := withEtcdTimeout(ctx)
+		_, err := cli.MemberRemove(removeCtx, old.ID)
+		cancel()
+		if err != nil {
+			return fmt.Errorf("remove member %s: %w", name, err)
+		}
+		r.recordReplacement(cluster, name, etcdv1alpha1.ReplacementStepRemoved, old.ID,
+			"removed member that stayed unhealthy for longer than the threshold")
+	}
+
+	// 数据目录已经没用了，删掉 pvc 和 pod，statefulset 会用新的 pvc 重建 pod
+	if err := r.deleteMemberVolume(ctx, cluster, name); err != nil {
+		return err
+	}
+	if err := r.deleteMemberPod(ctx, cluster, name); err != nil {
+		return err
+	}
+	r.recordReplacement(cluster, name, etcdv1alpha1.ReplacementStepVolumeDeleted, 0, "deleted the data volume and pod")
+
+	resp, err := memberAdd(ctx, cluster, cli, name)
+	if err != nil {
+		return fmt.Errorf("add member %s: %w", name, err)
+	}
+	if err := r.writeJoinConfig(ctx, cluster, name, resp.Members); err != nil {
+		return err
+	}
+	r.recordReplacement(cluster, name, etcdv1alpha1.ReplacementStepAdded, resp.Member.ID, "added a fresh member")
+	return nil
+}
+
+// recordReplacement records a replacement step as an Event and in the status history.
+func (r *EtcdClusterReconciler) recordReplacement(cluster *etcdv1alpha1.EtcdCluster, name, step string, id uint64, message string) {
+	record := etcdv1alpha1.MemberReplacementRecord{
+		Time:    metav1.Now(),
+		Member:  name,
+		Step:    step,
+		Message: message,
+	}
+	if id != 0 {
+		record.MemberID = fmt.Sprintf("%x", id)
+	}
+	history := append(cluster.Status.ReplacementHistory, record)
+	if len(history) > maxReplacementHistory {
+		history = history[len(history)-maxReplacementHistory:]
+	}
+	cluster.Status.ReplacementHistory = history
+	r.Recorder.Eventf(cluster, corev1.EventTypeWarning, "MemberReplacement"+step, "member %s: %s", name, message)
+}
+
+func (r *EtcdClusterReconciler) deleteMemberPod(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, name string) error {
+	var pod corev1.Pod
+	pod.Namespace = cluster.Namespace
+	pod.Name = name
+	if err := r.Delete(ctx, &pod); err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// recreateStuckPod deletes a pending pod whose volume was deleted underneath it. The
+// StatefulSet controller only creates volumes when it creates a pod, so such a pod
+// would otherwise wait for its volume forever.
+func (r *EtcdClusterReconciler) recreateStuckPod(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, name string) error {
+	var pvc corev1.PersistentVolumeClaim
+	err := r.Get(ctx, types.NamespacedName{Namespace: cluster.Namespace, Name: memberVolumeName(name)}, &pvc)
+	if err == nil || !apierrors.IsNotFound(err) {
+		return err
+	}
+	var pod corev1.Pod
+	err = r.Get(ctx, types.NamespacedName{Namespace: cluster.Namespace, Name: name}, &pod)
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if pod.Status.Phase != corev1.PodPending || pod.DeletionTimestamp != nil {
+		return nil
+	}
+	log.FromContext(ctx).Info("recreating pod whose volume was deleted", "pod", name)
+	return r.Delete(ctx, &pod)
+}
@@ -1,116 +1,25 @@
 package controllers
 
 import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+
 	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
 	appsv1 "k8s.io/api/apps/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"strconv"
+	"k8s.io/apimachinery/pkg/util/rand"
 )
 
 var (
 	EtcdClusterLabelKey       = "etcd.gqq.com"
 	EtcdClusterCommonLabelKey = "app"
 	EtcdDataDirName           = "datadir"
-	commmdShell               = `
-            HOSTNAME=$(hostname)
-            ETCDCTL_API=3
-            eps() {
-                EPS=""
-                for i in $(seq 0 $((${INITIAL_CLUSTER_SIZE} - 1))); do
-                    EPS="${EPS}${EPS:+,}http://${SET_NAME}-${i}.${SET_NAME}.${MY_NAMESPACE}.svc.cluster.local:2379"
-                done
-                echo ${EPS}
-            }
-            member_hash() {
-                etcdctl member list | grep -w "$HOSTNAME" | awk '{ print $1}' | awk -F "," '{ print $1}'
-            }
-            initial_peers() {
-                PEERS=""
-                for i in $(seq 0 $((${INITIAL_CLUSTER_SIZE} - 1))); do
-                  PEERS="${PEERS}${PEERS:+,}${SET_NAME}-${i}=http://${SET_NAME}-${i}.${SET_NAME}.${MY_NAMESPACE}.svc.cluster.local:2380"
-                done
-                echo ${PEERS}
-            }
-            # etcd-SET_ID
-            SET_ID=${HOSTNAME##*-}
-            echo " set id is ${SET_ID}"
-            # adding a new member to existing cluster (assuming all initial pods are available)
-            if [ "${SET_ID}" -ge ${INITIAL_CLUSTER_SIZE} ]; then
-                # export ETCDCTL_ENDPOINTS=$(eps)
-                # member already added?
-                MEMBER_HASH=$(member_hash)
-                if [ -n "${MEMBER_HASH}" ]; then
-                    # the member hash exists but for some reason etcd failed
-                    # as the datadir has not be created, we can remove the member
-                    # and retrieve new hash
-                    echo "Remove member ${MEMBER_HASH}"
-                    etcdctl --endpoints=$(eps) member remove ${MEMBER_HASH}
-                fi
-                echo "Adding new member"
-                echo "etcdctl --endpoints=$(eps) member add ${HOSTNAME} --peer-urls=http://${HOSTNAME}.${SET_NAME}.${MY_NAMESPACE}.svc.cluster.local:2380"
-                etcdctl member --endpoints=$(eps) add ${HOSTNAME} --peer-urls=http://${HOSTNAME}.${SET_NAME}.${MY_NAMESPACE}.svc.cluster.local:2380 | grep "^ETCD_" > /var/run/etcd/new_member_envs
-                if [ $? -ne 0 ]; then
-                    echo "member add ${HOSTNAME} error."
-                    rm -f /var/run/etcd/new_member_envs
-                    exit 1
-                fi
-                echo "==> Loading env vars of existing cluster..."
-                sed -ie "s/^/export /" /var/run/etcd/new_member_envs
-                cat /var/run/etcd/new_member_envs
-                . /var/run/etcd/new_member_envs
-                echo "etcd --name ${HOSTNAME} --initial-advertise-peer-urls ${ETCD_INITIAL_ADVERTISE_PEER_URLS} --listen-peer-urls http://${POD_IP}:2380 --listen-client-urls http://${POD_IP}:2379,http://127.0.0.1:2379 --advertise-client-urls http://${HOSTNAME}.${SET_NAME}.${MY_NAMESPACE}.svc.cluster.local:2379 --data-dir /var/run/etcd/default.etcd --initial-cluster ${ETCD_INITIAL_CLUSTER} --initial-cluster-state ${ETCD_INITIAL_CLUSTER_STATE}"
-                exec etcd --listen-peer-urls http://${POD_IP}:2380 \
-                    --listen-client-urls http://${POD_IP}:2379,http://127.0.0.1:2379 \
-                    --advertise-client-urls http://${HOSTNAME}.${SET_NAME}.${MY_NAMESPACE}.svc.cluster.local:2379 \
-                    --data-dir /var/run/etcd/default.etcd
-            fi
-            for i in $(seq 0 $((${INITIAL_CLUSTER_SIZE} - 1))); do
-                while true; do
-                    echo "Waiting for ${SET_NAME}-${i}.${SET_NAME}.${MY_NAMESPACE}.svc.cluster.local to come up"
-                    ping -W 1 -c 1 ${SET_NAME}-${i}.${SET_NAME}.${MY_NAMESPACE}.svc.cluster.local > /dev/null && break
-                    sleep 1s
-                done
-            done
-            echo "join member ${HOSTNAME}"
-            # join member
-            exec etcd --name ${HOSTNAME} \
-                --initial-advertise-peer-urls http://${HOSTNAME}.${SET_NAME}.${MY_NAMESPACE}.svc.cluster.local:2380 \
-                --listen-peer-urls http://${POD_IP}:2380 \
-                --listen-client-urls http://${POD_IP}:2379,http://127.0.0.1:2379 \
-                --advertise-client-urls http://${HOSTNAME}.${SET_NAME}.${MY_NAMESPACE}.svc.cluster.local:2379 \
-                --initial-cluster-token etcd-cluster-1 \
-                --data-dir /var/run/etcd/default.etcd \
-                --initial-cluster $(initial_peers) \
-                --initial-cluster-state new`
-	lifeShell = `
-                  HOSTNAME=$(hostname)
-
-                  member_hash() {
-                      etcdctl member list | grep -w "$HOSTNAME" | awk '{ print $1}' | awk -F "," '{ print $1}'
-                  }
-
-                  eps() {
-                      EPS=""
-                      for i in $(seq 0 $((${INITIAL_CLUSTER_SIZE} - 1))); do
-                          EPS="${EPS}${EPS:+,}http://${SET_NAME}-${i}.${SET_NAME}.${MY_NAMESPACE}.svc.cluster.local:2379"
-                      done
-                      echo ${EPS}
-                  }
-
-                  export ETCDCTL_ENDPOINTS=$(eps)
-                  SET_ID=${HOSTNAME##*-}
-
-                  # Removing member from cluster
-                  if [ "${SET_ID}" -ge ${INITIAL_CLUSTER_SIZE} ]; then
-                      echo "Removing ${HOSTNAME} from etcd cluster"
-                      etcdctl member remove $(member_hash)
-                      if [ $? -eq 0 ]; then
-                          # Remove everything otherwise the cluster will no longer scale-up
-                          rm -rf /var/run/etcd/*
-                      fi
-                  fi`
+	EtcdConfigVolumeName      = "config"
+	// TemplateHashAnnotation records the hash of the pod template last written to the StatefulSet.
+	TemplateHashAnnotation = "etcd.gqq.com/template-hash"
 )
 
 func MutateHeadlessSvc(etcdcluster *etcdv1alpha1.EtcdCluster, service *corev1.Service) {
@@ -137,42 +46,114 @@ func MutateHeadlessSvc(etcdcluster *etcdv1alpha1.EtcdCluster, service *corev1.Se
 
 }
 
+// MutateStatefulSet only touches the pod template when the template derived from the
+// EtcdCluster changes, so that scaling never rolls the existing members.
 func MutateStatefulSet(etcdcluster *etcdv1alpha1.EtcdCluster, set *appsv1.StatefulSet) {
 	set.Labels = map[string]string{
 		EtcdClusterCommonLabelKey: "etcd",
 	}
-	set.Spec = appsv1.StatefulSetSpec{
-		Replicas:    etcdcluster.Spec.Size,
-		ServiceName: etcdcluster.Name,
-		Selector: &metav1.LabelSelector{
+	if set.CreationTimestamp.IsZero() {
+		// 副本数在创建之后由成员管理逻辑一个一个地调整，其余字段创建后不能修改
+		replicas := initialMembers(etcdcluster)
+		set.Spec.Replicas = &replicas
+		set.Spec.ServiceName = etcdcluster.Name
+		set.Spec.Selector = &metav1.LabelSelector{
 			MatchLabels: map[string]string{
 				EtcdClusterLabelKey: etcdcluster.Name,
 			},
+		}
+		set.Spec.VolumeClaimTemplates = newVolumeClaimTemplates(etcdcluster)
+	}
+	// 成员由 operator 按顺序重启，statefulset 只重建被删除的 pod
+	set.Spec.UpdateStrategy = appsv1.StatefulSetUpdateStrategy{Type: appsv1.OnDeleteStatefulSetStrategyType}
+
+	template := newPodTemplate(etcdcluster)
+	hash := podTemplateHash(&template)
+	if set.Annotations[TemplateHashAnnotation] == hash {
+		return
+	}
+	if set.Annotations == nil {
+		set.Annotations = map[string]string{}
+	}
+	set.Annotations[TemplateHashAnnotation] = hash
+	set.Spec.Template = template
+}
+
+// podTemplateHash hashes everything the operator puts into the pod template.
+func podTemplateHash(template *corev1.PodTemplateSpec) string {
+	data, err := json.Marshal(template)
+	if err != nil {
+		// a PodTemplateSpec always marshals
+		panic(err)
+	}
+	h := fnv.New32a()
+	h.Write(data)
+	return rand.SafeEncodeString(fmt.Sprint(h.Sum32()))
+}
+
+// newPodTemplate builds the pod template of the members. It must not depend on
+// Spec.Size, otherwise every scale operation would restart all members.
+func newPodTemplate(etcdcluster *etcdv1alpha1.EtcdCluster) corev1.PodTemplateSpec {
+	template := corev1.PodTemplateSpec{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels: map[string]string{
+				EtcdClusterLabelKey:       etcdcluster.Name,
+				EtcdClusterCommonLabelKey: "etcd",
+			},
 		},
-		Template: corev1.PodTemplateSpec{
-			ObjectMeta: metav1.ObjectMeta{
-				Labels: map[string]string{
-					EtcdClusterLabelKey:       etcdcluster.Name,
-					EtcdClusterCommonLabelKey: "etcd",
+		Spec: corev1.PodSpec{
+			Containers: newContainers(etcdcluster),
+			Volumes: []corev1.Volume{
+				corev1.Volume{
+					Name: EtcdConfigVolumeName,
+					VolumeSource: corev1.VolumeSource{
+						ConfigMap: &corev1.ConfigMapVolumeSource{
+							LocalObjectReference: corev1.LocalObjectReference{
+								Name: memberConfigMapName(etcdcluster),
+							},
+						},
+					},
 				},
 			},
-			Spec: corev1.PodSpec{
-				Containers: newContainers(etcdcluster),
+		},
+	}
+	if tlsEnabled(etcdcluster) {
+		addSecretVolume(&template.Spec, EtcdPeerTLSVolumeName, peerSecretName(etcdcluster), EtcdPeerTLSDir)
+		addSecretVolume(&template.Spec, EtcdServerTLSVolumeName, serverSecretName(etcdcluster), EtcdServerTLSDir)
+	}
+	return template
+}
+
+// addSecretVolume mounts a Secret read-only into the etcd container.
+func addSecretVolume(spec *corev1.PodSpec, volumeName, secretName, mountPath string) {
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: volumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: secretName,
 			},
 		},
-		VolumeClaimTemplates: []corev1.PersistentVolumeClaim{
-			corev1.PersistentVolumeClaim{
-				ObjectMeta: metav1.ObjectMeta{
-					Name: EtcdDataDirName,
+	})
+	spec.Containers[0].VolumeMounts = append(spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+		Name:      volumeName,
+		MountPath: mountPath,
+		ReadOnly:  true,
+	})
+}
+
+func newVolumeClaimTemplates(etcdcluster *etcdv1alpha1.EtcdCluster) []corev1.PersistentVolumeClaim {
+	return []corev1.PersistentVolumeClaim{
+		corev1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: EtcdDataDirName,
+			},
+			Spec: corev1.PersistentVolumeClaimSpec{
+				AccessModes: []corev1.PersistentVolumeAccessMode{
+					corev1.ReadWriteOnce,
 				},
-				Spec: corev1.PersistentVolumeClaimSpec{
-					AccessModes: []corev1.PersistentVolumeAccessMode{
-						corev1.ReadWriteOnce,
-					},
-					Resources: corev1.ResourceRequirements{
-						Requests: corev1.ResourceList{
-							corev1.ResourceStorage: resource.MustParse("1Gi"),
-						},
+				Resources: corev1.ResourceRequirements{
+					Requests: corev1.ResourceList{
+						corev1.ResourceStorage: resource.MustParse("1Gi"),
 					},
 				},
 			},
@@ -184,7 +165,7 @@ func newContainers(cluster *etcdv1alpha1.EtcdCluster) []corev1.Container {
 	return []corev1.Container{
 		corev1.Container{
 			Name:  "etcd",
-			Image: cluster.Spec.Image,
+			Image: memberImage(cluster),
 			Ports: []corev1.ContainerPort{
 				corev1.ContainerPort{
 					Name:          "peer",
@@ -197,26 +178,10 @@ func newContainers(cluster *etcdv1alpha1.EtcdCluster) []corev1.Container {
 			},
 			Env: []corev1.EnvVar{
 				corev1.EnvVar{
-					Name:  "INITIAL_CLUSTER_SIZE",
-					Value: strconv.Itoa(int(*cluster.Spec.Size)),
-				},
-				corev1.EnvVar{
-					Name:  "SET_NAME",
-					Value: cluster.Name,
-				},
-				corev1.EnvVar{
-					Name: "POD_IP",
-					ValueFrom: &corev1.EnvVarSource{
-						FieldRef: &corev1.ObjectFieldSelector{
-							FieldPath: "status.podIP",
-						},
-					},
-				},
-				corev1.EnvVar{
-					Name: "MY_NAMESPACE",
+					Name: "POD_NAME",
 					ValueFrom: &corev1.EnvVarSource{
 						FieldRef: &corev1.ObjectFieldSelector{
-							FieldPath: "metadata.namespace",
+							FieldPath: "metadata.name",
 						},
 					},
 				},
@@ -226,18 +191,15 @@ func newContainers(cluster *etcdv1alpha1.EtcdCluster) []corev1.Container {
 					Name:      EtcdDataDirName,
 					MountPath: "/var/run/etcd",
 				},
+				corev1.VolumeMount{
+					Name:      EtcdConfigVolumeName,
+					MountPath: EtcdConfigDir,
+					ReadOnly:  true,
+				},
 			},
+			// 每个成员的启动参数由 operator 写在 ConfigMap 里
 			Command: []string{
-				"/bin/sh", "-xec", commmdShell,
-			},
-			Lifecycle: &corev1.Lifecycle{
-				PreStop: &corev1.LifecycleHandler{
-					Exec: &corev1.ExecAction{
-						Command: []string{
-							"/bin/sh", "-xec", lifeShell,
-						},
-					},
-				},
+				"etcd", "--config-file", EtcdConfigDir + "/$(POD_NAME).yaml",
 			},
 		},
 	}
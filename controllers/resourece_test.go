@@ -0,0 +1,46 @@
+package controllers
+
+import (
+	"testing"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestMutateStatefulSetScaleKeepsTemplate(t *testing.T) {
+	size := int32(3)
+	cluster := &etcdv1alpha1.EtcdCluster{
+		ObjectMeta: metav1.ObjectMeta{Name: "etcd", Namespace: "default"},
+		Spec:       etcdv1alpha1.EtcdClusterSpec{Size: &size, Image: "quay.io/coreos/etcd:v3.5.1"},
+	}
+	var set appsv1.StatefulSet
+	MutateStatefulSet(cluster, &set)
+	if *set.Spec.Replicas != 3 {
+		t.Fatalf("new StatefulSet has %d replicas, want 3", *set.Spec.Replicas)
+	}
+	if set.Spec.UpdateStrategy.Type != appsv1.OnDeleteStatefulSetStrategyType {
+		t.Errorf("update strategy is %s, want the operator to restart the pods", set.Spec.UpdateStrategy.Type)
+	}
+	hash := set.Annotations[TemplateHashAnnotation]
+
+	set.CreationTimestamp = metav1.Now()
+	newSize := int32(5)
+	cluster.Spec.Size = &newSize
+	MutateStatefulSet(cluster, &set)
+	if *set.Spec.Replicas != 3 {
+		t.Errorf("existing StatefulSet scaled to %d replicas, want membership reconcile to own replicas", *set.Spec.Replicas)
+	}
+	if got := set.Annotations[TemplateHashAnnotation]; got != hash {
+		t.Errorf("template hash changed from %s to %s on scale", hash, got)
+	}
+
+	cluster.Spec.Image = "quay.io/coreos/etcd:v3.5.2"
+	MutateStatefulSet(cluster, &set)
+	if set.Annotations[TemplateHashAnnotation] == hash {
+		t.Error("template hash did not change with the image")
+	}
+	if got := set.Spec.Template.Spec.Containers[0].Image; got != cluster.Spec.Image {
+		t.Errorf("template image is %s, want %s", got, cluster.Spec.Image)
+	}
+}
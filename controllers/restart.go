@@ -0,0 +1,153 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+)
+
+// listMemberPods returns the pods of a cluster sorted by name.
+func (r *EtcdClusterReconciler) listMemberPods(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster) ([]corev1.Pod, error) {
+	var pods corev1.PodList
+	if err := r.List(ctx, &pods, client.InNamespace(cluster.Namespace),
+		client.MatchingLabels{EtcdClusterLabelKey: cluster.Name}); err != nil {
+		return nil, err
+	}
+	sort.Slice(pods.Items, func(i, j int) bool {
+		return pods.Items[i].Name < pods.Items[j].Name
+	})
+	return pods.Items, nil
+}
+
+// allMembersStartedAfter reports whether every pod of the cluster was created after t.
+func (r *EtcdClusterReconciler) allMembersStartedAfter(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, t time.Time) (bool, error) {
+	pods, err := r.listMemberPods(ctx, cluster)
+	if err != nil {
+		return false, err
+	}
+	for _, pod := range pods {
+		if pod.CreationTimestamp.Time.Before(t) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// maxRestartLag is how many raft entries the other members may trail the leader by
+// when a member is restarted.
+const maxRestartLag = 1000
+
+// restartMembers deletes at most one pod for which needsRestart returns true, so that
+// the StatefulSet recreates it. A pod is only restarted while every other member is
+// healthy and caught up with the leader, unhealthy members go first, followers go
+// before the leader, and leadership is moved away before the leader restarts.
+// It returns true when it restarted a member or moved leadership.
+func (r *EtcdClusterReconciler) restartMembers(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	state *clusterState, needsRestart func(*corev1.Pod) bool, reason string) (bool, error) {
+	pods, err := r.listMemberPods(ctx, cluster)
+	if err != nil {
+		return false, err
+	}
+	var leaderPod *corev1.Pod
+	var pending []*corev1.Pod
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil {
+			// 上一个重启还没有完成
+			return false, nil
+		}
+		if !needsRestart(pod) {
+			continue
+		}
+		if m := state.memberByName(cluster, pod.Name); m != nil && m.ID == state.leaderID {
+			leaderPod = pod
+			continue
+		}
+		pending = append(pending, pod)
+	}
+	if len(pending) == 0 && leaderPod == nil {
+		return false, nil
+	}
+	// 不健康的成员先重启，重启它们不会让集群更差
+	sort.SliceStable(pending, func(i, j int) bool {
+		return !state.memberHealthy(cluster, pending[i].Name) && state.memberHealthy(cluster, pending[j].Name)
+	})
+	pod := leaderPod
+	if len(pending) > 0 {
+		pod = pending[0]
+	}
+	if blocker := state.restartBlocker(cluster, pod.Name); blocker != "" {
+		log.FromContext(ctx).Info("waiting before restarting the next member", "member", pod.Name, "reason", reason, "waiting for", blocker)
+		return false, nil
+	}
+	if pod == leaderPod {
+		if err := r.transferLeadership(ctx, cluster, state, state.leaderID); err != nil {
+			return false, fmt.Errorf("move leadership away from %s: %w", pod.Name, err)
+		}
+		return true, nil
+	}
+	log.FromContext(ctx).Info("restarting etcd member", "member", pod.Name, "reason", reason)
+	if err := r.Delete(ctx, pod); err != nil {
+		return false, err
+	}
+	r.Recorder.Eventf(cluster, corev1.EventTypeNormal, "MemberRestarted", "restarted member %s: %s", pod.Name, reason)
+	return true, nil
+}
+
+// memberHealthy reports whether the member of a pod answered the status request.
+func (s *clusterState) memberHealthy(cluster *etcdv1alpha1.EtcdCluster, name string) bool {
+	m := s.memberByName(cluster, name)
+	if m == nil {
+		return false
+	}
+	_, ok := s.statuses[m.ID]
+	return ok
+}
+
+// restartBlocker returns why the member name cannot be restarted yet, or an empty
+// string once every other member is healthy and caught up with the leader.
+func (s *clusterState) restartBlocker(cluster *etcdv1alpha1.EtcdCluster, name string) string {
+	self := s.memberByName(cluster, name)
+	for _, m := range s.members {
+		if self != nil && m.ID == self.ID {
+			continue
+		}
+		other := m.Name
+		if other == "" {
+			other = fmt.Sprintf("%x", m.ID)
+		}
+		lag, ok := s.memberLag(m)
+		switch {
+		case !ok:
+			return fmt.Sprintf("member %s to be healthy", other)
+		case lag > maxRestartLag:
+			return fmt.Sprintf("member %s to catch up with the leader, it is %d entries behind", other, lag)
+		}
+	}
+	return ""
+}
+
+// rollOutTemplate restarts the pods that do not run the current pod template. The
+// StatefulSet uses the OnDelete strategy and only recreates the pods deleted here.
+func (r *EtcdClusterReconciler) rollOutTemplate(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, state *clusterState) (bool, error) {
+	// statefulset 看到新模板之后才有新的 revision
+	if sts.Status.ObservedGeneration < sts.Generation || sts.Status.UpdateRevision == "" {
+		return false, nil
+	}
+	return r.restartMembers(ctx, cluster, state, outdatedPod(sts.Status.UpdateRevision), "the pod template changed")
+}
+
+// startedBefore returns a restart predicate for pods created before t.
+func startedBefore(t time.Time) func(*corev1.Pod) bool {
+	return func(pod *corev1.Pod) bool {
+		return pod.CreationTimestamp.Time.Before(t)
+	}
+}
@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"testing"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+func TestRestartBlockerWaitsForOtherMembers(t *testing.T) {
+	cluster := &etcdv1alpha1.EtcdCluster{}
+	state := &clusterState{
+		leaderID: 1,
+		members:  []*etcdserverpb.Member{{ID: 1, Name: "etcd-0"}, {ID: 2, Name: "etcd-1"}, {ID: 3, Name: "etcd-2"}},
+		statuses: map[uint64]*clientv3.StatusResponse{
+			1: {RaftIndex: 5000},
+			2: {RaftIndex: 4990},
+		},
+	}
+	// 自己不健康不影响重启自己
+	if b := state.restartBlocker(cluster, "etcd-2"); b != "" {
+		t.Errorf("etcd-2 blocked by %q", b)
+	}
+	if b := state.restartBlocker(cluster, "etcd-1"); b == "" {
+		t.Error("etcd-1 restarted while etcd-2 is down")
+	}
+	state.statuses[3] = &clientv3.StatusResponse{RaftIndex: 3000}
+	if b := state.restartBlocker(cluster, "etcd-1"); b == "" {
+		t.Error("etcd-1 restarted while etcd-2 is behind the leader")
+	}
+	state.statuses[3].RaftIndex = 4800
+	if b := state.restartBlocker(cluster, "etcd-1"); b != "" {
+		t.Errorf("etcd-1 blocked by %q", b)
+	}
+}
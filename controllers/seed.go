@@ -0,0 +1,282 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	"github.com/gqq/etcd-operator/pkg/backup"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+)
+
+// SeedLabelKey marks the member volumes a seeder created, so that they can be cleaned
+// up if seeding fails before the cluster takes them over.
+var SeedLabelKey = "etcd.gqq.com/seeded-by"
+
+// memberVolumeName is the name of the PersistentVolumeClaim the StatefulSet creates for a member.
+func memberVolumeName(name string) string {
+	return fmt.Sprintf("%s-%s", EtcdDataDirName, name)
+}
+
+// memberSeeder fills the data volumes of a cluster's members with a snapshot before
+// any etcd container starts. It creates each member's volume under the name the
+// StatefulSet will look for, and runs an agent Job that restores the snapshot into
+// it. Members are seeded one at a time, so a ReadWriteOnce source volume works too.
+type memberSeeder struct {
+	client.Client
+	scheme *runtime.Scheme
+	image  string
+
+	// owner owns the restore Jobs.
+	owner client.Object
+	// name prefixes the restore Jobs and marks the volumes the seeder created.
+	name string
+	// cluster is the cluster being seeded, it does not have to exist yet.
+	cluster *etcdv1alpha1.EtcdCluster
+	// token is the initial cluster token, which gives the seeded cluster a fresh cluster ID.
+	token string
+	// sourceArgs returns the flags that select the snapshot, and adds what the Job needs
+	// to reach it. No Job is started while it is nil.
+	sourceArgs func(job *batchv1.Job) []string
+	// dataSource, when set, is what the volumes are provisioned from. The restore Job
+	// then finds the snapshot in the volume itself.
+	dataSource *corev1.TypedLocalObjectReference
+}
+
+// seed restores the snapshot into the first members volumes. It returns how many are
+// done, the result of the last one, and why seeding failed, if it did.
+func (s *memberSeeder) seed(ctx context.Context, members int) (int, *backup.Result, string, error) {
+	names := make([]string, 0, members)
+	for i := 0; i < members; i++ {
+		names = append(names, memberName(s.cluster, i))
+	}
+	var result *backup.Result
+	for i, name := range names {
+		if err := s.ensureVolume(ctx, name); err != nil {
+			return i, nil, "", err
+		}
+		var job batchv1.Job
+		err := s.Get(ctx, types.NamespacedName{Namespace: s.cluster.Namespace, Name: s.jobName(i)}, &job)
+		if apierrors.IsNotFound(err) {
+			if s.sourceArgs == nil {
+				// 数据源暂时不可用
+				return i, nil, "", nil
+			}
+			return i, nil, "", s.createJob(ctx, i, names)
+		}
+		if err != nil {
+			return i, nil, "", err
+		}
+		finished, failed := jobFinished(&job)
+		if !finished {
+			return i, nil, "", nil
+		}
+		if failed {
+			msg, err := agentMessage(ctx, s.Client, &job, corev1.PodFailed)
+			if err != nil {
+				msg = fmt.Sprintf("job %s failed", job.Name)
+			}
+			return i, nil, fmt.Sprintf("restoring member %s failed: %s", name, msg), nil
+		}
+		result = &backup.Result{}
+		if err := agentResult(ctx, s.Client, &job, result); err != nil {
+			return i, nil, "", err
+		}
+	}
+	return members, result, "", nil
+}
+
+func (s *memberSeeder) jobName(ordinal int) string {
+	return fmt.Sprintf("%s-seed-%d", s.name, ordinal)
+}
+
+// ensureVolume creates the data volume of a member the way the StatefulSet would.
+func (s *memberSeeder) ensureVolume(ctx context.Context, name string) error {
+	var pvc corev1.PersistentVolumeClaim
+	err := s.Get(ctx, types.NamespacedName{Namespace: s.cluster.Namespace, Name: memberVolumeName(name)}, &pvc)
+	if !apierrors.IsNotFound(err) {
+		return err
+	}
+	template := newVolumeClaimTemplates(s.cluster)[0]
+	pvc = corev1.PersistentVolumeClaim{
+		ObjectMeta: template.ObjectMeta,
+		Spec:       template.Spec,
+	}
+	pvc.Namespace = s.cluster.Namespace
+	pvc.Name = memberVolumeName(name)
+	pvc.Labels = map[string]string{
+		EtcdClusterLabelKey: s.cluster.Name,
+		SeedLabelKey:        s.name,
+	}
+	pvc.Spec.DataSource = s.dataSource
+	return s.Create(ctx, &pvc)
+}
+
+func (s *memberSeeder) createJob(ctx context.Context, ordinal int, names []string) error {
+	name := names[ordinal]
+	job := newAgentJob(s.cluster.Namespace, s.jobName(ordinal), s.image,
+		map[string]string{EtcdClusterLabelKey: s.cluster.Name}, nil)
+	spec := &job.Spec.Template.Spec
+	spec.Volumes = append(spec.Volumes, corev1.Volume{
+		Name: EtcdDataDirName,
+		VolumeSource: corev1.VolumeSource{
+			PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+				ClaimName: memberVolumeName(name),
+			},
+		},
+	})
+	// 和 etcd 容器一样挂载，恢复出来的数据目录就是 EtcdDataDir
+	spec.Containers[0].VolumeMounts = append(spec.Containers[0].VolumeMounts, corev1.VolumeMount{
+		Name:      EtcdDataDirName,
+		MountPath: path.Dir(EtcdDataDir),
+	})
+	args := []string{"restore",
+		"--name", name,
+		"--initial-advertise-peer-urls", memberPeerURL(s.cluster, name),
+		"--initial-cluster", initialCluster(s.cluster, names),
+		"--initial-cluster-token", s.token,
+		"--data-dir", EtcdDataDir,
+		"--scratch-dir", agentScratchDir,
+	}
+	args = append(args, s.sourceArgs(job)...)
+	spec.Containers[0].Command = append(spec.Containers[0].Command, args...)
+	if err := controllerutil.SetControllerReference(s.owner, job, s.scheme); err != nil {
+		return err
+	}
+	return s.Create(ctx, job)
+}
+
+// cleanup deletes the volumes the seeder created, after seeding failed.
+func (s *memberSeeder) cleanup(ctx context.Context) error {
+	return s.DeleteAllOf(ctx, &corev1.PersistentVolumeClaim{}, client.InNamespace(s.cluster.Namespace),
+		client.MatchingLabels{SeedLabelKey: s.name, EtcdClusterLabelKey: s.cluster.Name})
+}
+
+// sourcePath returns the snapshot a PVC, S3 or VolumeSnapshot source points at.
+func sourcePath(dest *etcdv1alpha1.BackupDestination) string {
+	if dest.PVC != nil {
+		return strings.TrimPrefix(dest.PVC.Path, "/")
+	}
+	if dest.S3 != nil {
+		return dest.S3.Key
+	}
+	if dest.VolumeSnapshot != nil {
+		return dest.VolumeSnapshot.Name
+	}
+	return ""
+}
+
+// snapshotSource is a snapshot resolved from a RestoreSource.
+type snapshotSource struct {
+	dest   *etcdv1alpha1.BackupDestination
+	path   string
+	sha256 string
+	// changeLog is the directory of the change log replayed on top of the snapshot, if any.
+	changeLog   string
+	pointInTime *etcdv1alpha1.PointInTime
+}
+
+// resolveSnapshotSource finds the snapshot a RestoreSource points at. It returns a
+// message instead of a source while the referenced EtcdBackup is still running, and
+// a failure when the source can never be restored.
+func resolveSnapshotSource(ctx context.Context, c client.Client, namespace string, src *etcdv1alpha1.RestoreSource) (
+	source *snapshotSource, pending string, failure string, err error) {
+	if src.Backup == "" {
+		if err := validateDestination(&src.BackupDestination); err != nil {
+			return nil, "", err.Error(), nil
+		}
+		if sourcePath(&src.BackupDestination) == "" {
+			return nil, "", "pvc.path, s3.key or volumeSnapshot.name must point at the snapshot", nil
+		}
+		if src.PointInTime != nil && src.VolumeSnapshot != nil {
+			return nil, "", "pointInTime cannot be used with a volumeSnapshot", nil
+		}
+		if src.PointInTime != nil && src.PointInTime.ChangeLogPath == "" {
+			return nil, "", "pointInTime.changeLogPath must be set", nil
+		}
+		source = &snapshotSource{dest: &src.BackupDestination, path: sourcePath(&src.BackupDestination)}
+		if src.PointInTime != nil {
+			source.changeLog, source.pointInTime = src.PointInTime.ChangeLogPath, src.PointInTime
+		}
+		return source, "", "", nil
+	}
+
+	if src.PVC != nil || src.S3 != nil || src.VolumeSnapshot != nil {
+		return nil, "", "backup cannot be combined with pvc, s3 or volumeSnapshot", nil
+	}
+	var etcdbackup etcdv1alpha1.EtcdBackup
+	err = c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: src.Backup}, &etcdbackup)
+	if apierrors.IsNotFound(err) {
+		return nil, "", fmt.Sprintf("EtcdBackup %s not found", src.Backup), nil
+	}
+	if err != nil {
+		return nil, "", "", err
+	}
+	switch etcdbackup.Status.Phase {
+	case etcdv1alpha1.BackupPhaseCompleted:
+		if src.PointInTime != nil && etcdbackup.Spec.Destination.VolumeSnapshot != nil {
+			return nil, "", fmt.Sprintf("pointInTime cannot be used with EtcdBackup %s, it is a volume snapshot", src.Backup), nil
+		}
+		source = &snapshotSource{
+			dest:   &etcdbackup.Spec.Destination,
+			path:   etcdbackup.Status.Path,
+			sha256: etcdbackup.Status.SHA256,
+		}
+		if pit := src.PointInTime; pit != nil {
+			source.changeLog, source.pointInTime = pit.ChangeLogPath, pit
+			if source.changeLog == "" {
+				source.changeLog = defaultChangeLogPath(source.dest, namespace, etcdbackup.Spec.ClusterName)
+			}
+		}
+		return source, "", "", nil
+	case etcdv1alpha1.BackupPhaseFailed:
+		return nil, "", fmt.Sprintf("EtcdBackup %s failed", src.Backup), nil
+	default:
+		return nil, fmt.Sprintf("waiting for EtcdBackup %s to complete", src.Backup), "", nil
+	}
+}
+
+// args returns the flags that make a restore Job read the snapshot.
+func (s *snapshotSource) args(job *batchv1.Job) []string {
+	if s.dest.VolumeSnapshot != nil {
+		// 卷是从快照创建的，数据已经在数据目录里了
+		return []string{"--from-volume"}
+	}
+	args := []string{"--path", s.path}
+	if s.sha256 != "" {
+		args = append(args, "--sha256", s.sha256)
+	}
+	if s.changeLog != "" {
+		args = append(args, "--changelog", s.changeLog)
+		if s.pointInTime.Revision != 0 {
+			args = append(args, "--to-revision", strconv.FormatInt(s.pointInTime.Revision, 10))
+		}
+		if s.pointInTime.Time != nil {
+			args = append(args, "--to-time", s.pointInTime.Time.UTC().Format(time.RFC3339))
+		}
+	}
+	return append(args, agentStorageArgs(&job.Spec.Template.Spec, s.dest)...)
+}
+
+// dataSource returns the VolumeSnapshot member volumes are provisioned from, nil when
+// the snapshot is a file.
+func (s *snapshotSource) dataSource() *corev1.TypedLocalObjectReference {
+	if s.dest.VolumeSnapshot == nil {
+		return nil
+	}
+	return &corev1.TypedLocalObjectReference{
+		APIGroup: &volumeSnapshotGVK.Group,
+		Kind:     volumeSnapshotGVK.Kind,
+		Name:     s.path,
+	}
+}
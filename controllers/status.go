@@ -0,0 +1,170 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// clusterState is a point-in-time view of the etcd cluster gathered through the etcd client.
+type clusterState struct {
+	clusterID uint64
+	leaderID  uint64
+	members   []*etcdserverpb.Member
+	// statuses holds the status response of every member that answered, keyed by member ID.
+	statuses map[uint64]*clientv3.StatusResponse
+	// errors holds the reason a member did not answer, keyed by member ID.
+	errors map[uint64]string
+}
+
+// healthyCount returns the number of members that answered a status request.
+func (s *clusterState) healthyCount() int {
+	return len(s.statuses)
+}
+
+// voterCount returns the number of voting members, which is what quorum is computed from.
+func (s *clusterState) voterCount() int {
+	n := 0
+	for _, m := range s.members {
+		if !m.IsLearner {
+			n++
+		}
+	}
+	return n
+}
+
+// healthyVoterCount returns the number of voting members that answered a status request.
+func (s *clusterState) healthyVoterCount() int {
+	n := 0
+	for _, m := range s.members {
+		if _, ok := s.statuses[m.ID]; ok && !m.IsLearner {
+			n++
+		}
+	}
+	return n
+}
+
+// observeCluster lists the members of the cluster and asks every started member for its status.
+func observeCluster(ctx context.Context, cli *clientv3.Client) (*clusterState, error) {
+	listCtx, cancel := withEtcdTimeout(ctx)
+	defer cancel()
+	resp, err := cli.MemberList(listCtx)
+	if err != nil {
+		return nil, fmt.Errorf("list etcd members: %w", err)
+	}
+
+	state := &clusterState{
+		clusterID: resp.Header.ClusterId,
+		members:   resp.Members,
+		statuses:  map[uint64]*clientv3.StatusResponse{},
+		errors:    map[uint64]string{},
+	}
+	for _, m := range resp.Members {
+		if len(m.ClientURLs) == 0 {
+			// 还没有启动的成员没有 client url
+			state.errors[m.ID] = "member has not started"
+			continue
+		}
+		statusCtx, cancel := withEtcdTimeout(ctx)
+		st, err := cli.Status(statusCtx, m.ClientURLs[0])
+		cancel()
+		if err != nil {
+			state.errors[m.ID] = err.Error()
+			continue
+		}
+		if len(st.Errors) > 0 {
+			state.errors[m.ID] = st.Errors[0]
+			continue
+		}
+		state.statuses[m.ID] = st
+		if st.Leader != 0 {
+			state.leaderID = st.Leader
+		}
+	}
+	return state, nil
+}
+
+// memberStatuses converts the observed state into the API representation, sorted by member name.
+func (s *clusterState) memberStatuses() []etcdv1alpha1.MemberStatus {
+	members := make([]etcdv1alpha1.MemberStatus, 0, len(s.members))
+	for _, m := range s.members {
+		ms := etcdv1alpha1.MemberStatus{
+			ID:         fmt.Sprintf("%x", m.ID),
+			Name:       m.Name,
+			PeerURLs:   m.PeerURLs,
+			ClientURLs: m.ClientURLs,
+			IsLeader:   m.ID == s.leaderID,
+			IsLearner:  m.IsLearner,
+		}
+		if st, ok := s.statuses[m.ID]; ok {
+			ms.Healthy = true
+			ms.Version = st.Version
+			ms.DBSize = st.DbSize
+			ms.RaftTerm = st.RaftTerm
+			ms.RaftIndex = st.RaftIndex
+		} else {
+			ms.Message = s.errors[m.ID]
+		}
+		members = append(members, ms)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return members[i].Name < members[j].Name
+	})
+	return members
+}
+
+// leaderName returns the name of the leader, or an empty string when there is none.
+func (s *clusterState) leaderName() string {
+	for _, m := range s.members {
+		if m.ID == s.leaderID {
+			return m.Name
+		}
+	}
+	return ""
+}
+
+// applyClusterState records the observed etcd state in the EtcdCluster status.
+// A nil state means the cluster could not be reached at all, the members seen last
+// are kept and marked unhealthy.
+func applyClusterState(cluster *etcdv1alpha1.EtcdCluster, state *clusterState, now metav1.Time) {
+	cluster.Status.ObservedGeneration = cluster.Generation
+	if state == nil {
+		cluster.Status.ReadyReplicas = 0
+		cluster.Status.Leader = ""
+		// 保留 UnhealthySince，否则连不上的时候替换的计时会重新开始
+		for i := range cluster.Status.Members {
+			m := &cluster.Status.Members[i]
+			m.Healthy = false
+			m.IsLeader = false
+			m.Message = "the cluster could not be reached"
+			if m.UnhealthySince == nil {
+				m.UnhealthySince = now.DeepCopy()
+			}
+		}
+		return
+	}
+	cluster.Status.ReadyReplicas = int32(state.healthyCount())
+	cluster.Status.ClusterID = fmt.Sprintf("%x", state.clusterID)
+	cluster.Status.Leader = state.leaderName()
+	members := state.memberStatuses()
+	// 记录成员第一次不健康的时间，用来判断是否需要替换
+	previous := map[string]*metav1.Time{}
+	for _, m := range cluster.Status.Members {
+		previous[m.ID] = m.UnhealthySince
+	}
+	for i := range members {
+		if members[i].Healthy {
+			continue
+		}
+		members[i].UnhealthySince = previous[members[i].ID]
+		if members[i].UnhealthySince == nil {
+			members[i].UnhealthySince = now.DeepCopy()
+		}
+	}
+	cluster.Status.Members = members
+}
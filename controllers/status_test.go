@@ -0,0 +1,32 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestApplyUnreachableClusterKeepsMembers(t *testing.T) {
+	since := metav1.NewTime(time.Now().Add(-time.Hour))
+	cluster := &etcdv1alpha1.EtcdCluster{}
+	cluster.Status.Members = []etcdv1alpha1.MemberStatus{
+		{ID: "1", Name: "etcd-0", Healthy: true, IsLeader: true},
+		{ID: "2", Name: "etcd-1", UnhealthySince: &since},
+	}
+	now := metav1.Now()
+	applyClusterState(cluster, nil, now)
+
+	members := cluster.Status.Members
+	if len(members) != 2 {
+		t.Fatalf("%d members left, want 2", len(members))
+	}
+	if m := members[0]; m.Healthy || m.IsLeader || m.UnhealthySince == nil || !m.UnhealthySince.Equal(&now) {
+		t.Errorf("healthy member was not marked unhealthy now: %+v", m)
+	}
+	// 已经不健康的成员继续计时
+	if m := members[1]; m.UnhealthySince == nil || !m.UnhealthySince.Equal(&since) {
+		t.Errorf("member unhealthy since %v, want %v", m.UnhealthySince, since)
+	}
+}
@@ -0,0 +1,113 @@
+package controllers
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	// EtcdPeerTLSDir and EtcdServerTLSDir are where the certificate Secrets are mounted.
+	EtcdPeerTLSDir   = "/etc/etcd/tls/peer"
+	EtcdServerTLSDir = "/etc/etcd/tls/server"
+
+	EtcdPeerTLSVolumeName   = "peer-tls"
+	EtcdServerTLSVolumeName = "server-tls"
+
+	caCertKey         = "ca.crt"
+	caKeyKey          = "ca.key"
+	previousCACertKey = "previous-ca.crt"
+	previousCAKeyKey  = "previous-ca.key"
+)
+
+func tlsEnabled(cluster *etcdv1alpha1.EtcdCluster) bool {
+	return cluster.Spec.TLS != nil
+}
+
+func operatorManagedTLS(cluster *etcdv1alpha1.EtcdCluster) bool {
+	return cluster.Spec.TLS != nil && cluster.Spec.TLS.Mode == etcdv1alpha1.TLSModeOperator
+}
+
+func caSecretName(cluster *etcdv1alpha1.EtcdCluster) string {
+	return cluster.Name + "-ca"
+}
+
+// peerSecretName returns the Secret mounted at EtcdPeerTLSDir.
+func peerSecretName(cluster *etcdv1alpha1.EtcdCluster) string {
+	if operatorManagedTLS(cluster) {
+		return cluster.Name + "-peer-tls"
+	}
+	return cluster.Spec.TLS.PeerSecret
+}
+
+// serverSecretName returns the Secret mounted at EtcdServerTLSDir.
+func serverSecretName(cluster *etcdv1alpha1.EtcdCluster) string {
+	if operatorManagedTLS(cluster) {
+		return cluster.Name + "-server-tls"
+	}
+	return cluster.Spec.TLS.ServerSecret
+}
+
+// clientSecretName returns the Secret holding the operator's client certificate.
+func clientSecretName(cluster *etcdv1alpha1.EtcdCluster) string {
+	if operatorManagedTLS(cluster) {
+		return cluster.Name + "-client-tls"
+	}
+	return cluster.Spec.TLS.ClientSecret
+}
+
+// memberCertFiles returns the certificate and key a member reads from a mounted Secret.
+// Operator generated Secrets hold one certificate per member, user provided ones a single
+// certificate shared by all members.
+func memberCertFiles(cluster *etcdv1alpha1.EtcdCluster, dir, name string) (string, string) {
+	if operatorManagedTLS(cluster) {
+		return fmt.Sprintf("%s/%s.crt", dir, name), fmt.Sprintf("%s/%s.key", dir, name)
+	}
+	return dir + "/" + corev1.TLSCertKey, dir + "/" + corev1.TLSPrivateKeyKey
+}
+
+func secretKey(cluster *etcdv1alpha1.EtcdCluster, name string) types.NamespacedName {
+	return types.NamespacedName{Namespace: cluster.Namespace, Name: name}
+}
+
+func newOwnedSecret(cluster *etcdv1alpha1.EtcdCluster, name string) *corev1.Secret {
+	secret := &corev1.Secret{}
+	secret.Namespace = cluster.Namespace
+	secret.Name = name
+	return secret
+}
+
+// clientTLSConfig loads the operator's client certificate for a cluster, or returns nil
+// when the cluster does not use TLS.
+func (r *EtcdClusterReconciler) clientTLSConfig(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster) (*tls.Config, error) {
+	if !tlsEnabled(cluster) {
+		return nil, nil
+	}
+	var secret corev1.Secret
+	if err := r.Get(ctx, secretKey(cluster, clientSecretName(cluster)), &secret); err != nil {
+		return nil, fmt.Errorf("get client certificate: %w", err)
+	}
+	return tlsConfigFromSecret(&secret)
+}
+
+// tlsConfigFromSecret builds a client TLS configuration from a Secret with tls.crt, tls.key and ca.crt.
+func tlsConfigFromSecret(secret *corev1.Secret) (*tls.Config, error) {
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return nil, fmt.Errorf("load client certificate from secret %s: %w", secret.Name, err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(secret.Data[caCertKey]) {
+		return nil, fmt.Errorf("secret %s has no valid %s", secret.Name, caCertKey)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
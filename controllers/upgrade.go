@@ -0,0 +1,494 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-semver/semver"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+)
+
+const (
+	// defaultEtcdRepository is the image repository used with Spec.Version when Spec.Image is not set.
+	defaultEtcdRepository = "quay.io/coreos/etcd"
+	// defaultMemberHealthTimeout is used when Spec.Upgrade.MemberHealthTimeout is not set.
+	defaultMemberHealthTimeout = 5 * time.Minute
+)
+
+// memberImage returns the image of the etcd container. With Spec.Version it runs the
+// version the upgrade reached so far, or the image from before a failed upgrade while
+// it is rolled back. Spec.Image is used as is otherwise.
+func memberImage(cluster *etcdv1alpha1.EtcdCluster) string {
+	if cluster.Spec.Version == "" || cluster.Status.Version == "" {
+		return cluster.Spec.Image
+	}
+	if u := cluster.Status.Upgrade; u != nil && u.FromImage != "" && rolledBack(u) {
+		return u.FromImage
+	}
+	return versionImage(cluster.Spec.Image, cluster.Status.Version)
+}
+
+func rolledBack(u *etcdv1alpha1.UpgradeStatus) bool {
+	return u.Phase == etcdv1alpha1.UpgradePhaseRollingBack || u.Phase == etcdv1alpha1.UpgradePhaseRolledBack
+}
+
+func memberHealthTimeout(cluster *etcdv1alpha1.EtcdCluster) time.Duration {
+	if cluster.Spec.Upgrade != nil && cluster.Spec.Upgrade.MemberHealthTimeout != nil {
+		return cluster.Spec.Upgrade.MemberHealthTimeout.Duration
+	}
+	return defaultMemberHealthTimeout
+}
+
+// versionTag matches image tags that name an etcd version, such as v3.5.9, 3.5.9 or
+// 3.5.9-0, and captures what comes before and after the version.
+var versionTag = regexp.MustCompile(`^(v?)([0-9]+\.[0-9]+\.[0-9]+)(.*)$`)
+
+// versionImage returns the image of version in the repository of image. An image whose
+// tag already names version is used as is, digest included, and a tag naming another
+// version keeps its format. Other images get the tag v<version>.
+func versionImage(image, version string) string {
+	if image == "" {
+		return defaultEtcdRepository + ":v" + version
+	}
+	repo := imageRepository(image)
+	if m := versionTag.FindStringSubmatch(imageTag(image)); m != nil {
+		if m[2] == version {
+			return image
+		}
+		// 摘要对应的是旧版本，换了版本就不能再用
+		return repo + ":" + m[1] + version + m[3]
+	}
+	return repo + ":v" + version
+}
+
+// specVersion returns Spec.Version without the optional v prefix, the way etcd reports versions.
+func specVersion(cluster *etcdv1alpha1.EtcdCluster) string {
+	return strings.TrimPrefix(cluster.Spec.Version, "v")
+}
+
+// imageTag returns the tag of an image reference, or an empty string.
+func imageTag(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		return image[i+1:]
+	}
+	return ""
+}
+
+// imageRepository strips the tag and the digest from an image reference.
+func imageRepository(image string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	// 端口号里的冒号前面还有斜杠
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image
+}
+
+func parseVersion(v string) (*semver.Version, error) {
+	return semver.NewVersion(v)
+}
+
+// checkVersionChange returns why changing from one version to another is not allowed.
+func checkVersionChange(from, to *semver.Version, mode etcdv1alpha1.UpgradeMode) string {
+	switch {
+	case to.Major != from.Major:
+		return fmt.Sprintf("changing the major version from %s to %s is not supported", from, to)
+	case to.LessThan(*from) && mode != etcdv1alpha1.UpgradeModeDowngrade:
+		return fmt.Sprintf("%s is older than %s, spec.upgrade.mode must be Downgrade to go back", to, from)
+	case to.Minor > from.Minor+1:
+		return fmt.Sprintf("upgrading from %s to %s skips a minor version, upgrade to %d.%d first", from, to, from.Major, from.Minor+1)
+	case to.Minor+1 < from.Minor:
+		return fmt.Sprintf("downgrading from %s to %s skips a minor version, downgrade to %d.%d first", from, to, from.Major, from.Minor-1)
+	case minorDowngrade(from, to) && from.LessThan(downgradeAPIVersion):
+		return fmt.Sprintf("downgrading from %s to %s needs the downgrade API of etcd %s or later", from, to, downgradeAPIVersion)
+	}
+	return ""
+}
+
+func upgradeMode(cluster *etcdv1alpha1.EtcdCluster) etcdv1alpha1.UpgradeMode {
+	if cluster.Spec.Upgrade != nil && cluster.Spec.Upgrade.Mode != "" {
+		return cluster.Spec.Upgrade.Mode
+	}
+	return etcdv1alpha1.UpgradeModeUpgrade
+}
+
+// serverVersion returns the version every member reports, or an empty string while
+// some member does not answer or the members run different versions.
+func (s *clusterState) serverVersion() string {
+	version := ""
+	for _, m := range s.members {
+		st, ok := s.statuses[m.ID]
+		if !ok || (version != "" && st.Version != version) {
+			return ""
+		}
+		version = st.Version
+	}
+	return version
+}
+
+// reconcileUpgrade moves Status.Version to Spec.Version. A version change is checked,
+// a snapshot is taken, and then the pod template gets the new version and the members
+// are restarted one at a time. It returns true while members are being restarted.
+func (r *EtcdClusterReconciler) reconcileUpgrade(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, state *clusterState) (bool, error) {
+	if cluster.Spec.Version == "" {
+		cluster.Status.Version = ""
+		return false, nil
+	}
+	if cluster.Status.Version == "" {
+		// 已有的集群开始用 version 管理时，以成员实际运行的版本为准
+		if state == nil || state.serverVersion() == "" {
+			return false, nil
+		}
+		cluster.Status.Version = state.serverVersion()
+		return true, nil
+	}
+	u := cluster.Status.Upgrade
+	if u != nil {
+		switch u.Phase {
+		case etcdv1alpha1.UpgradePhaseUpgrading:
+			return r.rollUpgrade(ctx, cluster, sts, state)
+		case etcdv1alpha1.UpgradePhaseRollingBack:
+			return r.rollBack(ctx, cluster, sts, state)
+		}
+	}
+	if specVersion(cluster) == cluster.Status.Version {
+		return false, nil
+	}
+	failed := u != nil && (u.Phase == etcdv1alpha1.UpgradePhaseRolledBack || u.Phase == etcdv1alpha1.UpgradePhaseFailed)
+	if failed && u.ToVersion == specVersion(cluster) && u.ObservedGeneration == cluster.Generation {
+		// 失败的升级等 spec 再次修改之后才重试
+		return false, nil
+	}
+	if u == nil || u.ToVersion != specVersion(cluster) || u.Phase == etcdv1alpha1.UpgradePhaseCompleted || failed {
+		now := metav1.Now()
+		u = &etcdv1alpha1.UpgradeStatus{
+			Phase:              etcdv1alpha1.UpgradePhasePending,
+			FromVersion:        cluster.Status.Version,
+			ToVersion:          specVersion(cluster),
+			ObservedGeneration: cluster.Generation,
+			StartTime:          &now,
+		}
+		cluster.Status.Upgrade = u
+	}
+	u.ObservedGeneration = cluster.Generation
+
+	from, err := parseVersion(u.FromVersion)
+	if err != nil {
+		return false, err
+	}
+	to, err := parseVersion(u.ToVersion)
+	if err != nil {
+		return false, err
+	}
+	blocked := r.upgradeBlocker(cluster, sts, state)
+	if blocked == "" && u.Phase != etcdv1alpha1.UpgradePhaseBackingUp {
+		blocked = checkVersionChange(from, to, upgradeMode(cluster))
+	}
+	if blocked != "" {
+		if u.Message != blocked {
+			r.Recorder.Eventf(cluster, corev1.EventTypeWarning, "UpgradeBlocked", "upgrade to %s: %s", u.ToVersion, blocked)
+		}
+		u.Message = blocked
+		setCondition(cluster, etcdv1alpha1.ConditionProgressing, metav1.ConditionTrue, etcdv1alpha1.ReasonUpgradeBlocked, blocked)
+		return false, nil
+	}
+
+	// 升级前先做一次快照
+	backedUp, err := r.ensurePreUpgradeBackup(ctx, cluster, u)
+	if err != nil || !backedUp {
+		setCondition(cluster, etcdv1alpha1.ConditionProgressing, metav1.ConditionTrue, etcdv1alpha1.ReasonUpgrading, u.Message)
+		return false, err
+	}
+	// 降低次版本号之前先让 etcd 降低集群版本，旧版本的成员才能加入
+	if minorDowngrade(from, to) && !u.DowngradeEnabled {
+		if err := r.enableDowngrade(ctx, cluster, state, u.ToVersion); err != nil {
+			u.Message = err.Error()
+			return false, err
+		}
+		u.DowngradeEnabled = true
+		r.Recorder.Eventf(cluster, corev1.EventTypeNormal, "DowngradeEnabled", "enabled the etcd downgrade to %d.%d", to.Major, to.Minor)
+	}
+	u.Phase = etcdv1alpha1.UpgradePhaseUpgrading
+	u.Message = ""
+	u.FromImage = memberImage(cluster)
+	cluster.Status.Version = u.ToVersion
+	r.Recorder.Eventf(cluster, corev1.EventTypeNormal, "UpgradeStarted", "upgrading from %s to %s, EtcdBackup %s was taken before",
+		u.FromVersion, u.ToVersion, u.Backup)
+	return true, nil
+}
+
+// upgradeBlocker returns why the cluster cannot change its version right now.
+func (r *EtcdClusterReconciler) upgradeBlocker(cluster *etcdv1alpha1.EtcdCluster, sts *appsv1.StatefulSet, state *clusterState) string {
+	switch {
+	case state == nil:
+		return "cannot reach the etcd cluster"
+	case len(state.members) != int(*cluster.Spec.Size) || *sts.Spec.Replicas != *cluster.Spec.Size || len(state.learners()) > 0:
+		return "waiting for the cluster to reach its size"
+	case !state.allHealthy():
+		return "waiting for every member to be healthy"
+	case state.serverVersion() != cluster.Status.Version:
+		return fmt.Sprintf("waiting for every member to run %s", cluster.Status.Version)
+	}
+	return ""
+}
+
+// ensurePreUpgradeBackup takes a snapshot before the version change and returns true
+// once it completed. A failed snapshot is kept, deleting it takes a new one.
+func (r *EtcdClusterReconciler) ensurePreUpgradeBackup(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, u *etcdv1alpha1.UpgradeStatus) (bool, error) {
+	name := fmt.Sprintf("%s-pre-upgrade-%d", cluster.Name, u.StartTime.Unix())
+	var etcdbackup etcdv1alpha1.EtcdBackup
+	err := r.Get(ctx, types.NamespacedName{Namespace: cluster.Namespace, Name: name}, &etcdbackup)
+	if apierrors.IsNotFound(err) {
+		dest, err := r.upgradeBackupDestination(ctx, cluster)
+		if err != nil {
+			return false, err
+		}
+		if dest == nil {
+			u.Phase = etcdv1alpha1.UpgradePhasePending
+			u.Message = "set spec.upgrade.backupDestination or take an EtcdBackup, a snapshot is taken before the upgrade"
+			return false, nil
+		}
+		etcdbackup = etcdv1alpha1.EtcdBackup{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: cluster.Namespace,
+				Name:      name,
+				Labels:    map[string]string{EtcdClusterLabelKey: cluster.Name},
+			},
+			Spec: etcdv1alpha1.EtcdBackupSpec{
+				ClusterName: cluster.Name,
+				Destination: *dest,
+			},
+		}
+		if err := controllerutil.SetControllerReference(cluster, &etcdbackup, r.Schemes()); err != nil {
+			return false, err
+		}
+		if err := r.Create(ctx, &etcdbackup); err != nil {
+			return false, err
+		}
+		u.Phase = etcdv1alpha1.UpgradePhaseBackingUp
+		u.Backup = name
+		u.Message = fmt.Sprintf("taking a snapshot before the upgrade in EtcdBackup %s", name)
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	u.Phase = etcdv1alpha1.UpgradePhaseBackingUp
+	u.Backup = name
+	switch etcdbackup.Status.Phase {
+	case etcdv1alpha1.BackupPhaseCompleted:
+		return true, nil
+	case etcdv1alpha1.BackupPhaseFailed:
+		u.Message = fmt.Sprintf("EtcdBackup %s failed, delete it to take a new one: %s", name, etcdbackup.Status.Message)
+	default:
+		u.Message = fmt.Sprintf("taking a snapshot before the upgrade in EtcdBackup %s", name)
+	}
+	return false, nil
+}
+
+// upgradeBackupDestination returns where the snapshot before a version change is written.
+func (r *EtcdClusterReconciler) upgradeBackupDestination(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster) (*etcdv1alpha1.BackupDestination, error) {
+	if cluster.Spec.Upgrade != nil && cluster.Spec.Upgrade.BackupDestination != nil {
+		return cluster.Spec.Upgrade.BackupDestination.DeepCopy(), nil
+	}
+	latest, err := latestBackup(ctx, r.Client, cluster.Namespace, cluster.Name)
+	if err != nil || latest == nil {
+		return nil, err
+	}
+	// 路径和名字按新备份的名字生成
+	dest := latest.Spec.Destination.DeepCopy()
+	if dest.PVC != nil {
+		dest.PVC.Path = ""
+	}
+	if dest.S3 != nil {
+		dest.S3.Key = ""
+	}
+	if dest.VolumeSnapshot != nil {
+		dest.VolumeSnapshot.Name = ""
+	}
+	return dest, nil
+}
+
+// rollUpgrade restarts the members whose pods still run the old template, and
+// completes the upgrade once every member reports the new version.
+func (r *EtcdClusterReconciler) rollUpgrade(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, state *clusterState) (bool, error) {
+	u := cluster.Status.Upgrade
+	setCondition(cluster, etcdv1alpha1.ConditionProgressing, metav1.ConditionTrue, etcdv1alpha1.ReasonUpgrading,
+		fmt.Sprintf("upgrading from %s to %s, %d of %d members done", u.FromVersion, u.ToVersion, sts.Status.UpdatedReplicas, *sts.Spec.Replicas))
+	// statefulset 看到新模板之后才有新的 revision
+	if state == nil || sts.Status.ObservedGeneration < sts.Generation || sts.Status.UpdateRevision == "" {
+		return true, nil
+	}
+	u.UpdatedMembers = sts.Status.UpdatedReplicas
+	pods, err := r.listMemberPods(ctx, cluster)
+	if err != nil {
+		return false, err
+	}
+	if failed := failedMember(cluster, pods, state, sts.Status.UpdateRevision, memberHealthTimeout(cluster)); failed != "" {
+		return r.startRollback(ctx, cluster, state, pods, sts.Status.UpdateRevision,
+			fmt.Sprintf("member %s was not healthy within %s after it was restarted on %s", failed, memberHealthTimeout(cluster), u.ToVersion))
+	}
+	changed, err := r.restartMembers(ctx, cluster, state, outdatedPod(sts.Status.UpdateRevision),
+		fmt.Sprintf("upgrading to %s", u.ToVersion))
+	if changed || err != nil {
+		return changed, err
+	}
+	if sts.Status.UpdatedReplicas != *sts.Spec.Replicas || !state.allHealthy() ||
+		state.serverVersion() != u.ToVersion {
+		u.Message = "waiting for the restarted members to become healthy"
+		return true, nil
+	}
+	now := metav1.Now()
+	u.Phase = etcdv1alpha1.UpgradePhaseCompleted
+	u.CompletionTime = &now
+	u.Message = ""
+	// etcd 在所有成员都降级之后自己结束降级
+	u.DowngradeEnabled = false
+	setCondition(cluster, etcdv1alpha1.ConditionUpgradeFailed, metav1.ConditionFalse, etcdv1alpha1.ReasonUpgradeSucceeded,
+		fmt.Sprintf("upgraded from %s to %s", u.FromVersion, u.ToVersion))
+	r.Recorder.Eventf(cluster, corev1.EventTypeNormal, "UpgradeCompleted", "every member runs %s", u.ToVersion)
+	return false, nil
+}
+
+// failedMember returns a member whose pod runs the given revision for longer than
+// timeout without the member being healthy.
+func failedMember(cluster *etcdv1alpha1.EtcdCluster, pods []corev1.Pod, state *clusterState, revision string, timeout time.Duration) string {
+	for _, pod := range pods {
+		if outdatedPod(revision)(&pod) || time.Since(pod.CreationTimestamp.Time) < timeout {
+			continue
+		}
+		if state != nil {
+			if m := state.memberByName(cluster, pod.Name); m != nil {
+				if _, ok := state.statuses[m.ID]; ok {
+					continue
+				}
+			}
+		}
+		return pod.Name
+	}
+	return ""
+}
+
+// startRollback stops the rollout of a failed version change and puts the previous
+// image back. Once every member runs the new version etcd may have raised the cluster
+// version, and members on the previous minor version could no longer join, so only
+// patch version changes and downgrades are rolled back then. A downgrade is cancelled
+// first, members on the newer version can always join.
+func (r *EtcdClusterReconciler) startRollback(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, state *clusterState,
+	pods []corev1.Pod, revision, reason string) (bool, error) {
+	u := cluster.Status.Upgrade
+	from, err := parseVersion(u.FromVersion)
+	if err != nil {
+		return false, err
+	}
+	to, err := parseVersion(u.ToVersion)
+	if err != nil {
+		return false, err
+	}
+	upgraded := 0
+	for i := range pods {
+		if !outdatedPod(revision)(&pods[i]) {
+			upgraded++
+		}
+	}
+	if u.DowngradeEnabled {
+		if err := r.cancelDowngrade(ctx, cluster, state); err != nil {
+			return false, err
+		}
+		u.DowngradeEnabled = false
+		r.Recorder.Eventf(cluster, corev1.EventTypeNormal, "DowngradeCancelled", "cancelled the etcd downgrade to %d.%d", to.Major, to.Minor)
+	}
+	now := metav1.Now()
+	if upgraded >= len(pods) && (from.Major != to.Major || from.Minor < to.Minor) {
+		u.Phase = etcdv1alpha1.UpgradePhaseFailed
+		u.CompletionTime = &now
+		u.Message = reason + ", every member was upgraded already so the cluster version cannot go back"
+		setCondition(cluster, etcdv1alpha1.ConditionUpgradeFailed, metav1.ConditionTrue, etcdv1alpha1.ReasonRollbackNotPossible, u.Message)
+		r.Recorder.Event(cluster, corev1.EventTypeWarning, "UpgradeFailed", u.Message)
+		return false, nil
+	}
+	u.Phase = etcdv1alpha1.UpgradePhaseRollingBack
+	u.Message = reason
+	cluster.Status.Version = u.FromVersion
+	setCondition(cluster, etcdv1alpha1.ConditionUpgradeFailed, metav1.ConditionTrue, etcdv1alpha1.ReasonRollingBack,
+		fmt.Sprintf("rolling back to %s: %s", u.FromVersion, reason))
+	r.Recorder.Eventf(cluster, corev1.EventTypeWarning, "UpgradeRollingBack", "rolling back to %s: %s", u.FromVersion, reason)
+	return true, nil
+}
+
+// rollBack puts the members back on the image from before the failed version change.
+// Members that are down anyway are restarted right away, the healthy ones one at a
+// time like in an upgrade.
+func (r *EtcdClusterReconciler) rollBack(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster,
+	sts *appsv1.StatefulSet, state *clusterState) (bool, error) {
+	u := cluster.Status.Upgrade
+	if sts.Status.ObservedGeneration < sts.Generation || sts.Status.UpdateRevision == "" {
+		return true, nil
+	}
+	pods, err := r.listMemberPods(ctx, cluster)
+	if err != nil {
+		return false, err
+	}
+	reason := fmt.Sprintf("rolling back to %s", u.FromVersion)
+	for i := range pods {
+		pod := &pods[i]
+		if pod.DeletionTimestamp != nil {
+			return true, nil
+		}
+		if !outdatedPod(sts.Status.UpdateRevision)(pod) || failedMember(cluster, pods[i:i+1], state, pod.Labels[appsv1.StatefulSetRevisionLabel], 0) == "" {
+			continue
+		}
+		// 其他成员还认它做 leader 的时候交给 restartMembers 先转移
+		if state != nil {
+			if m := state.memberByName(cluster, pod.Name); m != nil && m.ID == state.leaderID {
+				continue
+			}
+		}
+		if err := r.Delete(ctx, pod); err != nil {
+			return false, err
+		}
+		r.Recorder.Eventf(cluster, corev1.EventTypeNormal, "MemberRestarted", "restarted member %s: %s", pod.Name, reason)
+		return true, nil
+	}
+	if state == nil {
+		return true, nil
+	}
+	changed, err := r.restartMembers(ctx, cluster, state, outdatedPod(sts.Status.UpdateRevision), reason)
+	if changed || err != nil {
+		return changed, err
+	}
+	if sts.Status.UpdatedReplicas != *sts.Spec.Replicas || !state.allHealthy() || state.serverVersion() != u.FromVersion {
+		return true, nil
+	}
+	now := metav1.Now()
+	u.Phase = etcdv1alpha1.UpgradePhaseRolledBack
+	u.CompletionTime = &now
+	setCondition(cluster, etcdv1alpha1.ConditionUpgradeFailed, metav1.ConditionTrue, etcdv1alpha1.ReasonRolledBack,
+		fmt.Sprintf("rolled back to %s: %s", u.FromVersion, u.Message))
+	r.Recorder.Eventf(cluster, corev1.EventTypeNormal, "UpgradeRolledBack", "every member runs %s again", u.FromVersion)
+	return false, nil
+}
+
+// outdatedPod returns a restart predicate for pods that do not run the given StatefulSet revision.
+func outdatedPod(revision string) func(*corev1.Pod) bool {
+	return func(pod *corev1.Pod) bool {
+		return pod.Labels[appsv1.StatefulSetRevisionLabel] != revision
+	}
+}
@@ -0,0 +1,100 @@
+package controllers
+
+import (
+	"testing"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/etcdserverpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+)
+
+func TestCheckVersionChange(t *testing.T) {
+	for _, tc := range []struct {
+		from, to string
+		mode     etcdv1alpha1.UpgradeMode
+		allowed  bool
+	}{
+		{"3.4.18", "3.5.1", etcdv1alpha1.UpgradeModeUpgrade, true},
+		{"3.5.1", "3.5.4", etcdv1alpha1.UpgradeModeUpgrade, true},
+		{"3.3.27", "3.5.1", etcdv1alpha1.UpgradeModeUpgrade, false},
+		{"3.5.1", "3.4.18", etcdv1alpha1.UpgradeModeUpgrade, false},
+		{"3.5.1", "3.4.18", etcdv1alpha1.UpgradeModeDowngrade, true},
+		{"3.5.1", "3.3.27", etcdv1alpha1.UpgradeModeDowngrade, false},
+		{"3.4.18", "3.3.27", etcdv1alpha1.UpgradeModeDowngrade, false},
+		{"3.4.18", "3.4.10", etcdv1alpha1.UpgradeModeDowngrade, true},
+		{"3.5.1", "4.0.0", etcdv1alpha1.UpgradeModeUpgrade, false},
+	} {
+		from, _ := parseVersion(tc.from)
+		to, _ := parseVersion(tc.to)
+		if msg := checkVersionChange(from, to, tc.mode); (msg == "") != tc.allowed {
+			t.Errorf("%s to %s in %s mode: got %q, allowed %v", tc.from, tc.to, tc.mode, msg, tc.allowed)
+		}
+	}
+}
+
+func TestVersionImage(t *testing.T) {
+	for image, want := range map[string]string{
+		"":                            "quay.io/coreos/etcd:v3.5.1",
+		"quay.io/coreos/etcd:v3.4.18": "quay.io/coreos/etcd:v3.5.1",
+		"registry.local:5000/etcd":    "registry.local:5000/etcd:v3.5.1",
+		"gcr.io/etcd-development/etcd@sha256:abc": "gcr.io/etcd-development/etcd:v3.5.1",
+		// 已经是这个版本的镜像不变，包括摘要
+		"quay.io/coreos/etcd:v3.5.1@sha256:abc":  "quay.io/coreos/etcd:v3.5.1@sha256:abc",
+		"quay.io/coreos/etcd:v3.4.18@sha256:abc": "quay.io/coreos/etcd:v3.5.1",
+		"registry.k8s.io/etcd:3.5.1-0":           "registry.k8s.io/etcd:3.5.1-0",
+		"registry.k8s.io/etcd:3.4.18-0":          "registry.k8s.io/etcd:3.5.1-0",
+		"bitnami/etcd:3.5.1":                     "bitnami/etcd:3.5.1",
+		"bitnami/etcd:3.4.18":                    "bitnami/etcd:3.5.1",
+		"registry.local:5000/etcd:latest":        "registry.local:5000/etcd:v3.5.1",
+	} {
+		if got := versionImage(image, "3.5.1"); got != want {
+			t.Errorf("image %q: got %s, want %s", image, got, want)
+		}
+	}
+
+	// 给现有集群设置 spec.version 不会改变镜像
+	cluster := &etcdv1alpha1.EtcdCluster{}
+	cluster.Spec.Image = "registry.k8s.io/etcd:3.5.1-0@sha256:abc"
+	cluster.Spec.Version = "3.5.1"
+	cluster.Status.Version = "3.5.1"
+	if got := memberImage(cluster); got != cluster.Spec.Image {
+		t.Errorf("member image %s, want %s", got, cluster.Spec.Image)
+	}
+}
+
+func TestFailedMember(t *testing.T) {
+	cluster := &etcdv1alpha1.EtcdCluster{}
+	pod := func(name, revision string, age time.Duration) corev1.Pod {
+		var p corev1.Pod
+		p.Name = name
+		p.Labels = map[string]string{appsv1.StatefulSetRevisionLabel: revision}
+		p.CreationTimestamp = metav1.NewTime(time.Now().Add(-age))
+		return p
+	}
+	state := &clusterState{
+		members:  []*etcdserverpb.Member{{ID: 1, Name: "etcd-0"}, {ID: 2, Name: "etcd-1"}, {ID: 3, Name: "etcd-2"}},
+		statuses: map[uint64]*clientv3.StatusResponse{1: {}, 3: {}},
+	}
+	pods := []corev1.Pod{
+		pod("etcd-0", "old", time.Hour),
+		pod("etcd-1", "old", time.Hour),
+		pod("etcd-2", "new", time.Hour),
+	}
+	// 没升级的成员不健康不算升级失败
+	if m := failedMember(cluster, pods, state, "new", time.Minute); m != "" {
+		t.Errorf("got %q for an unhealthy member on the old revision", m)
+	}
+	pods[1] = pod("etcd-1", "new", 30*time.Second)
+	if m := failedMember(cluster, pods, state, "new", time.Minute); m != "" {
+		t.Errorf("got %q before the timeout", m)
+	}
+	pods[1] = pod("etcd-1", "new", 2*time.Minute)
+	if m := failedMember(cluster, pods, state, "new", time.Minute); m != "etcd-1" {
+		t.Errorf("got %q, want etcd-1", m)
+	}
+}
@@ -0,0 +1,236 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+)
+
+// VolumeSnapshots are handled as unstructured objects, the snapshot CRDs are only
+// needed in clusters that use them.
+var volumeSnapshotGVK = schema.GroupVersionKind{Group: "snapshot.storage.k8s.io", Version: "v1", Kind: "VolumeSnapshot"}
+
+const (
+	// volumeSnapshotPollPeriod is how often a running volume snapshot backup is looked
+	// at, VolumeSnapshots are not watched.
+	volumeSnapshotPollPeriod = 5 * time.Second
+	// quiesceTimeout is how long stopping the member and cutting the snapshot may take.
+	quiesceTimeout = 10 * time.Minute
+)
+
+//+kubebuilder:rbac:groups=snapshot.storage.k8s.io,resources=volumesnapshots,verbs=get;list;watch;create;delete
+//+kubebuilder:rbac:groups=etcd.gqq.com,resources=etcdclusters,verbs=get;list;watch;update;patch
+
+func volumeSnapshotName(etcdbackup *etcdv1alpha1.EtcdBackup) string {
+	if name := etcdbackup.Spec.Destination.VolumeSnapshot.Name; name != "" {
+		return name
+	}
+	return etcdbackup.Name
+}
+
+func newVolumeSnapshot() *unstructured.Unstructured {
+	vs := &unstructured.Unstructured{}
+	vs.SetGroupVersionKind(volumeSnapshotGVK)
+	return vs
+}
+
+// quiesceMember picks the member whose volume is snapshotted: the healthy follower that
+// applied the most raft entries. Stopping it has to leave a quorum of healthy voting
+// members, so clusters with fewer than three members cannot take volume snapshots.
+func quiesceMember(cluster *etcdv1alpha1.EtcdCluster) string {
+	var follower string
+	var index uint64
+	voters, healthy := 0, 0
+	for _, m := range cluster.Status.Members {
+		if m.IsLearner {
+			continue
+		}
+		voters++
+		if !m.Healthy || m.Name == "" {
+			continue
+		}
+		healthy++
+		if !m.IsLeader && (follower == "" || m.RaftIndex > index) {
+			follower, index = m.Name, m.RaftIndex
+		}
+	}
+	if follower == "" || healthy-1 < quorum(voters) {
+		return ""
+	}
+	return follower
+}
+
+// reconcileVolumeSnapshot takes the snapshot of a backup with a VolumeSnapshot
+// destination. It asks the cluster to stop a follower, snapshots its data volume once
+// it is down, and lets the member start again as soon as the snapshot was cut. The
+// backup completes when the snapshot is ready to use.
+func (r *EtcdBackupReconciler) reconcileVolumeSnapshot(ctx context.Context, etcdbackup *etcdv1alpha1.EtcdBackup) (ctrl.Result, error) {
+	if err := validateWritableDestination(&etcdbackup.Spec.Destination); err != nil {
+		r.failBackup(etcdbackup, err.Error())
+		return ctrl.Result{}, nil
+	}
+	running := etcdbackup.Status.Phase == etcdv1alpha1.BackupPhaseRunning
+	var cluster etcdv1alpha1.EtcdCluster
+	err := r.Get(ctx, types.NamespacedName{Namespace: etcdbackup.Namespace, Name: etcdbackup.Spec.ClusterName}, &cluster)
+	switch {
+	case apierrors.IsNotFound(err) && running:
+		r.failBackup(etcdbackup, fmt.Sprintf("EtcdCluster %s was deleted", etcdbackup.Spec.ClusterName))
+		return ctrl.Result{}, nil
+	case apierrors.IsNotFound(err):
+		etcdbackup.Status.Phase = etcdv1alpha1.BackupPhasePending
+		etcdbackup.Status.Message = fmt.Sprintf("EtcdCluster %s not found", etcdbackup.Spec.ClusterName)
+		return ctrl.Result{RequeueAfter: backupPendingRequeuePeriod}, nil
+	case err != nil:
+		return ctrl.Result{}, err
+	}
+	if !running {
+		return r.startVolumeSnapshot(ctx, etcdbackup, &cluster)
+	}
+
+	member := etcdbackup.Status.Member
+	vs := newVolumeSnapshot()
+	err = r.Get(ctx, types.NamespacedName{Namespace: etcdbackup.Namespace, Name: etcdbackup.Status.Path}, vs)
+	if apierrors.IsNotFound(err) {
+		if time.Since(etcdbackup.Status.StartTime.Time) > quiesceTimeout {
+			r.failBackup(etcdbackup, fmt.Sprintf("member %s was not stopped within %s", member, quiesceTimeout))
+			return ctrl.Result{}, r.releaseQuiesce(ctx, &cluster, member)
+		}
+		stopped, err := r.memberStopped(ctx, &cluster, member)
+		if err != nil || !stopped {
+			return ctrl.Result{RequeueAfter: volumeSnapshotPollPeriod}, err
+		}
+		if err := r.Create(ctx, r.volumeSnapshotFor(etcdbackup, member)); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{RequeueAfter: volumeSnapshotPollPeriod}, nil
+	}
+	if err != nil {
+		return ctrl.Result{}, err
+	}
+
+	if msg, found, _ := unstructured.NestedString(vs.Object, "status", "error", "message"); found {
+		r.failBackup(etcdbackup, fmt.Sprintf("volume snapshot %s failed: %s", vs.GetName(), msg))
+		return ctrl.Result{}, r.releaseQuiesce(ctx, &cluster, member)
+	}
+	// 快照切好之后成员就可以恢复了，不用等上传完成
+	if _, found, _ := unstructured.NestedString(vs.Object, "status", "creationTime"); found {
+		if err := r.releaseQuiesce(ctx, &cluster, member); err != nil {
+			return ctrl.Result{}, err
+		}
+	} else if time.Since(etcdbackup.Status.StartTime.Time) > quiesceTimeout {
+		r.failBackup(etcdbackup, fmt.Sprintf("volume snapshot %s was not taken within %s", vs.GetName(), quiesceTimeout))
+		return ctrl.Result{}, r.releaseQuiesce(ctx, &cluster, member)
+	}
+	if ready, _, _ := unstructured.NestedBool(vs.Object, "status", "readyToUse"); !ready {
+		return ctrl.Result{RequeueAfter: volumeSnapshotPollPeriod}, nil
+	}
+	if size, found, _ := unstructured.NestedString(vs.Object, "status", "restoreSize"); found {
+		if q, err := resource.ParseQuantity(size); err == nil {
+			etcdbackup.Status.Size = q.Value()
+		}
+	}
+	now := metav1.Now()
+	etcdbackup.Status.Phase = etcdv1alpha1.BackupPhaseCompleted
+	etcdbackup.Status.CompletionTime = &now
+	etcdbackup.Status.Message = ""
+	r.Recorder.Eventf(etcdbackup, corev1.EventTypeNormal, "BackupCompleted", "volume snapshot %s of member %s is ready", vs.GetName(), member)
+	return ctrl.Result{}, nil
+}
+
+// startVolumeSnapshot asks the cluster to stop the member whose volume is snapshotted.
+// Only one member of a cluster is stopped at a time.
+func (r *EtcdBackupReconciler) startVolumeSnapshot(ctx context.Context, etcdbackup *etcdv1alpha1.EtcdBackup, cluster *etcdv1alpha1.EtcdCluster) (ctrl.Result, error) {
+	member := quiesceMember(cluster)
+	if member == "" {
+		etcdbackup.Status.Phase = etcdv1alpha1.BackupPhasePending
+		etcdbackup.Status.Message = "waiting for a healthy follower that can be stopped without losing quorum"
+		return ctrl.Result{RequeueAfter: backupPendingRequeuePeriod}, nil
+	}
+	if other := cluster.Annotations[QuiesceMemberAnnotation]; other != "" && other != member {
+		etcdbackup.Status.Phase = etcdv1alpha1.BackupPhasePending
+		etcdbackup.Status.Message = "waiting for another volume snapshot of the cluster to finish"
+		return ctrl.Result{RequeueAfter: backupPendingRequeuePeriod}, nil
+	}
+	patch := client.MergeFrom(cluster.DeepCopy())
+	if cluster.Annotations == nil {
+		cluster.Annotations = map[string]string{}
+	}
+	cluster.Annotations[QuiesceMemberAnnotation] = member
+	if err := r.Patch(ctx, cluster, patch); err != nil {
+		return ctrl.Result{}, err
+	}
+
+	now := metav1.Now()
+	etcdbackup.Status.Phase = etcdv1alpha1.BackupPhaseRunning
+	etcdbackup.Status.Member = member
+	etcdbackup.Status.Path = volumeSnapshotName(etcdbackup)
+	etcdbackup.Status.StartTime = &now
+	etcdbackup.Status.Message = ""
+	r.Recorder.Eventf(etcdbackup, corev1.EventTypeNormal, "BackupStarted", "stopping member %s of %s to take a volume snapshot", member, cluster.Name)
+	return ctrl.Result{RequeueAfter: volumeSnapshotPollPeriod}, nil
+}
+
+// memberStopped reports whether the cluster stopped the member and its old pod is gone.
+// The pod that replaces it cannot start etcd and leaves the volume alone.
+func (r *EtcdBackupReconciler) memberStopped(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, member string) (bool, error) {
+	q := cluster.Status.QuiescedMember
+	if q == nil || q.Name != member {
+		return false, nil
+	}
+	var pod corev1.Pod
+	err := r.Get(ctx, types.NamespacedName{Namespace: cluster.Namespace, Name: member}, &pod)
+	if apierrors.IsNotFound(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return pod.DeletionTimestamp.IsZero() && !pod.CreationTimestamp.Before(&q.Since), nil
+}
+
+// releaseQuiesce lets the cluster start the member again.
+func (r *EtcdBackupReconciler) releaseQuiesce(ctx context.Context, cluster *etcdv1alpha1.EtcdCluster, member string) error {
+	if cluster.Annotations[QuiesceMemberAnnotation] != member {
+		return nil
+	}
+	patch := client.MergeFrom(cluster.DeepCopy())
+	delete(cluster.Annotations, QuiesceMemberAnnotation)
+	return r.Patch(ctx, cluster, patch)
+}
+
+// volumeSnapshotFor returns the VolumeSnapshot of the data volume of member. It is not
+// owned by the backup, the deletion policy decides whether it is deleted with it.
+func (r *EtcdBackupReconciler) volumeSnapshotFor(etcdbackup *etcdv1alpha1.EtcdBackup, member string) *unstructured.Unstructured {
+	vs := newVolumeSnapshot()
+	vs.SetNamespace(etcdbackup.Namespace)
+	vs.SetName(etcdbackup.Status.Path)
+	vs.SetLabels(map[string]string{EtcdClusterLabelKey: etcdbackup.Spec.ClusterName})
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{"persistentVolumeClaimName": memberVolumeName(member)},
+	}
+	if class := etcdbackup.Spec.Destination.VolumeSnapshot.ClassName; class != "" {
+		spec["volumeSnapshotClassName"] = class
+	}
+	vs.Object["spec"] = spec
+	return vs
+}
+
+// deleteVolumeSnapshot deletes the VolumeSnapshot of a backup with the Delete policy.
+func (r *EtcdBackupReconciler) deleteVolumeSnapshot(ctx context.Context, etcdbackup *etcdv1alpha1.EtcdBackup) error {
+	vs := newVolumeSnapshot()
+	vs.SetNamespace(etcdbackup.Namespace)
+	vs.SetName(etcdbackup.Status.Path)
+	return client.IgnoreNotFound(r.Delete(ctx, vs))
+}
@@ -0,0 +1,30 @@
+package controllers
+
+import (
+	"testing"
+
+	etcdv1alpha1 "github.com/gqq/etcd-operator/api/v1alpha1"
+)
+
+func TestQuiesceMemberKeepsQuorum(t *testing.T) {
+	cluster := &etcdv1alpha1.EtcdCluster{}
+	cluster.Status.Members = []etcdv1alpha1.MemberStatus{
+		{Name: "etcd-0", Healthy: true, IsLeader: true, RaftIndex: 120},
+		{Name: "etcd-1", Healthy: true, RaftIndex: 100},
+		{Name: "etcd-2", Healthy: true, RaftIndex: 110},
+	}
+	if m := quiesceMember(cluster); m != "etcd-2" {
+		t.Errorf("picked %q, want etcd-2", m)
+	}
+	// 再停一个就没有 quorum 了
+	cluster.Status.Members[2].Healthy = false
+	if m := quiesceMember(cluster); m != "" {
+		t.Errorf("picked %q with one member down", m)
+	}
+	// 单成员和两成员的集群都停不起
+	cluster.Status.Members = cluster.Status.Members[:2]
+	cluster.Status.Members[1].Healthy = true
+	if m := quiesceMember(cluster); m != "" {
+		t.Errorf("picked %q in a two member cluster", m)
+	}
+}
@@ -0,0 +1,433 @@
+package backup
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/client/pkg/v3/transport"
+	"go.uber.org/zap"
+)
+
+// Environment variables the agent reads the S3 credentials from, so they never show up in the pod spec.
+const (
+	AccessKeyIDEnv     = "AWS_ACCESS_KEY_ID"
+	SecretAccessKeyEnv = "AWS_SECRET_ACCESS_KEY"
+)
+
+// AgentCommand is the first argument that makes the manager binary run as the agent.
+const AgentCommand = "agent"
+
+// RunAgent runs one agent command, for example
+//
+//	manager agent backup --endpoint https://etcd-0.etcd.default.svc.cluster.local:2379 --dir /backup --path etcd.db
+//
+// The result is written as JSON to the result file, which defaults to the
+// termination message of the container, where the operator picks it up.
+func RunAgent(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: agent <backup|restore|delete|changelog|rekey|verify> [flags]")
+	}
+	switch args[0] {
+	case "backup":
+		return runBackup(ctx, args[1:])
+	case "restore":
+		return runRestore(ctx, args[1:])
+	case "delete":
+		return runDelete(ctx, args[1:])
+	case "changelog":
+		return runChangeLog(ctx, args[1:])
+	case "rekey":
+		return runRekey(ctx, args[1:])
+	case "verify":
+		return runVerify(ctx, args[1:])
+	default:
+		return fmt.Errorf("unknown agent command %q", args[0])
+	}
+}
+
+// storageFlags select the Storage of an agent command.
+type storageFlags struct {
+	dir        string
+	s3Endpoint string
+	s3Bucket   string
+	s3Region   string
+	s3Insecure bool
+	keysDir    string
+	keyID      string
+}
+
+func (f *storageFlags) bind(fs *flag.FlagSet) {
+	fs.StringVar(&f.dir, "dir", "", "Directory snapshots are kept in.")
+	fs.StringVar(&f.s3Endpoint, "s3-endpoint", "", "Endpoint of the S3 compatible service snapshots are kept in.")
+	fs.StringVar(&f.s3Bucket, "s3-bucket", "", "Bucket snapshots are kept in.")
+	fs.StringVar(&f.s3Region, "s3-region", "", "Region of the bucket.")
+	fs.BoolVar(&f.s3Insecure, "s3-insecure", false, "Use plain HTTP to talk to the S3 endpoint.")
+	fs.StringVar(&f.keysDir, "keys-dir", "", "Directory with the encryption keys, one file per key ID.")
+	fs.StringVar(&f.keyID, "key-id", "", "Key new snapshots are encrypted with.")
+}
+
+func (f *storageFlags) keyring() (Keyring, error) {
+	if f.keysDir == "" {
+		if f.keyID != "" {
+			return nil, errors.New("--key-id requires --keys-dir")
+		}
+		return nil, nil
+	}
+	keys, err := LoadKeyring(f.keysDir)
+	if err != nil {
+		return nil, fmt.Errorf("load encryption keys: %w", err)
+	}
+	return keys, nil
+}
+
+// sealingKeyring is keyring for commands that write, which fail early when the key
+// they are asked to encrypt with is missing.
+func (f *storageFlags) sealingKeyring() (Keyring, error) {
+	keys, err := f.keyring()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := keys[f.keyID]; f.keyID != "" && !ok {
+		return nil, fmt.Errorf("encryption key %q not found in %s", f.keyID, f.keysDir)
+	}
+	return keys, nil
+}
+
+func (f *storageFlags) storage() (Storage, error) {
+	switch {
+	case f.dir != "" && f.s3Bucket != "":
+		return nil, errors.New("--dir and --s3-bucket are mutually exclusive")
+	case f.dir != "":
+		return NewFileStorage(f.dir), nil
+	case f.s3Bucket != "":
+		return NewS3Storage(S3Config{
+			Endpoint:        f.s3Endpoint,
+			Bucket:          f.s3Bucket,
+			Region:          f.s3Region,
+			Insecure:        f.s3Insecure,
+			AccessKeyID:     os.Getenv(AccessKeyIDEnv),
+			SecretAccessKey: os.Getenv(SecretAccessKeyEnv),
+		})
+	default:
+		return nil, errors.New("one of --dir and --s3-bucket is required")
+	}
+}
+
+// etcdFlags select the member an agent command talks to.
+type etcdFlags struct {
+	endpoint string
+	cacert   string
+	cert     string
+	key      string
+}
+
+func (f *etcdFlags) bind(fs *flag.FlagSet) {
+	fs.StringVar(&f.endpoint, "endpoint", "", "Client URL of the etcd member.")
+	fs.StringVar(&f.cacert, "cacert", "", "CA bundle to verify the member with.")
+	fs.StringVar(&f.cert, "cert", "", "Client certificate.")
+	fs.StringVar(&f.key, "key", "", "Client key.")
+}
+
+func (f *etcdFlags) tlsInfo() transport.TLSInfo {
+	return transport.TLSInfo{CertFile: f.cert, KeyFile: f.key, TrustedCAFile: f.cacert}
+}
+
+func runBackup(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	var sf storageFlags
+	var ef etcdFlags
+	sf.bind(fs)
+	ef.bind(fs)
+	path := fs.String("path", "", "Path of the snapshot in the storage.")
+	scratch := fs.String("scratch-dir", os.TempDir(), "Directory the snapshot is verified in before it is stored.")
+	timeout := fs.Duration("timeout", 10*time.Minute, "How long fetching the snapshot may take.")
+	resultFile := fs.String("result-file", "/dev/termination-log", "File the JSON result is written to.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if ef.endpoint == "" || *path == "" {
+		return errors.New("--endpoint and --path are required")
+	}
+	storage, err := sf.storage()
+	if err != nil {
+		return err
+	}
+	opts := SaveOptions{Endpoint: ef.endpoint, ScratchDir: *scratch, Timeout: *timeout, KeyID: sf.keyID}
+	if opts.Keys, err = sf.sealingKeyring(); err != nil {
+		return err
+	}
+	if ef.cert != "" {
+		if opts.TLS, err = ef.tlsInfo().ClientConfig(); err != nil {
+			return fmt.Errorf("load client certificate: %w", err)
+		}
+	}
+	lg, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	defer lg.Sync()
+
+	result, err := Save(ctx, lg, opts, storage, *path)
+	if err != nil {
+		return err
+	}
+	lg.Info("snapshot stored", zap.String("path", result.Path), zap.Int64("revision", result.Revision),
+		zap.Int64("size", result.Size), zap.String("sha256", result.SHA256))
+	return writeResult(*resultFile, result)
+}
+
+func runRestore(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	var sf storageFlags
+	var ef etcdFlags
+	sf.bind(fs)
+	ef.bind(fs)
+	var opts RestoreOptions
+	path := fs.String("path", "", "Path of the snapshot in the storage.")
+	peerURLs := fs.String("initial-advertise-peer-urls", "", "Comma separated peer URLs of the member.")
+	fs.StringVar(&opts.Name, "name", "", "Name of the member.")
+	fs.StringVar(&opts.InitialCluster, "initial-cluster", "", "All members of the restored cluster as name=peerURL.")
+	fs.StringVar(&opts.InitialClusterToken, "initial-cluster-token", "", "Token of the restored cluster.")
+	fs.StringVar(&opts.DataDir, "data-dir", "", "Data directory the member is restored into.")
+	fs.StringVar(&opts.ScratchDir, "scratch-dir", os.TempDir(), "Directory the snapshot is verified in.")
+	fs.StringVar(&opts.SHA256, "sha256", "", "Expected SHA-256 of the snapshot.")
+	timeout := fs.Duration("timeout", 10*time.Minute, "How long fetching a snapshot from --endpoint may take.")
+	fromVolume := fs.Bool("from-volume", false, "Restore the database already in --data-dir, whose volume was provisioned from a volume snapshot.")
+	var replay ReplayOptions
+	toTime := fs.String("to-time", "", "Replay the change log up to this RFC 3339 time.")
+	fs.StringVar(&replay.Dir, "changelog", "", "Directory of the change log to replay on top of the snapshot.")
+	fs.Int64Var(&replay.ToRevision, "to-revision", 0, "Replay the change log up to this revision.")
+	resultFile := fs.String("result-file", "/dev/termination-log", "File the JSON result is written to.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *toTime != "" {
+		t, err := time.Parse(time.RFC3339, *toTime)
+		if err != nil {
+			return fmt.Errorf("--to-time: %w", err)
+		}
+		replay.ToTime = t
+	}
+	if replay.Dir != "" {
+		if ef.endpoint != "" || *fromVolume {
+			return errors.New("--changelog cannot be combined with --endpoint or --from-volume")
+		}
+		opts.Replay = &replay
+	}
+	if opts.Name == "" || opts.InitialCluster == "" || opts.DataDir == "" || *peerURLs == "" {
+		return errors.New("--name, --initial-cluster, --initial-advertise-peer-urls and --data-dir are required")
+	}
+	sources := 0
+	for _, set := range []bool{*path != "", ef.endpoint != "", *fromVolume} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return errors.New("exactly one of --path, --endpoint and --from-volume is required")
+	}
+	opts.PeerURLs = strings.Split(*peerURLs, ",")
+	lg, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	defer lg.Sync()
+
+	var result *Result
+	if *fromVolume {
+		result, err = RestoreDataDir(lg, opts)
+	} else if ef.endpoint != "" {
+		// 直接从运行中的集群拉快照
+		source := SaveOptions{Endpoint: ef.endpoint, Timeout: *timeout}
+		if ef.cert != "" {
+			if source.TLS, err = ef.tlsInfo().ClientConfig(); err != nil {
+				return fmt.Errorf("load client certificate: %w", err)
+			}
+		}
+		result, err = Clone(ctx, lg, source, opts)
+	} else {
+		var storage Storage
+		if storage, err = sf.storage(); err != nil {
+			return err
+		}
+		if opts.Keys, err = sf.keyring(); err != nil {
+			return err
+		}
+		result, err = Restore(ctx, lg, storage, *path, opts)
+	}
+	if err != nil {
+		return err
+	}
+	lg.Info("snapshot restored", zap.String("member", opts.Name), zap.String("path", result.Path),
+		zap.Int64("revision", result.Revision))
+	return writeResult(*resultFile, result)
+}
+
+func runDelete(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	var sf storageFlags
+	sf.bind(fs)
+	path := fs.String("path", "", "Path of the snapshot in the storage.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return errors.New("--path is required")
+	}
+	storage, err := sf.storage()
+	if err != nil {
+		return err
+	}
+	return storage.Delete(ctx, *path)
+}
+
+func runChangeLog(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("changelog", flag.ContinueOnError)
+	var sf storageFlags
+	var ef etcdFlags
+	sf.bind(fs)
+	ef.bind(fs)
+	opts := ChangeLogOptions{}
+	fs.StringVar(&opts.Dir, "path", "", "Directory the change log segments are written to.")
+	fs.DurationVar(&opts.SegmentInterval, "segment-interval", 10*time.Second, "How often a segment is stored.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if ef.endpoint == "" || opts.Dir == "" {
+		return errors.New("--endpoint and --path are required")
+	}
+	// 监听整个集群，任何一个成员可用就能继续
+	opts.Endpoints = strings.Split(ef.endpoint, ",")
+	opts.KeyID = sf.keyID
+	storage, err := sf.storage()
+	if err != nil {
+		return err
+	}
+	if opts.Keys, err = sf.sealingKeyring(); err != nil {
+		return err
+	}
+	if ef.cert != "" {
+		if opts.TLS, err = ef.tlsInfo().ClientConfig(); err != nil {
+			return fmt.Errorf("load client certificate: %w", err)
+		}
+	}
+	lg, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	defer lg.Sync()
+	return WriteChangeLog(ctx, lg, opts, storage)
+}
+
+func runRekey(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	var sf storageFlags
+	sf.bind(fs)
+	path := fs.String("path", "", "Path of the snapshot in the storage.")
+	sum := fs.String("sha256", "", "Expected SHA-256 of the snapshot.")
+	scratch := fs.String("scratch-dir", os.TempDir(), "Directory the snapshot is decrypted in.")
+	resultFile := fs.String("result-file", "/dev/termination-log", "File the JSON result is written to.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" || sf.keyID == "" {
+		return errors.New("--path and --key-id are required")
+	}
+	storage, err := sf.storage()
+	if err != nil {
+		return err
+	}
+	keys, err := sf.sealingKeyring()
+	if err != nil {
+		return err
+	}
+	lg, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	defer lg.Sync()
+
+	result, err := Rekey(ctx, storage, *path, *scratch, *sum, keys, sf.keyID)
+	if err != nil {
+		return err
+	}
+	lg.Info("snapshot re-encrypted", zap.String("path", result.Path), zap.String("keyID", result.KeyID))
+	return writeResult(*resultFile, result)
+}
+
+// prefixFlag collects repeated --prefix flags of the form prefix=minKeys.
+type prefixFlag []PrefixCheck
+
+func (f *prefixFlag) String() string {
+	return fmt.Sprint(*f)
+}
+
+func (f *prefixFlag) Set(value string) error {
+	i := strings.LastIndex(value, "=")
+	if i < 0 {
+		return fmt.Errorf("%q is not prefix=minKeys", value)
+	}
+	min, err := strconv.ParseInt(value[i+1:], 10, 64)
+	if err != nil {
+		return fmt.Errorf("%q is not prefix=minKeys: %w", value, err)
+	}
+	*f = append(*f, PrefixCheck{Prefix: value[:i], MinKeys: min})
+	return nil
+}
+
+func runVerify(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	var sf storageFlags
+	sf.bind(fs)
+	var opts VerifyOptions
+	var prefixes prefixFlag
+	path := fs.String("path", "", "Path of the snapshot in the storage.")
+	fs.StringVar(&opts.ScratchDir, "scratch-dir", os.TempDir(), "Directory the snapshot is restored in.")
+	fs.StringVar(&opts.SHA256, "sha256", "", "Expected SHA-256 of the snapshot.")
+	fs.Int64Var(&opts.Revision, "revision", 0, "Expected revision of the snapshot.")
+	fs.Int64Var(&opts.ExpectedKeys, "keys", 0, "Expected number of keys.")
+	fs.Var(&prefixes, "prefix", "Minimum number of keys below a prefix as prefix=minKeys, may be repeated.")
+	resultFile := fs.String("result-file", "/dev/termination-log", "File the JSON result is written to.")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *path == "" {
+		return errors.New("--path is required")
+	}
+	opts.Prefixes = prefixes
+	storage, err := sf.storage()
+	if err != nil {
+		return err
+	}
+	if opts.Keys, err = sf.keyring(); err != nil {
+		return err
+	}
+	lg, err := zap.NewProduction()
+	if err != nil {
+		return err
+	}
+	defer lg.Sync()
+
+	result, err := Verify(ctx, lg, storage, *path, opts)
+	if err != nil {
+		return err
+	}
+	lg.Info("snapshot verified", zap.String("path", result.Path), zap.Int64("revision", result.Revision),
+		zap.Int64("keys", result.Keys))
+	return writeResult(*resultFile, result)
+}
+
+func writeResult(file string, result interface{}) error {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, data, 0644)
+}
@@ -0,0 +1,353 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/etcdutl/v3/snapshot"
+	"go.uber.org/zap"
+)
+
+// The change log records every revision of a cluster so that a restore can replay
+// the writes made after a snapshot was taken. It is kept as segments of gzip
+// compressed JSON lines, one Record per line, named after the first and the last
+// revision they hold.
+const segmentSuffix = ".jsonl.gz"
+
+// Record is one revision of the change log, the changes of a single etcd transaction.
+type Record struct {
+	Revision int64 `json:"rev"`
+	// Time is when the writer received the revision. etcd keeps no timestamps, so it
+	// trails the write by the latency of the watch.
+	Time   time.Time `json:"time"`
+	Events []Event   `json:"events"`
+}
+
+// Event is a put or a delete of a single key. Leases are not recorded, a replayed key
+// does not expire.
+type Event struct {
+	Delete bool   `json:"delete,omitempty"`
+	Key    []byte `json:"key"`
+	Value  []byte `json:"value,omitempty"`
+}
+
+// segment is a stored part of the change log.
+type segment struct {
+	path        string
+	first, last int64
+}
+
+// segmentName returns the path of the segment holding the revisions first to last.
+// The zero padding keeps the segments of a directory in revision order.
+func segmentName(dir string, first, last int64) string {
+	return path.Join(dir, fmt.Sprintf("%020d-%020d%s", first, last, segmentSuffix))
+}
+
+// listSegments returns the segments stored below dir in revision order.
+func listSegments(ctx context.Context, storage Storage, dir string) ([]segment, error) {
+	paths, err := storage.List(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	var segments []segment
+	for _, p := range paths {
+		name := path.Base(p)
+		if !strings.HasSuffix(name, segmentSuffix) {
+			continue
+		}
+		s := segment{path: p}
+		if _, err := fmt.Sscanf(strings.TrimSuffix(name, segmentSuffix), "%d-%d", &s.first, &s.last); err != nil {
+			continue
+		}
+		segments = append(segments, s)
+	}
+	return segments, nil
+}
+
+// storeSegment writes records as one segment.
+func storeSegment(ctx context.Context, storage Storage, dir string, records []Record, keys Keyring, keyID string) error {
+	if len(records) == 0 {
+		return nil
+	}
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var sw io.WriteCloser
+	if keyID != "" {
+		var err error
+		if sw, err = newSealWriter(&buf, keys, keyID); err != nil {
+			return err
+		}
+		w = sw
+	}
+	zw := gzip.NewWriter(w)
+	enc := json.NewEncoder(zw)
+	for i := range records {
+		if err := enc.Encode(&records[i]); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if sw != nil {
+		if err := sw.Close(); err != nil {
+			return err
+		}
+	}
+	name := segmentName(dir, records[0].Revision, records[len(records)-1].Revision)
+	return storage.Put(ctx, name, &buf, int64(buf.Len()))
+}
+
+// ChangeLogOptions configures WriteChangeLog.
+type ChangeLogOptions struct {
+	// Endpoints are the client URLs of the members to watch.
+	Endpoints []string
+	TLS       *tls.Config
+	// Dir is the directory the segments are written to.
+	Dir string
+	// SegmentInterval is how often the revisions received since the last segment are
+	// stored as a new one. It bounds how much a restore can lose.
+	SegmentInterval time.Duration
+	// Keys and KeyID encrypt the segments. They are stored as is when KeyID is empty.
+	Keys  Keyring
+	KeyID string
+}
+
+// WriteChangeLog watches every key of the cluster and stores what changed as a new
+// segment every SegmentInterval. It picks up after the last stored segment, so a
+// restarted writer loses nothing unless the missed revisions were compacted in the
+// meantime. It runs until ctx is done or storing a segment fails.
+func WriteChangeLog(ctx context.Context, lg *zap.Logger, opts ChangeLogOptions, storage Storage) error {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   opts.Endpoints,
+		DialTimeout: 10 * time.Second,
+		TLS:         opts.TLS,
+	})
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	segments, err := listSegments(ctx, storage, opts.Dir)
+	if err != nil {
+		return err
+	}
+	var next int64
+	if len(segments) > 0 {
+		next = segments[len(segments)-1].last + 1
+	} else {
+		// 第一次启动从当前 revision 开始记录，之前的数据由快照覆盖
+		resp, err := cli.Get(ctx, "\x00", clientv3.WithFromKey(), clientv3.WithCountOnly())
+		if err != nil {
+			return fmt.Errorf("get current revision: %w", err)
+		}
+		next = resp.Header.Revision + 1
+	}
+	lg.Info("writing change log", zap.String("dir", opts.Dir), zap.Int64("revision", next))
+
+	watch := func(rev int64) (clientv3.WatchChan, context.CancelFunc) {
+		watchCtx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+		return cli.Watch(watchCtx, "", clientv3.WithPrefix(), clientv3.WithRev(rev)), cancel
+	}
+	wch, cancel := watch(next)
+	defer func() { cancel() }()
+	ticker := time.NewTicker(opts.SegmentInterval)
+	defer ticker.Stop()
+
+	var pending []Record
+	flush := func(ctx context.Context) error {
+		if err := storeSegment(ctx, storage, opts.Dir, pending, opts.Keys, opts.KeyID); err != nil {
+			return fmt.Errorf("store change log segment: %w", err)
+		}
+		pending = nil
+		return nil
+	}
+	for {
+		select {
+		case <-ticker.C:
+			if err := flush(ctx); err != nil {
+				return err
+			}
+		case resp, ok := <-wch:
+			if ctx.Err() != nil {
+				// 退出之前把已经收到的修改写掉
+				storeCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+				defer cancel()
+				return flush(storeCtx)
+			}
+			if !ok {
+				return errors.New("watch closed")
+			}
+			if resp.CompactRevision != 0 {
+				lg.Warn("revisions were compacted before they were written, the change log has a gap",
+					zap.Int64("from", next), zap.Int64("to", resp.CompactRevision-1))
+				if err := flush(ctx); err != nil {
+					return err
+				}
+				cancel()
+				wch, cancel = watch(resp.CompactRevision)
+				continue
+			}
+			if err := resp.Err(); err != nil {
+				return err
+			}
+			now := time.Now().UTC()
+			for _, ev := range resp.Events {
+				// 同一个事务的修改属于同一个 revision
+				rev := ev.Kv.ModRevision
+				if n := len(pending); n == 0 || pending[n-1].Revision != rev {
+					pending = append(pending, Record{Revision: rev, Time: now})
+				}
+				e := Event{Key: ev.Kv.Key}
+				if ev.Type == mvccpb.DELETE {
+					e.Delete = true
+				} else {
+					e.Value = ev.Kv.Value
+				}
+				r := &pending[len(pending)-1]
+				r.Events = append(r.Events, e)
+				next = rev + 1
+			}
+		}
+	}
+}
+
+// ReplayOptions selects how much of a change log is replayed on top of a snapshot.
+type ReplayOptions struct {
+	// Dir is the directory of the change log.
+	Dir string
+	// ToRevision is the last revision replayed. Zero replays to the end of the change log.
+	ToRevision int64
+	// ToTime stops the replay at the last revision received at or before it.
+	ToTime time.Time
+}
+
+// stop reports whether the replay ends before r.
+func (o ReplayOptions) stop(r *Record) bool {
+	return (o.ToRevision != 0 && r.Revision > o.ToRevision) || (!o.ToTime.IsZero() && r.Time.After(o.ToTime))
+}
+
+// replay applies the change log on top of the snapshot at dbPath and returns the path
+// of a snapshot of the result. The snapshot is loaded into a temporary single member
+// etcd, every revision after the snapshot's is applied as one transaction, so the
+// revisions stay the same, and the result is saved as a new snapshot.
+func replay(ctx context.Context, lg *zap.Logger, storage Storage, dbPath, scratchDir string, opts ReplayOptions, keys Keyring) (string, error) {
+	manager := snapshot.NewV3(lg)
+	status, err := manager.Status(dbPath)
+	if err != nil {
+		return "", fmt.Errorf("verify snapshot: %w", err)
+	}
+
+	m, err := startScratchMember(lg, "replay", dbPath, scratchDir)
+	if err != nil {
+		return "", err
+	}
+	defer m.Close()
+	last, err := applyChangeLog(ctx, m.cli, storage, status.Revision, opts, keys)
+	if err != nil {
+		return "", err
+	}
+	lg.Info("replayed change log", zap.Int64("from", status.Revision), zap.Int64("to", last))
+
+	out := filepath.Join(scratchDir, "replayed.db")
+	if err := fetchFromMember(ctx, lg, SaveOptions{Endpoint: m.clientURL, Timeout: 10 * time.Minute}, out); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// applyChangeLog applies the revisions after base, and returns the last revision applied.
+func applyChangeLog(ctx context.Context, cli *clientv3.Client, storage Storage, base int64, opts ReplayOptions, keys Keyring) (int64, error) {
+	segments, err := listSegments(ctx, storage, opts.Dir)
+	if err != nil {
+		return 0, err
+	}
+	current := base
+	for _, s := range segments {
+		if s.last <= current {
+			continue
+		}
+		if s.first > current+1 {
+			return current, fmt.Errorf("the change log is missing revisions %d to %d", current+1, s.first-1)
+		}
+		done, err := applySegment(ctx, cli, storage, s, &current, opts, keys)
+		if err != nil {
+			return current, err
+		}
+		if done {
+			return current, nil
+		}
+	}
+	if opts.ToRevision > current {
+		return current, fmt.Errorf("the change log ends at revision %d, before revision %d", current, opts.ToRevision)
+	}
+	return current, nil
+}
+
+// applySegment applies the revisions of a segment that follow *current, and returns
+// true once it reached the end of the replay.
+func applySegment(ctx context.Context, cli *clientv3.Client, storage Storage, s segment, current *int64, opts ReplayOptions, keys Keyring) (bool, error) {
+	rc, err := storage.Get(ctx, s.path)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	r, _, err := openSealed(rc, keys)
+	if err != nil {
+		return false, fmt.Errorf("read segment %s: %w", s.path, err)
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return false, fmt.Errorf("read segment %s: %w", s.path, err)
+	}
+	dec := json.NewDecoder(zr)
+	for {
+		var r Record
+		err := dec.Decode(&r)
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("read segment %s: %w", s.path, err)
+		}
+		if r.Revision <= *current {
+			continue
+		}
+		if opts.stop(&r) {
+			return true, nil
+		}
+		if r.Revision != *current+1 {
+			return false, fmt.Errorf("the change log is missing revisions %d to %d", *current+1, r.Revision-1)
+		}
+		ops := make([]clientv3.Op, 0, len(r.Events))
+		for _, e := range r.Events {
+			if e.Delete {
+				ops = append(ops, clientv3.OpDelete(string(e.Key)))
+			} else {
+				ops = append(ops, clientv3.OpPut(string(e.Key), string(e.Value)))
+			}
+		}
+		resp, err := cli.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return false, fmt.Errorf("replay revision %d: %w", r.Revision, err)
+		}
+		// 每个 revision 都必须正好产生一个新的 revision，否则快照和日志对不上
+		if resp.Header.Revision != r.Revision {
+			return false, fmt.Errorf("replaying revision %d produced revision %d, the change log does not belong to the snapshot",
+				r.Revision, resp.Header.Revision)
+		}
+		*current = r.Revision
+	}
+}
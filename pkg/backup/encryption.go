@@ -0,0 +1,294 @@
+package backup
+
+import (
+	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Encrypted data starts with a header that names the key it was encrypted with,
+// followed by the plaintext in chunks sealed with AES-256-GCM. The nonce of a chunk is
+// a random prefix per file, the chunk counter and a flag on the last chunk, so chunks
+// cannot be reordered, dropped or cut off without failing authentication.
+const (
+	sealMagic       = "ETCDGCM1"
+	sealChunkSize   = 64 * 1024
+	noncePrefixSize = 7
+)
+
+// Keyring maps key IDs to 32 byte AES-256 keys.
+type Keyring map[string][]byte
+
+// LoadKeyring reads one key per file from dir, the way a Secret volume lays them out.
+// The file name is the key ID, the content 32 raw bytes or their base64 encoding.
+func LoadKeyring(dir string) (Keyring, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	keys := Keyring{}
+	for _, e := range entries {
+		// Secret volume 里以 . 开头的是原子更新用的目录和链接
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		key, err := parseKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %w", e.Name(), err)
+		}
+		keys[e.Name()] = key
+	}
+	return keys, nil
+}
+
+func parseKey(data []byte) ([]byte, error) {
+	if len(data) == 32 {
+		return data, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("must be 32 bytes, raw or base64 encoded")
+	}
+	return key, nil
+}
+
+func (k Keyring) aead(keyID string) (cipher.AEAD, error) {
+	key, ok := k[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encryption key %q not found", keyID)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// sealWriter encrypts everything written to it. Close seals the last chunk but does
+// not close the underlying writer.
+type sealWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	buf     []byte
+	out     []byte
+}
+
+// newSealWriter writes the header for keyID to w and returns a writer that encrypts
+// with that key.
+func newSealWriter(w io.Writer, keys Keyring, keyID string) (io.WriteCloser, error) {
+	if len(keyID) > math.MaxUint8 {
+		return nil, fmt.Errorf("key ID %q is too long", keyID)
+	}
+	aead, err := keys.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header := append([]byte(sealMagic), byte(len(keyID)))
+	header = append(header, keyID...)
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &sealWriter{
+		w:      w,
+		aead:   aead,
+		prefix: prefix,
+		buf:    make([]byte, 0, sealChunkSize),
+	}, nil
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		// 只有确定后面还有数据，满的块才不是最后一块
+		if len(s.buf) == sealChunkSize {
+			if err := s.flush(false); err != nil {
+				return 0, err
+			}
+		}
+		k := copy(s.buf[len(s.buf):sealChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+k]
+		p = p[k:]
+	}
+	return n, nil
+}
+
+func (s *sealWriter) Close() error {
+	return s.flush(true)
+}
+
+func (s *sealWriter) flush(last bool) error {
+	if s.counter == math.MaxUint32 {
+		return errors.New("too much data to encrypt with one nonce prefix")
+	}
+	s.out = s.aead.Seal(s.out[:0], chunkNonce(s.prefix, s.counter, last), s.buf, nil)
+	s.counter++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(s.out)
+	return err
+}
+
+// openSealed returns a reader of the plaintext of r and the ID of the key it was
+// encrypted with. Data that is not encrypted is passed through with an empty key ID,
+// so snapshots written before encryption was turned on can still be restored.
+func openSealed(r io.Reader, keys Keyring) (io.Reader, string, error) {
+	br := bufio.NewReaderSize(r, sealChunkSize)
+	magic, err := br.Peek(len(sealMagic))
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+	if string(magic) != sealMagic {
+		return br, "", nil
+	}
+	if _, err := br.Discard(len(sealMagic)); err != nil {
+		return nil, "", err
+	}
+	n, err := br.ReadByte()
+	if err != nil {
+		return nil, "", fmt.Errorf("read encryption header: %w", err)
+	}
+	header := make([]byte, int(n)+noncePrefixSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, "", fmt.Errorf("read encryption header: %w", err)
+	}
+	keyID := string(header[:n])
+	aead, err := keys.aead(keyID)
+	if err != nil {
+		return nil, keyID, err
+	}
+	return &openReader{
+		r:      br,
+		aead:   aead,
+		prefix: header[n:],
+		in:     make([]byte, sealChunkSize+aead.Overhead()),
+		buf:    make([]byte, 0, sealChunkSize),
+	}, keyID, nil
+}
+
+type openReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+	in      []byte
+	buf     []byte
+	plain   []byte
+	done    bool
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+	return n, nil
+}
+
+// next decrypts the next chunk.
+func (o *openReader) next() error {
+	n, err := io.ReadFull(o.r, o.in)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		_, err := o.r.Peek(1)
+		last = err == io.EOF
+	}
+	if n == 0 {
+		return errors.New("encrypted data is truncated")
+	}
+	plain, err := o.aead.Open(o.buf[:0], chunkNonce(o.prefix, o.counter, last), o.in[:n], nil)
+	if err != nil {
+		// 被截断时最后剩下的块不是按最后一块加密的，也会在这里失败
+		return fmt.Errorf("decrypt chunk %d: %w", o.counter, err)
+	}
+	o.counter++
+	o.plain = plain
+	o.done = last
+	return nil
+}
+
+// sealFile encrypts the file src into dst with the key keyID.
+func sealFile(src, dst string, keys Keyring, keyID string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	sw, err := newSealWriter(out, keys, keyID)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(sw, in); err != nil {
+		return err
+	}
+	if err := sw.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// Rekey encrypts the snapshot stored under path with the key keyID. The snapshot is
+// decrypted with whichever key of keys it was encrypted with, or read as is if it was
+// not encrypted, and checked against sum, if given, before it replaces the old one.
+func Rekey(ctx context.Context, storage Storage, path, scratchDir, sum string, keys Keyring, keyID string) (*Result, error) {
+	dbPath := filepath.Join(scratchDir, "snapshot.db")
+	defer os.Remove(dbPath)
+
+	got, size, err := fetch(ctx, storage, path, dbPath, keys)
+	if err != nil {
+		return nil, err
+	}
+	if sum != "" && got != sum {
+		return nil, fmt.Errorf("snapshot %s has SHA-256 %s, want %s", path, got, sum)
+	}
+	if err := put(ctx, storage, path, dbPath, keys, keyID); err != nil {
+		return nil, err
+	}
+	return &Result{Path: path, Size: size, SHA256: got, KeyID: keyID}, nil
+}
@@ -0,0 +1,64 @@
+package backup
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func seal(t *testing.T, keys Keyring, keyID string, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := newSealWriter(&buf, keys, keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSealRoundTrip(t *testing.T) {
+	keys := Keyring{"old": bytes.Repeat([]byte{1}, 32), "new": bytes.Repeat([]byte{2}, 32)}
+	for _, size := range []int{0, 1, sealChunkSize, 3*sealChunkSize + 5} {
+		data := bytes.Repeat([]byte("etcd"), size/4+1)[:size]
+		sealed := seal(t, keys, "new", data)
+
+		r, keyID, err := openSealed(bytes.NewReader(sealed), keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatalf("size %d: %v", size, err)
+		}
+		if keyID != "new" || !bytes.Equal(got, data) {
+			t.Errorf("size %d: got %d bytes with key %q", size, len(got), keyID)
+		}
+		// 截掉最后一块必须被发现
+		r, _, _ = openSealed(bytes.NewReader(sealed[:len(sealed)-1]), keys)
+		if _, err := io.ReadAll(r); err == nil {
+			t.Errorf("size %d: truncated data was accepted", size)
+		}
+	}
+}
+
+func TestOpenSealedNeedsTheRightKey(t *testing.T) {
+	keys := Keyring{"old": bytes.Repeat([]byte{1}, 32)}
+	sealed := seal(t, keys, "old", []byte("snapshot"))
+	if _, keyID, err := openSealed(bytes.NewReader(sealed), Keyring{}); err == nil || keyID != "old" {
+		t.Errorf("got key %q and error %v, want a missing key error for old", keyID, err)
+	}
+
+	// 没有加密的数据原样返回
+	r, keyID, err := openSealed(bytes.NewReader([]byte("snapshot")), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(r); keyID != "" || string(got) != "snapshot" {
+		t.Errorf("got %q with key %q for plain data", got, keyID)
+	}
+}
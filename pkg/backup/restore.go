@@ -0,0 +1,192 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"go.etcd.io/etcd/etcdutl/v3/snapshot"
+	"go.uber.org/zap"
+)
+
+// RestoreOptions configures Restore. Every member of a cluster is restored from the
+// same snapshot with the same InitialCluster and InitialClusterToken, so that they
+// agree on the member IDs and on the new cluster ID.
+type RestoreOptions struct {
+	// Name is the name of the member being restored.
+	Name string
+	// PeerURLs are the peer URLs the member advertises.
+	PeerURLs []string
+	// InitialCluster lists all members of the restored cluster as name=peerURL.
+	InitialCluster string
+	// InitialClusterToken makes the cluster ID of the restored cluster unique.
+	InitialClusterToken string
+	// DataDir is the etcd data directory the member is restored into. Anything in it is replaced.
+	DataDir string
+	// ScratchDir holds the snapshot while it is verified.
+	ScratchDir string
+	// SHA256 is the expected checksum of the snapshot, if known.
+	SHA256 string
+	// Replay, when set, replays a change log on top of the snapshot before it is restored.
+	Replay *ReplayOptions
+	// Keys decrypt the snapshot and the change log if they were encrypted.
+	Keys Keyring
+}
+
+// Restore fetches the snapshot stored under path and restores it into the data
+// directory of a single member.
+func Restore(ctx context.Context, lg *zap.Logger, storage Storage, path string, opts RestoreOptions) (*Result, error) {
+	dbPath := filepath.Join(opts.ScratchDir, "snapshot.db")
+	defer os.Remove(dbPath)
+
+	sum, size, err := fetch(ctx, storage, path, dbPath, opts.Keys)
+	if err != nil {
+		return nil, err
+	}
+	if opts.SHA256 != "" && sum != opts.SHA256 {
+		return nil, fmt.Errorf("snapshot %s has SHA-256 %s, want %s", path, sum, opts.SHA256)
+	}
+	if opts.Replay != nil {
+		// 校验和描述的是取回的快照，revision 是重放之后的
+		replayed, err := replay(ctx, lg, storage, dbPath, opts.ScratchDir, *opts.Replay, opts.Keys)
+		if err != nil {
+			return nil, fmt.Errorf("replay change log %s: %w", opts.Replay.Dir, err)
+		}
+		defer os.Remove(replayed)
+		dbPath = replayed
+	}
+	return restoreFile(lg, dbPath, path, sum, size, false, opts)
+}
+
+// RestoreDataDir restores the database that is already in the data directory, because
+// the volume was provisioned from a snapshot of another member's volume. The member's
+// WAL and identity are replaced, so it joins the restored cluster as a new member with
+// the keys the old member had applied.
+func RestoreDataDir(lg *zap.Logger, opts RestoreOptions) (*Result, error) {
+	// 数据目录会被清空，先把数据库挪到旁边
+	dbPath := filepath.Join(filepath.Dir(opts.DataDir), "volume-snapshot.db")
+	src := filepath.Join(opts.DataDir, "member", "snap", "db")
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		if err := copyFile(src, dbPath); err != nil {
+			return nil, fmt.Errorf("copy %s: %w", src, err)
+		}
+	} else if err != nil {
+		return nil, err
+	}
+	sum, size, err := fileSHA256(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	// 数据库是从成员的数据目录拿的，不是 snapshot API 写的，末尾没有校验和
+	result, err := restoreFile(lg, dbPath, src, sum, size, true, opts)
+	if err != nil {
+		return nil, err
+	}
+	return result, os.Remove(dbPath)
+}
+
+// copyFile copies src to dst through a temporary file, so that dst is either
+// complete or missing when a retried Job looks for it.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+// Clone streams a snapshot from a member of a running cluster and restores it into
+// the data directory of a single member.
+func Clone(ctx context.Context, lg *zap.Logger, source SaveOptions, opts RestoreOptions) (*Result, error) {
+	dbPath := filepath.Join(opts.ScratchDir, "snapshot.db")
+	defer os.Remove(dbPath)
+
+	if err := fetchFromMember(ctx, lg, source, dbPath); err != nil {
+		return nil, err
+	}
+	sum, size, err := fileSHA256(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	return restoreFile(lg, dbPath, source.Endpoint, sum, size, false, opts)
+}
+
+// restoreFile restores the local snapshot at dbPath, which came from source. skipHash
+// accepts a database that was copied from a data directory instead of saved as a snapshot.
+func restoreFile(lg *zap.Logger, dbPath, source, sum string, size int64, skipHash bool, opts RestoreOptions) (*Result, error) {
+	manager := snapshot.NewV3(lg)
+	status, err := manager.Status(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("verify snapshot: %w", err)
+	}
+
+	// 重试的 Job 可能留下恢复了一半的数据目录
+	if err := os.RemoveAll(opts.DataDir); err != nil {
+		return nil, err
+	}
+	err = manager.Restore(snapshot.RestoreConfig{
+		SnapshotPath:        dbPath,
+		Name:                opts.Name,
+		OutputDataDir:       opts.DataDir,
+		PeerURLs:            opts.PeerURLs,
+		InitialCluster:      opts.InitialCluster,
+		InitialClusterToken: opts.InitialClusterToken,
+		SkipHashCheck:       skipHash,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("restore snapshot into %s: %w", opts.DataDir, err)
+	}
+	return &Result{
+		Path:      source,
+		Size:      size,
+		Revision:  status.Revision,
+		SHA256:    sum,
+		TotalKeys: status.TotalKey,
+		Hash:      status.Hash,
+	}, nil
+}
+
+// fetch copies the snapshot stored under path into a local file, decrypting it with
+// keys if it was encrypted, and returns its SHA-256 and size.
+func fetch(ctx context.Context, storage Storage, path, dbPath string, keys Keyring) (string, int64, error) {
+	rc, err := storage.Get(ctx, path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+	r, _, err := openSealed(rc, keys)
+	if err != nil {
+		return "", 0, fmt.Errorf("fetch snapshot %s: %w", path, err)
+	}
+	f, err := os.OpenFile(dbPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(f, h), r)
+	if err != nil {
+		return "", 0, fmt.Errorf("fetch snapshot %s: %w", path, err)
+	}
+	if err := f.Sync(); err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
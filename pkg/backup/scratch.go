@@ -0,0 +1,100 @@
+package backup
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/etcdutl/v3/snapshot"
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.uber.org/zap"
+)
+
+// scratchMember is a temporary single member etcd loaded from a snapshot. It only
+// listens on localhost and its data is removed when it is closed.
+type scratchMember struct {
+	etcd      *embed.Etcd
+	cli       *clientv3.Client
+	clientURL string
+	dir       string
+}
+
+// startScratchMember restores the snapshot at dbPath into a new data directory below
+// scratchDir and starts a member on it.
+func startScratchMember(lg *zap.Logger, name, dbPath, scratchDir string) (*scratchMember, error) {
+	peerURL, err := localURL()
+	if err != nil {
+		return nil, err
+	}
+	clientURL, err := localURL()
+	if err != nil {
+		return nil, err
+	}
+	cfg := embed.NewConfig()
+	cfg.Name = name
+	cfg.Dir = filepath.Join(scratchDir, name+".etcd")
+	cfg.LPUrls, cfg.APUrls = []url.URL{*peerURL}, []url.URL{*peerURL}
+	cfg.LCUrls, cfg.ACUrls = []url.URL{*clientURL}, []url.URL{*clientURL}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+	// 一个 revision 里可能删除了很多 key
+	cfg.MaxTxnOps = math.MaxInt32
+	cfg.MaxRequestBytes = 64 * 1024 * 1024
+	cfg.ZapLoggerBuilder = embed.NewZapLoggerBuilder(lg.Named(name).WithOptions(zap.IncreaseLevel(zap.WarnLevel)))
+	if err := os.RemoveAll(cfg.Dir); err != nil {
+		return nil, err
+	}
+	err = snapshot.NewV3(lg).Restore(snapshot.RestoreConfig{
+		SnapshotPath:   dbPath,
+		Name:           cfg.Name,
+		OutputDataDir:  cfg.Dir,
+		PeerURLs:       []string{peerURL.String()},
+		InitialCluster: cfg.InitialCluster,
+	})
+	if err != nil {
+		os.RemoveAll(cfg.Dir)
+		return nil, fmt.Errorf("load snapshot: %w", err)
+	}
+
+	m := &scratchMember{clientURL: clientURL.String(), dir: cfg.Dir}
+	if m.etcd, err = embed.StartEtcd(cfg); err != nil {
+		m.Close()
+		return nil, fmt.Errorf("start scratch member: %w", err)
+	}
+	select {
+	case <-m.etcd.Server.ReadyNotify():
+	case <-time.After(time.Minute):
+		m.Close()
+		return nil, errors.New("scratch member did not start")
+	}
+	if m.cli, err = clientv3.New(clientv3.Config{Endpoints: []string{m.clientURL}, DialTimeout: 10 * time.Second}); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *scratchMember) Close() {
+	if m.cli != nil {
+		m.cli.Close()
+	}
+	if m.etcd != nil {
+		m.etcd.Close()
+	}
+	os.RemoveAll(m.dir)
+}
+
+// localURL returns a URL on a free local port.
+func localURL() (*url.URL, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+	return url.Parse("http://" + l.Addr().String())
+}
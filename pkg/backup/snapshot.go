@@ -0,0 +1,166 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/etcdutl/v3/snapshot"
+	"go.uber.org/zap"
+)
+
+// Result describes a snapshot that was written to a Storage.
+type Result struct {
+	// Path is where the snapshot was stored.
+	Path string `json:"path"`
+	// Size is the size of the snapshot in bytes.
+	Size int64 `json:"size"`
+	// Revision is the etcd revision the snapshot was taken at.
+	Revision int64 `json:"revision"`
+	// SHA256 is the hex encoded SHA-256 of the snapshot.
+	SHA256 string `json:"sha256"`
+	// TotalKeys is the number of keys in the backend, over all buckets.
+	TotalKeys int `json:"totalKeys"`
+	// Keys is the number of etcd keys at Revision, zero if they could not be counted.
+	Keys int64 `json:"keys,omitempty"`
+	// Hash is the crc32 hash of the backend that etcdutl snapshot status reports.
+	Hash uint32 `json:"hash"`
+	// KeyID is the key the stored snapshot is encrypted with, empty if it is not.
+	KeyID string `json:"keyID,omitempty"`
+}
+
+// SaveOptions configures Save.
+type SaveOptions struct {
+	// Endpoint is the client URL of the member the snapshot is taken from.
+	Endpoint string
+	// TLS is the client TLS configuration, nil for clusters without TLS.
+	TLS *tls.Config
+	// ScratchDir holds the snapshot while it is verified, before it is stored.
+	ScratchDir string
+	// Timeout bounds fetching the snapshot from the member.
+	Timeout time.Duration
+	// Keys and KeyID encrypt the snapshot before it is stored. It is stored as is
+	// when KeyID is empty.
+	Keys  Keyring
+	KeyID string
+}
+
+// Save streams a snapshot from a single member into a local file, checks its
+// integrity, encrypts it if asked to and stores it under path. Size and SHA256 of
+// the result describe the snapshot before it was encrypted.
+func Save(ctx context.Context, lg *zap.Logger, opts SaveOptions, storage Storage, path string) (*Result, error) {
+	dbPath := filepath.Join(opts.ScratchDir, "snapshot.db")
+	defer os.Remove(dbPath)
+
+	if err := fetchFromMember(ctx, lg, opts, dbPath); err != nil {
+		return nil, err
+	}
+	// Status opens the file as a bolt database, so a corrupt snapshot fails here
+	status, err := snapshot.NewV3(lg).Status(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("verify snapshot: %w", err)
+	}
+	sum, size, err := fileSHA256(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	// key 数量只用来校验恢复，数不出来不影响备份
+	keys, err := countKeys(ctx, opts, status.Revision)
+	if err != nil {
+		lg.Warn("could not count the keys of the snapshot", zap.Int64("revision", status.Revision), zap.Error(err))
+	}
+
+	if err := put(ctx, storage, path, dbPath, opts.Keys, opts.KeyID); err != nil {
+		return nil, err
+	}
+	return &Result{
+		Path:      path,
+		Size:      size,
+		Revision:  status.Revision,
+		SHA256:    sum,
+		TotalKeys: status.TotalKey,
+		Keys:      keys,
+		Hash:      status.Hash,
+		KeyID:     opts.KeyID,
+	}, nil
+}
+
+// countKeys returns the number of keys at rev on the member the snapshot was taken from.
+func countKeys(ctx context.Context, opts SaveOptions, rev int64) (int64, error) {
+	cli, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{opts.Endpoint},
+		DialTimeout: 10 * time.Second,
+		TLS:         opts.TLS,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer cli.Close()
+	ctx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	resp, err := cli.Get(ctx, "\x00", clientv3.WithFromKey(), clientv3.WithCountOnly(),
+		clientv3.WithRev(rev), clientv3.WithSerializable())
+	if err != nil {
+		return 0, err
+	}
+	return resp.Count, nil
+}
+
+// put stores the local file name under path, encrypted with keyID unless it is empty.
+func put(ctx context.Context, storage Storage, path, name string, keys Keyring, keyID string) error {
+	if keyID != "" {
+		sealed := name + ".sealed"
+		defer os.Remove(sealed)
+		if err := sealFile(name, sealed, keys, keyID); err != nil {
+			return fmt.Errorf("encrypt snapshot: %w", err)
+		}
+		name = sealed
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	return storage.Put(ctx, path, f, info.Size())
+}
+
+// fetchFromMember streams a snapshot from a single member into dbPath.
+func fetchFromMember(ctx context.Context, lg *zap.Logger, opts SaveOptions, dbPath string) error {
+	saveCtx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+	err := snapshot.NewV3(lg).Save(saveCtx, clientv3.Config{
+		Endpoints:   []string{opts.Endpoint},
+		DialTimeout: 10 * time.Second,
+		TLS:         opts.TLS,
+	}, dbPath)
+	if err != nil {
+		return fmt.Errorf("fetch snapshot from %s: %w", opts.Endpoint, err)
+	}
+	return nil
+}
+
+// fileSHA256 returns the hex encoded SHA-256 and the size of a file.
+func fileSHA256(name string) (string, int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
@@ -0,0 +1,174 @@
+// Package backup takes etcd snapshots and moves them between etcd and the
+// places they are kept. It runs inside the agent Jobs the operator starts, not
+// in the operator itself, because only a pod can mount the volume a snapshot is
+// written to.
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// Storage is a place snapshots are written to and read from.
+type Storage interface {
+	// Put stores size bytes read from r under path.
+	Put(ctx context.Context, path string, r io.Reader, size int64) error
+	// Get opens the snapshot stored under path. The caller must close it.
+	Get(ctx context.Context, path string) (io.ReadCloser, error)
+	// Delete removes the snapshot stored under path. Deleting a missing snapshot is not an error.
+	Delete(ctx context.Context, path string) error
+	// List returns the paths stored directly below the directory dir, sorted.
+	List(ctx context.Context, dir string) ([]string, error)
+}
+
+// fileStorage keeps snapshots in a directory, usually the mount point of a PersistentVolumeClaim.
+type fileStorage struct {
+	dir string
+}
+
+// NewFileStorage returns a Storage that keeps snapshots below dir.
+func NewFileStorage(dir string) Storage {
+	return &fileStorage{dir: dir}
+}
+
+func (s *fileStorage) Put(ctx context.Context, path string, r io.Reader, size int64) error {
+	name := filepath.Join(s.dir, filepath.Clean("/"+path))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	// 先写临时文件再改名，避免留下写了一半的快照
+	f, err := os.CreateTemp(filepath.Dir(name), ".snapshot-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), name)
+}
+
+func (s *fileStorage) Get(ctx context.Context, path string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.dir, filepath.Clean("/"+path)))
+}
+
+func (s *fileStorage) Delete(ctx context.Context, path string) error {
+	err := os.Remove(filepath.Join(s.dir, filepath.Clean("/"+path)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (s *fileStorage) List(ctx context.Context, dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, filepath.Clean("/"+dir)))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, e := range entries {
+		// 跳过还没有改名的临时文件
+		if e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		paths = append(paths, path.Join(dir, e.Name()))
+	}
+	return paths, nil
+}
+
+// S3Config is the location and credentials of an S3 compatible bucket.
+type S3Config struct {
+	// Endpoint is the host and optional port of the service, for example s3.amazonaws.com or minio:9000.
+	Endpoint string
+	Bucket   string
+	Region   string
+	// Insecure talks plain HTTP to the endpoint.
+	Insecure        bool
+	AccessKeyID     string
+	SecretAccessKey string
+}
+
+// s3Storage keeps snapshots as objects in an S3 compatible bucket.
+type s3Storage struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3Storage returns a Storage that keeps snapshots in an S3 compatible bucket.
+func NewS3Storage(cfg S3Config) (Storage, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKeyID, cfg.SecretAccessKey, ""),
+		Secure: !cfg.Insecure,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("create S3 client for %s: %w", cfg.Endpoint, err)
+	}
+	return &s3Storage{client: client, bucket: cfg.Bucket}, nil
+}
+
+func (s *s3Storage) Put(ctx context.Context, path string, r io.Reader, size int64) error {
+	_, err := s.client.PutObject(ctx, s.bucket, path, r, size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	if err != nil {
+		return fmt.Errorf("upload s3://%s/%s: %w", s.bucket, path, err)
+	}
+	return nil
+}
+
+func (s *s3Storage) Get(ctx context.Context, path string) (io.ReadCloser, error) {
+	obj, err := s.client.GetObject(ctx, s.bucket, path, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("download s3://%s/%s: %w", s.bucket, path, err)
+	}
+	// GetObject is lazy, Stat surfaces a missing object here instead of on the first read
+	if _, err := obj.Stat(); err != nil {
+		obj.Close()
+		return nil, fmt.Errorf("download s3://%s/%s: %w", s.bucket, path, err)
+	}
+	return obj, nil
+}
+
+func (s *s3Storage) Delete(ctx context.Context, path string) error {
+	if err := s.client.RemoveObject(ctx, s.bucket, path, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("delete s3://%s/%s: %w", s.bucket, path, err)
+	}
+	return nil
+}
+
+func (s *s3Storage) List(ctx context.Context, dir string) ([]string, error) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	var paths []string
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, fmt.Errorf("list s3://%s/%s: %w", s.bucket, prefix, obj.Err)
+		}
+		if strings.HasSuffix(obj.Key, "/") {
+			continue
+		}
+		paths = append(paths, obj.Key)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
@@ -0,0 +1,117 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/etcdutl/v3/snapshot"
+	"go.uber.org/zap"
+)
+
+// PrefixCheck expects at least MinKeys keys below Prefix.
+type PrefixCheck struct {
+	Prefix  string `json:"prefix"`
+	MinKeys int64  `json:"minKeys"`
+}
+
+// VerifyOptions configures Verify. Zero values skip the corresponding check.
+type VerifyOptions struct {
+	// ScratchDir holds the snapshot and the data of the scratch member.
+	ScratchDir string
+	// SHA256 is the expected checksum of the snapshot.
+	SHA256 string
+	// Revision is the revision the snapshot is expected to be at.
+	Revision int64
+	// ExpectedKeys is the number of keys the restored member is expected to serve.
+	ExpectedKeys int64
+	// Prefixes are checked on the restored member.
+	Prefixes []PrefixCheck
+	// Keys decrypt the snapshot if it was encrypted.
+	Keys Keyring
+}
+
+// PrefixResult is the number of keys found below a prefix.
+type PrefixResult struct {
+	Prefix string `json:"prefix"`
+	Keys   int64  `json:"keys"`
+}
+
+// VerifyResult describes a snapshot that was restored successfully.
+type VerifyResult struct {
+	Path     string         `json:"path"`
+	SHA256   string         `json:"sha256"`
+	Revision int64          `json:"revision"`
+	Keys     int64          `json:"keys"`
+	Prefixes []PrefixResult `json:"prefixes,omitempty"`
+}
+
+// Verify restores the snapshot stored under path into a scratch single member etcd
+// and checks that it serves what the backup promised: the same checksum, revision and
+// number of keys, and enough keys below every prefix. The first failed check is
+// returned as the error.
+func Verify(ctx context.Context, lg *zap.Logger, storage Storage, path string, opts VerifyOptions) (*VerifyResult, error) {
+	dbPath := filepath.Join(opts.ScratchDir, "snapshot.db")
+	defer os.Remove(dbPath)
+
+	sum, _, err := fetch(ctx, storage, path, dbPath, opts.Keys)
+	if err != nil {
+		return nil, err
+	}
+	if opts.SHA256 != "" && sum != opts.SHA256 {
+		return nil, fmt.Errorf("snapshot %s has SHA-256 %s, want %s", path, sum, opts.SHA256)
+	}
+	status, err := snapshot.NewV3(lg).Status(dbPath)
+	if err != nil {
+		return nil, fmt.Errorf("verify snapshot: %w", err)
+	}
+	if opts.Revision != 0 && status.Revision != opts.Revision {
+		return nil, fmt.Errorf("snapshot %s is at revision %d, want %d", path, status.Revision, opts.Revision)
+	}
+
+	m, err := startScratchMember(lg, "verify", dbPath, opts.ScratchDir)
+	if err != nil {
+		return nil, err
+	}
+	defer m.Close()
+	result := &VerifyResult{Path: path, SHA256: sum, Revision: status.Revision}
+	if result.Keys, err = countPrefix(ctx, m.cli, ""); err != nil {
+		return nil, err
+	}
+	if opts.ExpectedKeys != 0 && result.Keys != opts.ExpectedKeys {
+		return nil, fmt.Errorf("restored member has %d keys, the backup had %d", result.Keys, opts.ExpectedKeys)
+	}
+	var failed []string
+	for _, p := range opts.Prefixes {
+		n, err := countPrefix(ctx, m.cli, p.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		result.Prefixes = append(result.Prefixes, PrefixResult{Prefix: p.Prefix, Keys: n})
+		if n < p.MinKeys {
+			failed = append(failed, fmt.Sprintf("%q has %d keys, want at least %d", p.Prefix, n, p.MinKeys))
+		}
+	}
+	if len(failed) > 0 {
+		return nil, fmt.Errorf("prefix check failed: %s", strings.Join(failed, ", "))
+	}
+	return result, nil
+}
+
+// countPrefix returns the number of keys below prefix, all keys for an empty prefix.
+func countPrefix(ctx context.Context, cli *clientv3.Client, prefix string) (int64, error) {
+	var resp *clientv3.GetResponse
+	var err error
+	if prefix == "" {
+		resp, err = cli.Get(ctx, "\x00", clientv3.WithFromKey(), clientv3.WithCountOnly())
+	} else {
+		resp, err = cli.Get(ctx, prefix, clientv3.WithPrefix(), clientv3.WithCountOnly())
+	}
+	if err != nil {
+		return 0, fmt.Errorf("count keys below %q: %w", prefix, err)
+	}
+	return resp.Count, nil
+}